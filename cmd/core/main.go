@@ -33,12 +33,7 @@ var logLevelMap = map[string]log.Level{
 }
 
 func init() {
-	interlaceConfig, err := config.GetInterlaceConfig()
-	if err != nil {
-		log.Errorf("Error in loading config: %s", err.Error())
-	}
-
-	logLevelStr := interlaceConfig.LogLevel
+	logLevelStr := config.GetLogLevel()
 
 	if logLevelStr == "" {
 		logLevelStr = "info"
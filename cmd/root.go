@@ -58,6 +58,7 @@ func Execute() {
 
 func init() {
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(verifyCmd)
 	rootCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "k", "", "path to kubeconfig file")
 	rootCmd.Flags().StringVarP(&namespace, "namespace", "n", "", "target argocd-namespace")
 	rootCmd.Flags().BoolVarP(&debug, "debug", "d", false, "debug option")
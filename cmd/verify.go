@@ -0,0 +1,101 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/IBM/argocd-interlace/pkg/verify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var verifyOption verify.VerifyOption
+
+var verifyCmd = &cobra.Command{
+	Use:          "verify",
+	Short:        "Verify a signed manifest and its attestation offline",
+	SilenceUsage: true,
+	Long: `Verify the artifacts produced by argocd-interlace without running the controller.
+The DSSE signatures of the attestation and its subject digest are checked when --attestation is given,
+and the signature of every resource in the manifest is checked when --signature is given.
+With several --key, the attestation must be signed by --threshold of them, all by default.
+Artifacts signed in keyless mode are verified with --ca-roots instead of --key: the
+certificate chain of the attestation is given with --certificate, the one of the
+signature is embedded in it. The certificates must be issued to --certificate-identity
+by --certificate-oidc-issuer, and be valid at the time the transparency log entry
+given with --rekor-entry was integrated.
+The transparency log entry given with --rekor-entry is checked with the public key of the
+log given with --rekor-key: its signed entry timestamp, its inclusion proof and that it
+records a signature of the attestation.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if verifyOption.ManifestPath == "" {
+			return fmt.Errorf("--manifest is required")
+		}
+		if len(verifyOption.PublicKeyPaths) == 0 && verifyOption.CARootsPath == "" {
+			return fmt.Errorf("one of --key and --ca-roots is required")
+		}
+		if verifyOption.SignaturePath == "" && verifyOption.AttestationPath == "" {
+			return fmt.Errorf("at least one of --signature and --attestation is required")
+		}
+		if verifyOption.CARootsPath != "" && verifyOption.RekorEntryPath == "" {
+			return fmt.Errorf("--rekor-entry is required to verify certificates with --ca-roots")
+		}
+		if verifyOption.CARootsPath != "" && (verifyOption.CertificateIdentity == "" || verifyOption.CertificateOIDCIssuer == "") {
+			return fmt.Errorf("--certificate-identity and --certificate-oidc-issuer are required to verify certificates with --ca-roots")
+		}
+		if verifyOption.RekorEntryPath != "" && verifyOption.AttestationPath == "" {
+			return fmt.Errorf("--attestation is required to verify the transparency log entry")
+		}
+		if verifyOption.RekorEntryPath != "" && verifyOption.RekorPublicKeyPath == "" {
+			return fmt.Errorf("--rekor-key is required to verify the transparency log entry")
+		}
+		if verifyOption.AttestationPath != "" && len(verifyOption.PublicKeyPaths) == 0 && verifyOption.CertificatePath == "" {
+			return fmt.Errorf("--certificate is required to verify the attestation without --key")
+		}
+		keyCount := len(verifyOption.PublicKeyPaths)
+		if verifyOption.CertificatePath != "" {
+			keyCount++
+		}
+		if verifyOption.Threshold < 0 || verifyOption.Threshold > keyCount {
+			return fmt.Errorf("--threshold must be between 1 and the number of keys %d, or 0 for all of them", keyCount)
+		}
+
+		err := verify.Verify(verifyOption)
+		if err != nil {
+			return err
+		}
+
+		log.Info("Verified OK")
+		return nil
+	},
+}
+
+func init() {
+	verifyCmd.Flags().StringVarP(&verifyOption.ManifestPath, "manifest", "m", "", "path to the manifest, e.g. manifest.yaml")
+	verifyCmd.Flags().StringVarP(&verifyOption.SignaturePath, "signature", "s", "", "path to the signed manifest bundle or a resource with cosign annotations")
+	verifyCmd.Flags().StringVarP(&verifyOption.AttestationPath, "attestation", "a", "", "path to attestation.json")
+	verifyCmd.Flags().StringSliceVar(&verifyOption.PublicKeyPaths, "key", nil, "path to the public key, repeat or separate with commas for an attestation signed by several keys")
+	verifyCmd.Flags().IntVar(&verifyOption.Threshold, "threshold", 0, "number of keys that must have signed the attestation, all of them by default")
+	verifyCmd.Flags().StringVar(&verifyOption.CertificatePath, "certificate", "", "path to the certificate chain of the attestation in keyless mode, e.g. certificate.pem")
+	verifyCmd.Flags().StringVar(&verifyOption.CARootsPath, "ca-roots", "", "path to the PEM root certificates of the CA issuing keyless certificates")
+	verifyCmd.Flags().StringVar(&verifyOption.RekorEntryPath, "rekor-entry", "", "path to the transparency log entry of the attestation, e.g. rekor-entry.json")
+	verifyCmd.Flags().StringVar(&verifyOption.RekorPublicKeyPath, "rekor-key", "", "path to the public key of the transparency log, e.g. from $REKOR_SERVER/api/v1/log/publicKey")
+	verifyCmd.Flags().StringVar(&verifyOption.CertificateIdentity, "certificate-identity", "", "expected email or URI of keyless certificates, e.g. https://kubernetes.io/namespaces/argocd-interlace/serviceaccounts/argocd-interlace-controller")
+	verifyCmd.Flags().StringVar(&verifyOption.CertificateOIDCIssuer, "certificate-oidc-issuer", "", "expected OIDC issuer of keyless certificates, e.g. the service account issuer of the cluster")
+}
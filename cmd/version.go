@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"github.com/IBM/argocd-interlace/pkg/version"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -26,6 +27,6 @@ var versionCmd = &cobra.Command{
 	Short: "argocd-interlace version",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Info("argocd-interlace 0.0.1")
+		log.Infof("argocd-interlace %s", version.Version)
 	},
 }
@@ -5,17 +5,25 @@ go 1.16
 require (
 	cloud.google.com/go/kms v1.1.0 // indirect
 	github.com/argoproj/argo-cd/v2 v2.2.0-rc1
+	github.com/cyberphone/json-canonicalization v0.0.0-20210823021906-dc406ceaf94b
 	github.com/evanphx/json-patch v4.11.0+incompatible
 	github.com/ghodss/yaml v1.0.1-0.20190212211648-25d852aebe32
-	github.com/go-git/go-git/v5 v5.4.2 // indirect
+	github.com/go-git/go-git/v5 v5.4.2
+	github.com/go-openapi/strfmt v0.20.2
+	github.com/go-openapi/swag v0.19.15
+	github.com/google/go-containerregistry v0.6.0
+	github.com/google/trillian v1.3.14-0.20210713114448-df474653733c
 	github.com/in-toto/in-toto-golang v0.2.1-0.20210806133539-f50646681592
 	github.com/mattbaird/jsonpatch v0.0.0-20200820163806-098863c1fc24
 	github.com/opencontainers/image-spec v1.0.2 // indirect
 	github.com/opencontainers/runc v1.0.3 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/secure-systems-lab/go-securesystemslib v0.1.0
 	github.com/sigstore/cosign v1.2.0
 	github.com/sigstore/k8s-manifest-sigstore v0.1.0
+	github.com/sigstore/rekor v0.3.0
+	github.com/sigstore/sigstore v0.0.0-20210729211320-56a91f560f44
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.2.1
 	github.com/theupdateframework/go-tuf v0.0.0-20210804171843-477a5d73800a
@@ -27,6 +35,8 @@ require (
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
 	sigs.k8s.io/controller-runtime v0.9.2 // indirect
+	sigs.k8s.io/kustomize/api v0.9.0
+	sigs.k8s.io/kustomize/kyaml v0.11.1
 )
 
 replace (
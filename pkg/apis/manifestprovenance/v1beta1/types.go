@@ -0,0 +1,91 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	GroupName = "argocd.interlace.dev"
+	Version   = "v1beta1"
+	Kind      = "ManifestProvenance"
+	Resource  = "manifestprovenances"
+)
+
+var GroupVersionResource = schema.GroupVersionResource{
+	Group:    GroupName,
+	Version:  Version,
+	Resource: Resource,
+}
+
+// ManifestProvenance records the supply-chain state of the manifest
+// built for an Argo CD Application. It is owned by the Application.
+type ManifestProvenance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ManifestProvenanceSpec   `json:"spec,omitempty"`
+	Status ManifestProvenanceStatus `json:"status,omitempty"`
+}
+
+type ManifestProvenanceSpec struct {
+	Application string `json:"application"`
+	RepoURL     string `json:"repoURL,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Chart       string `json:"chart,omitempty"`
+}
+
+type ManifestProvenanceStatus struct {
+	CommitSha              string               `json:"commitSha,omitempty"`
+	Revision               string               `json:"revision,omitempty"`
+	ManifestDigest         string               `json:"manifestDigest,omitempty"`
+	Manifest               string               `json:"manifest,omitempty"`
+	Signature              string               `json:"signature,omitempty"`
+	SignatureCertificate   string               `json:"signatureCertificate,omitempty"`
+	Attestation            string               `json:"attestation,omitempty"`
+	AttestationCertificate string               `json:"attestationCertificate,omitempty"`
+	RekorUUID              string               `json:"rekorUUID,omitempty"`
+	RekorLogIndex          int64                `json:"rekorLogIndex,omitempty"`
+	RekorIntegratedTime    int64                `json:"rekorIntegratedTime,omitempty"`
+	RekorLogID             string               `json:"rekorLogID,omitempty"`
+	RekorSignedTimestamp   string               `json:"rekorSignedEntryTimestamp,omitempty"`
+	RekorInclusionProof    *RekorInclusionProof `json:"rekorInclusionProof,omitempty"`
+	BuildStartedOn         *metav1.Time         `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn        *metav1.Time         `json:"buildFinishedOn,omitempty"`
+	SourceVerified         bool                 `json:"sourceVerified"`
+	SourceVerification     *SourceVerification  `json:"sourceVerification,omitempty"`
+	LastUpdated            *metav1.Time         `json:"lastUpdated,omitempty"`
+}
+
+// SourceVerification is the outcome of the latest signature verification of the source materials
+type SourceVerification struct {
+	CommitSha string `json:"commitSha,omitempty"`
+	Verified  bool   `json:"verified"`
+	Method    string `json:"method,omitempty"`
+	Signer    string `json:"signer,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RekorInclusionProof is the proof that the attestation is included in the transparency log
+type RekorInclusionProof struct {
+	LogIndex int64    `json:"logIndex"`
+	RootHash string   `json:"rootHash"`
+	TreeSize int64    `json:"treeSize"`
+	Hashes   []string `json:"hashes"`
+}
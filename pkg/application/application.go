@@ -21,6 +21,7 @@ type ApplicationData struct {
 	AppPath                     string
 	AppDirPath                  string
 	AppClusterUrl               string
+	AppDestinationNamespace     string
 	AppSourceRepoUrl            string
 	AppSourceRevision           string
 	AppSourceCommitSha          string
@@ -31,9 +32,22 @@ type ApplicationData struct {
 	ReleaseName                 string
 	Values                      string
 	Version                     string
+	Kustomize                   KustomizeOptions
 }
 
-func NewApplicationData(appName, appPath, appDirPath, appClusterUrl,
+// KustomizeOptions are the kustomize options of the application source, Argo CD
+// applies them to the kustomization of the application before it builds it
+type KustomizeOptions struct {
+	NamePrefix             string
+	NameSuffix             string
+	Images                 []string
+	CommonLabels           map[string]string
+	CommonAnnotations      map[string]string
+	ForceCommonLabels      bool
+	ForceCommonAnnotations bool
+}
+
+func NewApplicationData(appName, appPath, appDirPath, appClusterUrl, appDestinationNamespace,
 	appSourceRepoUrl, appSourceRevision, appSourceCommitSha, appSourcePreiviousCommitSha,
 	chart string, isHelm bool, valueFiles []string, releaseName string,
 	values string, version string) (*ApplicationData, error) {
@@ -42,6 +56,7 @@ func NewApplicationData(appName, appPath, appDirPath, appClusterUrl,
 		AppPath:                     appPath,
 		AppDirPath:                  appDirPath,
 		AppClusterUrl:               appClusterUrl,
+		AppDestinationNamespace:     appDestinationNamespace,
 		AppSourceRepoUrl:            appSourceRepoUrl,
 		AppSourceRevision:           appSourceRevision,
 		AppSourceCommitSha:          appSourceCommitSha,
@@ -54,3 +69,26 @@ func NewApplicationData(appName, appPath, appDirPath, appClusterUrl,
 		Version:                     version,
 	}, nil
 }
+
+// RevisionID returns the commit SHA of the application revision. Helm charts
+// pulled from a chart repository have no commit on creation, the chart version
+// (target revision) identifies the revision instead.
+func (a ApplicationData) RevisionID() string {
+	if a.AppSourceCommitSha == "" && a.IsHelm {
+		return a.AppSourceRevision
+	}
+	return a.AppSourceCommitSha
+}
+
+// SourceVerification is the outcome of the signature verification of the source
+// materials of an application revision
+type SourceVerification struct {
+	// Verified tells that the source materials are signed by a trusted key
+	Verified bool
+	// Method is the verification method, hash-list, git-signature, all or helm-sigstore
+	Method string
+	// Signer describes the identity and key of the trusted signer
+	Signer string
+	// Error is the reason why the source materials are not verified
+	Error string
+}
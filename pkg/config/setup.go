@@ -17,33 +17,95 @@
 package config
 
 import (
+	"crypto/ecdsa"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
 	log "github.com/sirupsen/logrus"
 )
 
 type InterlaceConfig struct {
-	LogLevel                string
-	ManifestStorageType     string
-	ArgocdNamespace         string
-	ArgocdApiBaseUrl        string
-	ArgocdServer            string
-	ArgocdApiToken          string
-	ArgocdPwd               string
-	RekorServer             string
-	RekorTmpDir             string
-	ManifestAppSetMode      string
-	ManifestArgocdProj      string
-	ManifestSuffix          string
-	SourceMaterialHashList  string
-	SourceMaterialSignature string
-	AlwaysGenerateProv      bool
-	SignatureResourceLabel  string
+	LogLevel                   string
+	ManifestStorageTypes       []string
+	ArgocdNamespace            string
+	ArgocdApiBaseUrl           string
+	ArgocdServer               string
+	ArgocdApiToken             string
+	ArgocdPwd                  string
+	RekorServer                string
+	ManifestAppSetMode         string
+	ManifestArgocdProj         string
+	ManifestSuffix             string
+	SourceMaterialHashList     string
+	SourceMaterialSignature    string
+	SourceMaterialVerification string
+	GitSSHAllowedSigners       string
+	AlwaysGenerateProv         bool
+	SignatureResourceLabel     string
+	OciImageRegistry           string
+	OciRegistryInsecure        bool
+	ManifestStorageDir         string
+	ManifestStorageHistory     int
+	ManifestBundleNamespace    string
+	ManifestBundleKind         string
+	DriftCheckInterval         time.Duration
+	MetricsAddr                string
+	SigningKeyRef              string
+	AttestationKeyRefs         []string
+	CosignPassword             string
+	RSASignatureScheme         string
+	VaultAddr                  string
+	VaultToken                 string
+	FulcioURL                  string
+	OIDCTokenPath              string
+	ProvenancePredicateVersion string
+	BuilderID                  string
+	PodName                    string
+	PodNamespace               string
+	ClusterName                string
+	ManifestRebuildCheck       bool
+	ProvenanceResourceSubjects bool
+	ProvenanceImageMaterials   bool
+	RejectMutableImageTags     bool
+	PinImageDigests            bool
+	GitRevisionProvider        string
 }
 
+const (
+	// Number of revisions kept per application by the filesystem storage backend
+	defaultManifestStorageHistory = 10
+	// Namespace and kind of the resources created by the resource storage backend
+	defaultManifestBundleNamespace = "argocd-interlace"
+	defaultManifestBundleKind      = "ConfigMap"
+	// Address of the Prometheus metrics endpoint
+	defaultMetricsAddr = ":9090"
+	// Signing key mounted from the signing-secrets secret
+	defaultSigningKeyRef = "/etc/signing-secrets/cosign.key"
+	// Signature scheme of RSA signing keys, "pss" or "pkcs1v15"
+	defaultRSASignatureScheme = "pss"
+	// Prefix of signing key references served by a Vault transit engine
+	vaultTransitKeyRefPrefix = "vault-transit://"
+	// Signing key reference of the keyless mode, where an ephemeral key is certified by Fulcio
+	keylessKeyRef    = "keyless"
+	defaultFulcioURL = "https://fulcio.sigstore.dev"
+	// Service account token projected with the sigstore audience
+	defaultOIDCTokenPath = "/var/run/sigstore/cosign/oidc-token"
+	// SLSA provenance predicate version, "v0.1", "v0.2" or "v1.0"
+	defaultProvenancePredicateVersion = "v0.1"
+	// Builder id recorded in the provenance
+	defaultBuilderID = "https://github.com/IBM/argocd-interlace"
+	// Provider resolving the latest commit of a revision, "git", "github", "gitlab" or "gitea"
+	defaultGitRevisionProvider = "git"
+	// Verification of source materials, "hash-list", "git-signature" or "all"
+	defaultSourceMaterialVerification = "hash-list"
+)
+
 var instance *InterlaceConfig
 
 func GetInterlaceConfig() (*InterlaceConfig, error) {
@@ -58,8 +120,14 @@ func GetInterlaceConfig() (*InterlaceConfig, error) {
 	return instance, nil
 }
 
+// GetLogLevel returns the configured log level. It is read on its own, since
+// subcommands like verify run without the controller configuration.
+func GetLogLevel() string {
+	return os.Getenv("ARGOCD_INTERLACE_LOG_LEVEL")
+}
+
 func newConfig() (*InterlaceConfig, error) {
-	logLevel := os.Getenv("ARGOCD_INTERLACE_LOG_LEVEL")
+	logLevel := GetLogLevel()
 
 	manifestStorageType := os.Getenv("MANIFEST_STORAGE_TYPE")
 
@@ -67,6 +135,20 @@ func newConfig() (*InterlaceConfig, error) {
 		return nil, fmt.Errorf("MANIFEST_STORAGE_TYPE is empty, please specify in configuration !")
 	}
 
+	// MANIFEST_STORAGE_TYPE accepts a comma separated list, e.g. "annotation,oci"
+	manifestStorageTypes := []string{}
+	seenStorageTypes := map[string]bool{}
+	for _, storageType := range strings.Split(manifestStorageType, ",") {
+		storageType = strings.TrimSpace(storageType)
+		if storageType != "" && !seenStorageTypes[storageType] {
+			manifestStorageTypes = append(manifestStorageTypes, storageType)
+			seenStorageTypes[storageType] = true
+		}
+	}
+	if len(manifestStorageTypes) == 0 {
+		return nil, fmt.Errorf("MANIFEST_STORAGE_TYPE has no storage type, please specify in configuration !")
+	}
+
 	argocdNamespace := os.Getenv("ARGOCD_NAMESPACE")
 	if argocdNamespace == "" {
 		return nil, fmt.Errorf("ARGOCD_NAMESPACE is empty, please specify in configuration !")
@@ -88,15 +170,26 @@ func newConfig() (*InterlaceConfig, error) {
 		return nil, fmt.Errorf("ARGOCD_PWD is empty, please specify in configuration !")
 	}
 
+	// Source materials are verified with the signed hash list, the signature of the git commit or tag, or both
+	sourceMaterialVerification := os.Getenv("SOURCE_MATERIAL_VERIFICATION")
+	if sourceMaterialVerification == "" {
+		sourceMaterialVerification = defaultSourceMaterialVerification
+	}
+	switch sourceMaterialVerification {
+	case "hash-list", "git-signature", "all":
+	default:
+		return nil, fmt.Errorf("SOURCE_MATERIAL_VERIFICATION must be hash-list, git-signature or all, got %s", sourceMaterialVerification)
+	}
+
 	sourceHashList := os.Getenv("SOURCE_MATERIAL_HASH_LIST")
 
-	if sourceHashList == "" {
+	if sourceHashList == "" && sourceMaterialVerification != "git-signature" {
 		return nil, fmt.Errorf("SOURCE_MATERIAL_HASH_LIST is empty, please specify in configuration !")
 	}
 
 	sourceHashSignature := os.Getenv("SOURCE_MATERIAL_SIGNATURE")
 
-	if sourceHashSignature == "" {
+	if sourceHashSignature == "" && sourceMaterialVerification != "git-signature" {
 		return nil, fmt.Errorf("SOURCE_MATERIAL_SIGNATURE is empty, please specify in configuration !")
 	}
 
@@ -115,7 +208,7 @@ func newConfig() (*InterlaceConfig, error) {
 
 	config := &InterlaceConfig{
 		LogLevel:                logLevel,
-		ManifestStorageType:     manifestStorageType,
+		ManifestStorageTypes:    manifestStorageTypes,
 		ArgocdNamespace:         argocdNamespace,
 		ArgocdApiBaseUrl:        strings.TrimSuffix(argocdApiBaseUrl, "\n") + "/api/v1/applications",
 		ArgocdServer:            strings.TrimSuffix(argocdServer, "\n"),
@@ -127,19 +220,265 @@ func newConfig() (*InterlaceConfig, error) {
 		SignatureResourceLabel:  signRscLabel,
 	}
 
-	if manifestStorageType == "annotation" {
-		rekorServer := os.Getenv("REKOR_SERVER")
-		if rekorServer == "" {
-			return nil, fmt.Errorf("REKOR_SERVER is empty, please specify in configuration !")
+	config.SourceMaterialVerification = sourceMaterialVerification
+	// Allowed signers file of SSH signatures on git commits and tags, in the format of ssh-keygen
+	config.GitSSHAllowedSigners = os.Getenv("GIT_SSH_ALLOWED_SIGNERS")
+
+	rekorServer := os.Getenv("REKOR_SERVER")
+	if rekorServer == "" {
+		return nil, fmt.Errorf("REKOR_SERVER is empty, please specify in configuration !")
+	}
+	config.RekorServer = strings.TrimSuffix(rekorServer, "/")
+
+	// SIGNING_KEY_REF is a cosign key file, a vault-transit:// reference, a KMS URI or "keyless"
+	config.SigningKeyRef = os.Getenv("SIGNING_KEY_REF")
+	if config.SigningKeyRef == "" {
+		config.SigningKeyRef = defaultSigningKeyRef
+	}
+	config.CosignPassword = os.Getenv("COSIGN_PASSWORD")
+
+	// Manifests are signed in the cosign format, which supports ECDSA keys only. RSA and
+	// Ed25519 keys can sign the attestation. Keys held by Vault or a KMS are checked when loaded.
+	if isKeyFileRef(config.SigningKeyRef) {
+		err := checkECDSAKeyFile(config.SigningKeyRef, config.CosignPassword)
+		if err != nil {
+			return nil, fmt.Errorf("SIGNING_KEY_REF %s cannot sign manifests: %s", config.SigningKeyRef, err.Error())
+		}
+	}
+
+	// The attestation is signed by every key in ATTESTATION_KEY_REFS, a comma
+	// separated list of signing key references, or by SIGNING_KEY_REF alone
+	seenKeyRefs := map[string]bool{}
+	for _, keyRef := range strings.Split(os.Getenv("ATTESTATION_KEY_REFS"), ",") {
+		keyRef = strings.TrimSpace(keyRef)
+		if keyRef != "" && !seenKeyRefs[keyRef] {
+			config.AttestationKeyRefs = append(config.AttestationKeyRefs, keyRef)
+			seenKeyRefs[keyRef] = true
+		}
+	}
+	if len(config.AttestationKeyRefs) == 0 {
+		config.AttestationKeyRefs = []string{config.SigningKeyRef}
+	}
+	signingKeyRefs := append([]string{config.SigningKeyRef}, config.AttestationKeyRefs...)
+
+	config.RSASignatureScheme = os.Getenv("RSA_SIGNATURE_SCHEME")
+	if config.RSASignatureScheme == "" {
+		config.RSASignatureScheme = defaultRSASignatureScheme
+	}
+	if config.RSASignatureScheme != "pss" && config.RSASignatureScheme != "pkcs1v15" {
+		return nil, fmt.Errorf("RSA_SIGNATURE_SCHEME must be pss or pkcs1v15, got %s", config.RSASignatureScheme)
+	}
+
+	if hasKeyRef(signingKeyRefs, func(keyRef string) bool { return strings.HasPrefix(keyRef, vaultTransitKeyRefPrefix) }) {
+		config.VaultAddr = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+		if config.VaultAddr == "" {
+			return nil, fmt.Errorf("VAULT_ADDR is empty, please specify in configuration !")
+		}
+		config.VaultToken = strings.TrimSuffix(os.Getenv("VAULT_TOKEN"), "\n")
+		if config.VaultToken == "" {
+			return nil, fmt.Errorf("VAULT_TOKEN is empty, please specify in configuration !")
+		}
+	}
+
+	if hasKeyRef(signingKeyRefs, func(keyRef string) bool { return keyRef == keylessKeyRef }) {
+		config.FulcioURL = strings.TrimSuffix(os.Getenv("FULCIO_URL"), "/")
+		if config.FulcioURL == "" {
+			config.FulcioURL = defaultFulcioURL
+		}
+		config.OIDCTokenPath = os.Getenv("OIDC_TOKEN_PATH")
+		if config.OIDCTokenPath == "" {
+			config.OIDCTokenPath = defaultOIDCTokenPath
+		}
+	}
+
+	config.ProvenancePredicateVersion = os.Getenv("PROVENANCE_PREDICATE_VERSION")
+	if config.ProvenancePredicateVersion == "" {
+		config.ProvenancePredicateVersion = defaultProvenancePredicateVersion
+	}
+	switch config.ProvenancePredicateVersion {
+	case "v0.1", "v0.2", "v1.0":
+	default:
+		return nil, fmt.Errorf("PROVENANCE_PREDICATE_VERSION must be v0.1, v0.2 or v1.0, got %s", config.ProvenancePredicateVersion)
+	}
+
+	// Besides the manifest bundle, each resource of the manifest can be a subject of the provenance
+	provenanceResourceSubjects := os.Getenv("PROVENANCE_RESOURCE_SUBJECTS")
+	if provenanceResourceSubjects != "" {
+		resourceSubjects, err := strconv.ParseBool(provenanceResourceSubjects)
+		if err != nil {
+			return nil, fmt.Errorf("PROVENANCE_RESOURCE_SUBJECTS must be true or false, got %s", provenanceResourceSubjects)
+		}
+		config.ProvenanceResourceSubjects = resourceSubjects
+	}
+
+	// Container images of the manifest are materials of the provenance unless disabled
+	config.ProvenanceImageMaterials = true
+	provenanceImageMaterials := os.Getenv("PROVENANCE_IMAGE_MATERIALS")
+	if provenanceImageMaterials != "" {
+		imageMaterials, err := strconv.ParseBool(provenanceImageMaterials)
+		if err != nil {
+			return nil, fmt.Errorf("PROVENANCE_IMAGE_MATERIALS must be true or false, got %s", provenanceImageMaterials)
+		}
+		config.ProvenanceImageMaterials = imageMaterials
+	}
+
+	// Manifests with images referenced by tag instead of digest can be refused
+	rejectMutableImageTags := os.Getenv("REJECT_MUTABLE_IMAGE_TAGS")
+	if rejectMutableImageTags != "" {
+		rejectMutable, err := strconv.ParseBool(rejectMutableImageTags)
+		if err != nil {
+			return nil, fmt.Errorf("REJECT_MUTABLE_IMAGE_TAGS must be true or false, got %s", rejectMutableImageTags)
+		}
+		config.RejectMutableImageTags = rejectMutable
+	}
+
+	// Images referenced by tag can be pinned to their digest in the signed manifest
+	pinImageDigests := os.Getenv("PIN_IMAGE_DIGESTS")
+	if pinImageDigests != "" {
+		pinDigests, err := strconv.ParseBool(pinImageDigests)
+		if err != nil {
+			return nil, fmt.Errorf("PIN_IMAGE_DIGESTS must be true or false, got %s", pinImageDigests)
+		}
+		config.PinImageDigests = pinDigests
+	}
+
+	// The latest commit of a revision is resolved with git ls-remote unless the API of a git host is chosen
+	config.GitRevisionProvider = os.Getenv("GIT_REVISION_PROVIDER")
+	if config.GitRevisionProvider == "" {
+		config.GitRevisionProvider = defaultGitRevisionProvider
+	}
+	switch config.GitRevisionProvider {
+	case "git", "github", "gitlab", "gitea":
+	default:
+		return nil, fmt.Errorf("GIT_REVISION_PROVIDER must be git, github, gitlab or gitea, got %s", config.GitRevisionProvider)
+	}
+
+	// Identity of the controller recorded as builder in the provenance, the pod
+	// is given by the downward API and the cluster name is optional
+	config.BuilderID = os.Getenv("BUILDER_ID")
+	if config.BuilderID == "" {
+		config.BuilderID = defaultBuilderID
+	}
+	config.PodName = os.Getenv("POD_NAME")
+	if config.PodName == "" {
+		config.PodName, _ = os.Hostname()
+	}
+	config.PodNamespace = os.Getenv("POD_NAMESPACE")
+	config.ClusterName = os.Getenv("CLUSTER_NAME")
+
+	// The manifest is built again from source and compared to the Argo CD one before signing
+	manifestRebuildCheck := os.Getenv("MANIFEST_REBUILD_CHECK")
+	if manifestRebuildCheck != "" {
+		rebuildCheck, err := strconv.ParseBool(manifestRebuildCheck)
+		if err != nil {
+			return nil, fmt.Errorf("MANIFEST_REBUILD_CHECK must be true or false, got %s", manifestRebuildCheck)
+		}
+		config.ManifestRebuildCheck = rebuildCheck
+	}
+
+	// Live drift verification is disabled unless an interval like "10m" is given
+	driftCheckInterval := os.Getenv("DRIFT_CHECK_INTERVAL")
+	if driftCheckInterval != "" {
+		interval, err := time.ParseDuration(driftCheckInterval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("DRIFT_CHECK_INTERVAL must be a duration like 10m, got %s", driftCheckInterval)
+		}
+		config.DriftCheckInterval = interval
+	}
+
+	config.MetricsAddr = os.Getenv("METRICS_ADDR")
+	if config.MetricsAddr == "" {
+		config.MetricsAddr = defaultMetricsAddr
+	}
+
+	for _, storageType := range manifestStorageTypes {
+		switch storageType {
+		case "annotation":
+
+		case "oci":
+			ociImageRegistry := os.Getenv("OCI_IMAGE_REGISTRY")
+			if ociImageRegistry == "" {
+				return nil, fmt.Errorf("OCI_IMAGE_REGISTRY is empty, please specify in configuration !")
+			}
+			config.OciImageRegistry = strings.TrimSuffix(ociImageRegistry, "/")
+
+			ociRegistryInsecure := os.Getenv("OCI_REGISTRY_INSECURE")
+			config.OciRegistryInsecure, _ = strconv.ParseBool(ociRegistryInsecure)
+
+		case "filesystem":
+			manifestStorageDir := os.Getenv("MANIFEST_STORAGE_DIR")
+			if manifestStorageDir == "" {
+				return nil, fmt.Errorf("MANIFEST_STORAGE_DIR is empty, please specify in configuration !")
+			}
+			config.ManifestStorageDir = manifestStorageDir
+
+			config.ManifestStorageHistory = defaultManifestStorageHistory
+			manifestStorageHistory := os.Getenv("MANIFEST_STORAGE_HISTORY")
+			if manifestStorageHistory != "" {
+				history, err := strconv.Atoi(manifestStorageHistory)
+				if err != nil || history < 1 {
+					return nil, fmt.Errorf("MANIFEST_STORAGE_HISTORY must be a positive number, got %s", manifestStorageHistory)
+				}
+				config.ManifestStorageHistory = history
+			}
+
+		case "crd":
+
+		case "resource":
+			config.ManifestBundleNamespace = os.Getenv("MANIFEST_BUNDLE_NAMESPACE")
+			if config.ManifestBundleNamespace == "" {
+				config.ManifestBundleNamespace = defaultManifestBundleNamespace
+			}
+
+			config.ManifestBundleKind = os.Getenv("MANIFEST_BUNDLE_KIND")
+			if config.ManifestBundleKind == "" {
+				config.ManifestBundleKind = defaultManifestBundleKind
+			}
+			if config.ManifestBundleKind != "ConfigMap" && config.ManifestBundleKind != "Secret" {
+				return nil, fmt.Errorf("MANIFEST_BUNDLE_KIND must be ConfigMap or Secret, got %s", config.ManifestBundleKind)
+			}
+
+		default:
+			return nil, fmt.Errorf("Unsupported storage type %s", storageType)
 		}
-		config.RekorServer = rekorServer
+	}
+
+	return config, nil
+
+}
 
-		config.RekorTmpDir = os.Getenv("REKORTMPDIR")
+// isKeyFileRef returns true when keyRef is the path of a private key file, not keyless or a
+// reference to a key held by Vault or a KMS
+func isKeyFileRef(keyRef string) bool {
+	return keyRef != keylessKeyRef && !strings.Contains(keyRef, "://")
+}
 
-		return config, nil
+// checkECDSAKeyFile returns an error when the private key file is not an ECDSA key
+func checkECDSAKeyFile(keyPath, password string) error {
 
+	keyBytes, err := ioutil.ReadFile(filepath.Clean(keyPath))
+	if err != nil {
+		return err
 	}
 
-	return nil, fmt.Errorf("Unsupported storage type %s", manifestStorageType)
+	priv, err := cryptoutils.UnmarshalPEMToPrivateKey(keyBytes, func(bool) ([]byte, error) {
+		return []byte(password), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load private key, check COSIGN_PASSWORD for an encrypted key: %s", err.Error())
+	}
 
+	if _, ok := priv.(*ecdsa.PrivateKey); !ok {
+		return fmt.Errorf("only ECDSA keys are supported, got %T", priv)
+	}
+	return nil
+}
+
+func hasKeyRef(keyRefs []string, match func(string) bool) bool {
+	for _, keyRef := range keyRefs {
+		if match(keyRef) {
+			return true
+		}
+	}
+	return false
 }
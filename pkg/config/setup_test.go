@@ -0,0 +1,93 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writePKCS8Key(t *testing.T, dir, name string, priv interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, name)
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPath
+}
+
+func TestCheckECDSAKeyFile(t *testing.T) {
+	dir := t.TempDir()
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyPath string
+		wantErr bool
+	}{
+		{"ecdsa", writePKCS8Key(t, dir, "ecdsa.key", ecdsaKey), false},
+		{"rsa", writePKCS8Key(t, dir, "rsa.key", rsaKey), true},
+		{"ed25519", writePKCS8Key(t, dir, "ed25519.key", ed25519Key), true},
+		{"missing", filepath.Join(dir, "missing.key"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkECDSAKeyFile(tt.keyPath, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkECDSAKeyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsKeyFileRef(t *testing.T) {
+	tests := map[string]bool{
+		"/etc/signing-secrets/cosign.key":                       true,
+		"keyless":                                               false,
+		"vault-transit://transit/interlace":                     false,
+		"awskms:///arn:aws:kms:us-east-1:111122223333:key/1234": false,
+	}
+	for keyRef, want := range tests {
+		if got := isKeyFileRef(keyRef); got != want {
+			t.Errorf("isKeyFileRef(%s) = %v, want %v", keyRef, got, want)
+		}
+	}
+}
@@ -22,7 +22,10 @@ import (
 	"runtime/debug"
 	"time"
 
+	interlaceconfig "github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/drift"
 	"github.com/IBM/argocd-interlace/pkg/interlace"
+	"github.com/IBM/argocd-interlace/pkg/metrics"
 	"github.com/IBM/argocd-interlace/pkg/utils"
 	appv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	appClientset "github.com/argoproj/argo-cd/v2/pkg/client/clientset/versioned"
@@ -42,16 +45,34 @@ type controller struct {
 	informer             cache.SharedIndexInformer
 	appRefreshQueue      workqueue.RateLimitingInterface
 	namespace            string
+	driftChecker         *drift.Checker
+	driftCheckInterval   time.Duration
 }
 
 func Start(ctx context.Context, config string, namespace string) {
-	_, cfg, err := utils.GetClient(config)
-	appClientset := appClientset.NewForConfigOrDie(cfg)
+	clientset, cfg, err := utils.GetClient(config)
 	if err != nil {
 		log.Fatalf("Error in starting argocd interlace controller: %s", err.Error())
 	}
+	appClientset := appClientset.NewForConfigOrDie(cfg)
+
+	interlaceConfig, err := interlaceconfig.GetInterlaceConfig()
+	if err != nil {
+		log.Fatalf("Error in loading config: %s", err.Error())
+	}
 
 	c := newController(appClientset, namespace)
+
+	if interlaceConfig.DriftCheckInterval > 0 {
+		c.driftChecker, err = drift.NewChecker(clientset, cfg)
+		if err != nil {
+			log.Fatalf("Error in creating drift checker: %s", err.Error())
+		}
+		c.driftCheckInterval = interlaceConfig.DriftCheckInterval
+	}
+
+	metrics.StartServer(interlaceConfig.MetricsAddr)
+
 	c.Run(ctx)
 }
 
@@ -175,9 +196,25 @@ func (c *controller) Run(ctx context.Context) {
 			// continue looping
 		}
 	}, time.Second, ctx.Done())
+
+	if c.driftChecker != nil {
+		log.Infof("Checking drift of live resources every %s", c.driftCheckInterval)
+		go wait.Until(c.checkDrift, c.driftCheckInterval, ctx.Done())
+	}
 	<-ctx.Done()
 }
 
+// checkDrift compares the live resources of all applications with their signed manifest
+func (c *controller) checkDrift() {
+	apps := []*appv1.Application{}
+	for _, obj := range c.informer.GetStore().List() {
+		if app, ok := obj.(*appv1.Application); ok {
+			apps = append(apps, app)
+		}
+	}
+	c.driftChecker.Run(apps)
+}
+
 func (c *controller) processNextItem() (processNext bool) {
 	log.Debug("Check if new events in queue ", c.appRefreshQueue.Len())
 
@@ -0,0 +1,449 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package drift
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/images"
+	"github.com/IBM/argocd-interlace/pkg/metrics"
+	"github.com/IBM/argocd-interlace/pkg/storage"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	appv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/ghodss/yaml"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	"github.com/sigstore/k8s-manifest-sigstore/pkg/util/mapnode"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	eventReasonDrift         = "ManifestDrift"
+	eventReasonDriftResolved = "ManifestDriftResolved"
+	eventSourceComponent     = "argocd-interlace"
+
+	resultInSync  = "in_sync"
+	resultDrifted = "drifted"
+	resultError   = "error"
+)
+
+// ignoredFields are changed by Interlace or kubectl themselves and are not drift
+var ignoredFields = []string{
+	"metadata.annotations.cosign.sigstore.dev/",
+	"metadata.annotations.argocd.interlace.dev/",
+	"metadata.annotations.kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// ignoredSignatureResourceFields are the data keys the annotation storage
+// backend writes to a ConfigMap signature resource
+var ignoredSignatureResourceFields = []string{
+	"data.message",
+	"data.signature",
+	"data.certificate",
+	"data.rekorEntry",
+}
+
+// DriftedResource is a resource whose live state diverges from the signed manifest
+type DriftedResource struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Missing is set when the resource does not exist in the cluster
+	Missing bool
+	Diff    *mapnode.DiffResult
+}
+
+func (r DriftedResource) String() string {
+	resource := fmt.Sprintf("%s %s", r.Kind, r.Name)
+	if r.Namespace != "" {
+		resource = fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+	}
+	if r.Missing {
+		return fmt.Sprintf("%s is missing", resource)
+	}
+	return fmt.Sprintf("%s diverges in %s", resource, strings.Join(r.Diff.Keys(), ", "))
+}
+
+// Checker periodically compares the live resources of applications with their
+// last signed manifest and reports drift as Kubernetes Events and metrics.
+// Storage backends and clients of destination clusters are kept between checks.
+type Checker struct {
+	clientset       kubernetes.Interface
+	restConfig      *rest.Config
+	argocdNamespace string
+	// state of each checked application
+	apps map[string]*appState
+	// clients of each destination cluster
+	clusters map[string]*clusterClient
+	mutex    sync.Mutex
+	// resolveDigest returns the digest an image reference points to in its registry
+	resolveDigest func(reference string) (string, bool, error)
+}
+
+// appState is what the checker keeps of an application between checks
+type appState struct {
+	// revision the storage backend was created for
+	revision       string
+	storageBackend storage.StorageBackend
+	// number of drifted resources at the previous check
+	drifted int
+}
+
+func NewChecker(clientset kubernetes.Interface, restConfig *rest.Config) (*Checker, error) {
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	return &Checker{
+		clientset:       clientset,
+		restConfig:      restConfig,
+		argocdNamespace: interlaceConfig.ArgocdNamespace,
+		apps:            map[string]*appState{},
+		clusters:        map[string]*clusterClient{},
+		resolveDigest:   images.ResolveDigest,
+	}, nil
+}
+
+// Run checks every application and records the result. The metrics of
+// applications that no longer exist are removed.
+func (c *Checker) Run(apps []*appv1.Application) {
+
+	appNames := map[string]bool{}
+	for _, app := range apps {
+		appNames[app.Name] = true
+
+		driftedResources, err := c.CheckApplication(app)
+		if err != nil {
+			log.Errorf("Error in checking drift of application %s: %s", app.Name, err.Error())
+			metrics.DriftChecks.WithLabelValues(app.Name, resultError).Inc()
+			continue
+		}
+		if driftedResources == nil {
+			continue
+		}
+
+		c.record(app, driftedResources)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for appName := range c.apps {
+		if appNames[appName] {
+			continue
+		}
+		log.Infof("[INFO][%s] Application was removed, its drift metrics are deleted", appName)
+		metrics.DriftedResources.DeleteLabelValues(appName)
+		for _, result := range []string{resultInSync, resultDrifted, resultError} {
+			metrics.DriftChecks.DeleteLabelValues(appName, result)
+		}
+		delete(c.apps, appName)
+	}
+}
+
+func (c *Checker) record(app *appv1.Application, driftedResources []DriftedResource) {
+
+	c.mutex.Lock()
+	state := c.appState(app.Name)
+	previous := state.drifted
+	state.drifted = len(driftedResources)
+	c.mutex.Unlock()
+
+	metrics.DriftedResources.WithLabelValues(app.Name).Set(float64(len(driftedResources)))
+
+	if len(driftedResources) == 0 {
+		metrics.DriftChecks.WithLabelValues(app.Name, resultInSync).Inc()
+		if previous > 0 {
+			log.Infof("[INFO][%s] Live resources match the signed manifest again", app.Name)
+			c.recordEvent(app, corev1.EventTypeNormal, eventReasonDriftResolved, "Live resources match the signed manifest")
+		}
+		return
+	}
+
+	metrics.DriftChecks.WithLabelValues(app.Name, resultDrifted).Inc()
+	for _, driftedResource := range driftedResources {
+		log.Warnf("[WARN][%s] Drift detected: %s", app.Name, driftedResource.String())
+		c.recordEvent(app, corev1.EventTypeWarning, eventReasonDrift, fmt.Sprintf("Live state differs from signed manifest: %s", driftedResource.String()))
+	}
+}
+
+func (c *Checker) recordEvent(app *appv1.Application, eventType, reason, message string) {
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", app.Name, time.Now().UnixNano()),
+			Namespace: app.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "argoproj.io/v1alpha1",
+			Kind:            "Application",
+			Name:            app.Name,
+			Namespace:       app.Namespace,
+			UID:             app.UID,
+			ResourceVersion: app.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := c.clientset.CoreV1().Events(app.Namespace).Create(context.TODO(), event, metav1.CreateOptions{})
+	if err != nil {
+		log.Errorf("Error in creating event for application %s: %s", app.Name, err.Error())
+	}
+}
+
+// appState returns the state of the application, created on its first check.
+// The caller holds the mutex.
+func (c *Checker) appState(appName string) *appState {
+	state, ok := c.apps[appName]
+	if !ok {
+		state = &appState{}
+		c.apps[appName] = state
+	}
+	return state
+}
+
+// CheckApplication returns the resources of the application whose live state diverges
+// from its last signed manifest. It returns nil when no manifest has been signed yet.
+func (c *Checker) CheckApplication(app *appv1.Application) ([]DriftedResource, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	storageBackend, err := c.storageBackend(app, interlaceConfig.ManifestStorageTypes[0])
+	if err != nil {
+		return nil, err
+	}
+
+	signedManifest, err := storageBackend.GetLatestManifestContent()
+	if err != nil {
+		return nil, err
+	}
+	if signedManifest == nil {
+		log.Debugf("No signed manifest found for application %s, skipping drift check", app.Name)
+		return nil, nil
+	}
+
+	cluster, err := c.clusterClient(app.Spec.Destination)
+	if err != nil {
+		log.Errorf("Error in creating client of destination cluster %s: %s", utils.DestinationKey(app.Spec.Destination), err.Error())
+		return nil, err
+	}
+
+	// Image tags are resolved once per check
+	liveDigests := map[string]string{}
+	resolveLiveDigest := func(reference string) (string, error) {
+		if digest, ok := liveDigests[reference]; ok {
+			return digest, nil
+		}
+		digest, _, err := c.resolveDigest(reference)
+		if err != nil {
+			return "", err
+		}
+		liveDigests[reference] = digest
+		return digest, nil
+	}
+
+	driftedResources := []DriftedResource{}
+	for _, item := range k8smnfutil.SplitConcatYAMLs(signedManifest) {
+		var signedObj unstructured.Unstructured
+		err := yaml.Unmarshal(item, &signedObj.Object)
+		if err != nil {
+			return nil, err
+		}
+		if signedObj.GetKind() == "" {
+			continue
+		}
+
+		driftedResource := DriftedResource{
+			Kind:      signedObj.GetKind(),
+			Namespace: signedObj.GetNamespace(),
+			Name:      signedObj.GetName(),
+		}
+
+		liveObj, err := cluster.getLiveObject(signedObj, app.Spec.Destination.Namespace)
+		if k8serrors.IsForbidden(err) {
+			// Only the kinds the controller is granted to read are checked
+			log.Warnf("[WARN][%s] Drift of %s %s is not checked, reading it is forbidden: %s", app.Name, signedObj.GetKind(), signedObj.GetName(), err.Error())
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error in getting live state of %s %s: %s", signedObj.GetKind(), signedObj.GetName(), err.Error())
+			return nil, err
+		}
+		if liveObj == nil {
+			driftedResource.Missing = true
+			driftedResources = append(driftedResources, driftedResource)
+			continue
+		}
+
+		maskKeys := append([]string{}, ignoredFields...)
+		if isSignatureResource(signedObj, interlaceConfig.SignatureResourceLabel) {
+			maskKeys = append(maskKeys, ignoredSignatureResourceFields...)
+		}
+
+		diff, err := diffLiveState(item, liveObj, maskKeys, resolveLiveDigest)
+		if err != nil {
+			return nil, err
+		}
+		if diff != nil {
+			driftedResource.Diff = diff
+			driftedResources = append(driftedResources, driftedResource)
+		}
+	}
+
+	return driftedResources, nil
+}
+
+// storageBackend returns the storage backend of the application, created again
+// only when the synced revision changed since the previous check
+func (c *Checker) storageBackend(app *appv1.Application, storageType string) (storage.StorageBackend, error) {
+
+	// The signed manifest of the synced revision is the latest one
+	commitSha := app.Status.Sync.Revision
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := c.appState(app.Name)
+	if state.storageBackend != nil && state.revision == commitSha {
+		return state.storageBackend, nil
+	}
+
+	appData, _ := application.NewApplicationData(app.Name, app.Spec.Source.Path, "", app.Spec.Destination.Server, app.Spec.Destination.Namespace,
+		app.Spec.Source.RepoURL, app.Spec.Source.TargetRevision, commitSha, commitSha,
+		app.Spec.Source.Chart, app.Spec.Source.IsHelm(), nil, "", "", "")
+
+	storageBackends, err := storage.InitializeStorageBackends(*appData, []string{storageType})
+	if err != nil {
+		return nil, err
+	}
+
+	state.revision = commitSha
+	state.storageBackend = storageBackends[storageType]
+	return state.storageBackend, nil
+}
+
+// clusterClient returns the client of the destination cluster, created on first use
+func (c *Checker) clusterClient(destination appv1.ApplicationDestination) (*clusterClient, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := utils.DestinationKey(destination)
+	if cluster, ok := c.clusters[key]; ok {
+		return cluster, nil
+	}
+
+	restConfig, err := utils.ClusterRestConfig(c.clientset, c.argocdNamespace, c.restConfig, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := newClusterClient(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.clusters[key] = cluster
+	return cluster, nil
+}
+
+// diffLiveState returns the fields of the signed object that are changed or removed
+// in the live object. Fields only set in the live object, e.g. status or defaults
+// filled by the API server, are not drift. It returns nil when there is no drift.
+func diffLiveState(signedObjYAML []byte, liveObj *unstructured.Unstructured, maskKeys []string, resolveLiveDigest func(reference string) (string, error)) (*mapnode.DiffResult, error) {
+
+	signedNode, err := mapnode.NewFromYamlBytes(signedObjYAML)
+	if err != nil {
+		log.Errorf("signedNode error from NewFromYamlBytes %s", err.Error())
+		return nil, err
+	}
+
+	liveNode, err := mapnode.NewFromMap(liveObj.Object)
+	if err != nil {
+		log.Errorf("liveNode error from NewFromMap %s", err.Error())
+		return nil, err
+	}
+
+	diff := signedNode.FindUpdatedAndDeleted(liveNode)
+	if diff == nil || diff.Size() == 0 {
+		return nil, nil
+	}
+
+	_, diff, _ = diff.Filter(maskKeys)
+	diff = removePinnedImages(diff, resolveLiveDigest)
+	if diff.Size() == 0 {
+		return nil, nil
+	}
+	return diff, nil
+}
+
+// removePinnedImages removes the differences of images pinned to their digest in
+// the signed manifest, e.g. nginx:1.21@sha256:..., and referenced by tag in the
+// live resource deployed from Git, when the tag still resolves to the signed digest.
+// A tag moved to another image since signing, or that can not be resolved, is drift.
+func removePinnedImages(diff *mapnode.DiffResult, resolveLiveDigest func(reference string) (string, error)) *mapnode.DiffResult {
+
+	items := []mapnode.Difference{}
+	for _, item := range diff.Items {
+		if strings.HasSuffix(item.Key, ".image") {
+			before, ok1 := item.Values["before"].(string)
+			after, ok2 := item.Values["after"].(string)
+			if ok1 && ok2 && after != "" && strings.HasPrefix(before, after+"@") {
+				signedDigest := strings.TrimPrefix(before, after+"@")
+				liveDigest, err := resolveLiveDigest(after)
+				if err != nil {
+					log.Warnf("[WARN] Digest of live image %s could not be resolved: %s", after, err.Error())
+				} else if liveDigest == signedDigest {
+					continue
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return &mapnode.DiffResult{Items: items}
+}
+
+func isSignatureResource(obj unstructured.Unstructured, signatureResourceLabel string) bool {
+	if rscLabel, ok := obj.GetLabels()[signatureResourceLabel]; ok {
+		isSignatureresource, _ := strconv.ParseBool(rscLabel)
+		return isSignatureresource
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package drift
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/sigstore/k8s-manifest-sigstore/pkg/util/mapnode"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	signedDigest = "sha256:4cf0a4d8f4d6e6a5e1d4f1fa2a2e1b0c8d1f0f2e3c4b5a69788796a5b4c3d2e1"
+	movedDigest  = "sha256:9d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e"
+)
+
+// signedDeployment is the signed manifest of a deployment with its image pinned by digest
+const signedDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  annotations:
+    cosign.sigstore.dev/signature: c2lnbmF0dXJl
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: nginx:1.21@` + signedDigest + `
+`
+
+// liveDeployment returns the live deployment with the image and replicas
+func liveDeployment(t *testing.T, image string, replicas int) *unstructured.Unstructured {
+	live := fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  uid: 6f1c2a3b-0000-4000-8000-000000000001
+  annotations:
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+spec:
+  replicas: %d
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: %s
+        imagePullPolicy: IfNotPresent
+status:
+  readyReplicas: 1
+`, replicas, image)
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(live), &obj.Object); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestDiffLiveState(t *testing.T) {
+	registry := map[string]string{"nginx:1.21": signedDigest, "nginx:1.22": movedDigest}
+
+	tests := []struct {
+		name     string
+		image    string
+		replicas int
+		registry map[string]string
+		want     []string
+	}{
+		{
+			name:     "in sync",
+			image:    "nginx:1.21@" + signedDigest,
+			replicas: 1,
+			registry: registry,
+		},
+		{
+			name:     "live tag resolves to the signed digest",
+			image:    "nginx:1.21",
+			replicas: 1,
+			registry: registry,
+		},
+		{
+			name:     "live tag moved to another digest",
+			image:    "nginx:1.21",
+			replicas: 1,
+			registry: map[string]string{"nginx:1.21": movedDigest},
+			want:     []string{"spec.template.spec.containers.0.image"},
+		},
+		{
+			name:     "live tag can not be resolved",
+			image:    "nginx:1.21",
+			replicas: 1,
+			registry: map[string]string{},
+			want:     []string{"spec.template.spec.containers.0.image"},
+		},
+		{
+			name:     "live image of another tag",
+			image:    "nginx:1.22",
+			replicas: 1,
+			registry: registry,
+			want:     []string{"spec.template.spec.containers.0.image"},
+		},
+		{
+			name:     "live field changed",
+			image:    "nginx:1.21",
+			replicas: 3,
+			registry: registry,
+			want:     []string{"spec.replicas"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolveLiveDigest := func(reference string) (string, error) {
+				digest, ok := tt.registry[reference]
+				if !ok {
+					return "", fmt.Errorf("%s: not found", reference)
+				}
+				return digest, nil
+			}
+
+			diff, err := diffLiveState([]byte(signedDeployment), liveDeployment(t, tt.image, tt.replicas), ignoredFields, resolveLiveDigest)
+			if err != nil {
+				t.Fatalf("diffLiveState() error = %v", err)
+			}
+			var keys []string
+			if diff != nil {
+				keys = diff.Keys()
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("diffLiveState() = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovePinnedImages(t *testing.T) {
+	resolved := []string{}
+	resolveLiveDigest := func(reference string) (string, error) {
+		resolved = append(resolved, reference)
+		return signedDigest, nil
+	}
+
+	diff := &mapnode.DiffResult{Items: []mapnode.Difference{
+		{Key: "spec.containers.0.image", Values: map[string]interface{}{"before": "nginx:1.21@" + signedDigest, "after": "nginx:1.21"}},
+		// The live image is pinned, the signed one is not
+		{Key: "spec.containers.1.image", Values: map[string]interface{}{"before": "busybox:1.33", "after": "busybox:1.33@" + signedDigest}},
+		{Key: "spec.containers.2.image", Values: map[string]interface{}{"before": "redis:6@" + signedDigest, "after": nil}},
+		{Key: "spec.replicas", Values: map[string]interface{}{"before": 1, "after": 3}},
+	}}
+
+	got := removePinnedImages(diff, resolveLiveDigest)
+
+	want := []string{"spec.containers.1.image", "spec.containers.2.image", "spec.replicas"}
+	if !reflect.DeepEqual(got.Keys(), want) {
+		t.Errorf("removePinnedImages() = %v, want %v", got.Keys(), want)
+	}
+	if !reflect.DeepEqual(resolved, []string{"nginx:1.21"}) {
+		t.Errorf("resolved images = %v, want only the live tag of the pinned image", resolved)
+	}
+}
+
+func TestDriftedResourceString(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource DriftedResource
+		want     string
+	}{
+		{
+			name:     "missing namespaced resource",
+			resource: DriftedResource{Kind: "Deployment", Namespace: "guestbook", Name: "guestbook-ui", Missing: true},
+			want:     "Deployment guestbook/guestbook-ui is missing",
+		},
+		{
+			name: "drifted cluster resource",
+			resource: DriftedResource{Kind: "ClusterRole", Name: "guestbook", Diff: &mapnode.DiffResult{Items: []mapnode.Difference{
+				{Key: "rules.0.verbs", Values: map[string]interface{}{"before": "get", "after": "*"}},
+			}}},
+			want: "ClusterRole guestbook diverges in rules.0.verbs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.resource.String(); got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSignatureResource(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"labeled", map[string]string{"argocd.argoproj.io/signature-resource": "true"}, true},
+		{"labeled false", map[string]string{"argocd.argoproj.io/signature-resource": "false"}, false},
+		{"not labeled", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetLabels(tt.labels)
+			if got := isSignatureResource(obj, "argocd.argoproj.io/signature-resource"); got != tt.want {
+				t.Errorf("isSignatureResource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// containerFields are the fields of a pod spec listing containers with an image
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// Image is a container image referenced by a manifest
+type Image struct {
+	// Reference as written in the manifest, e.g. nginx:1.21
+	Reference string
+	// Digest of the image in the registry, e.g. sha256:..., empty when it could not be resolved
+	Digest string
+	// Pinned is set when the reference has a digest, otherwise the tag may point to another image later
+	Pinned bool
+}
+
+// ExtractImages returns the images of the containers of every pod spec in the
+// manifest, e.g. of Pods, Deployments or CronJobs, once each
+func ExtractImages(manifest []byte) ([]string, error) {
+
+	images := []string{}
+	seen := map[string]bool{}
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifest) {
+		var obj interface{}
+		err := yaml.Unmarshal(item, &obj)
+		if err != nil {
+			log.Errorf("Error in unmarshaling manifest: %s", err.Error())
+			return nil, err
+		}
+		for _, image := range findImages(obj) {
+			if !seen[image] {
+				images = append(images, image)
+				seen[image] = true
+			}
+		}
+	}
+	return images, nil
+}
+
+func findImages(node interface{}) []string {
+
+	images := []string{}
+	walkContainers(node, func(container map[string]interface{}) {
+		if image, ok := container["image"].(string); ok && image != "" {
+			images = append(images, image)
+		}
+	})
+	return images
+}
+
+// walkContainers calls visit with every container of the pod specs found in node
+func walkContainers(node interface{}, visit func(container map[string]interface{})) {
+
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for _, field := range containerFields {
+			containers, ok := node[field].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, container := range containers {
+				if container, ok := container.(map[string]interface{}); ok {
+					visit(container)
+				}
+			}
+		}
+		keys := []string{}
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			walkContainers(node[key], visit)
+		}
+	case []interface{}:
+		for _, child := range node {
+			walkContainers(child, visit)
+		}
+	}
+}
+
+// PinImages rewrites the images of the object referenced by tag to the digest the
+// tag points to in the registry, keeping the tag for readability, e.g.
+// nginx:1.21@sha256:... The digest of every rewritten reference is added to digests,
+// which also serves as cache of the references already resolved.
+func PinImages(obj map[string]interface{}, digests map[string]string) error {
+
+	var err error
+	walkContainers(obj, func(container map[string]interface{}) {
+		image, ok := container["image"].(string)
+		if !ok || image == "" || err != nil {
+			return
+		}
+		digest, found := digests[image]
+		if !found {
+			var pinned bool
+			digest, pinned, err = ResolveDigest(image)
+			if err != nil {
+				log.Errorf("Error in resolving digest of image %s: %s", image, err.Error())
+				return
+			}
+			if pinned {
+				return
+			}
+			digests[image] = digest
+		}
+		container["image"] = fmt.Sprintf("%s@%s", image, digest)
+	})
+	return err
+}
+
+// ReadImageDigests returns the digests of the images pinned in the manifest of the
+// application directory, or nil when no image was pinned
+func ReadImageDigests(appDirPath string) (map[string]string, error) {
+
+	digestsPath := filepath.Join(appDirPath, utils.IMAGE_DIGESTS_FILE_NAME)
+	if !utils.FileExist(digestsPath) {
+		return nil, nil
+	}
+
+	digestsBytes, err := ioutil.ReadFile(filepath.Clean(digestsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	err = json.Unmarshal(digestsBytes, &digests)
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// WriteImageDigests records the digests of the images pinned in the manifest of the
+// application directory, a previous record is removed when there is none
+func WriteImageDigests(appDirPath string, digests map[string]string) error {
+
+	digestsPath := filepath.Join(appDirPath, utils.IMAGE_DIGESTS_FILE_NAME)
+	if len(digests) == 0 {
+		if utils.FileExist(digestsPath) {
+			return os.Remove(digestsPath)
+		}
+		return nil
+	}
+
+	digestsBytes, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return utils.WriteToFile(string(digestsBytes), appDirPath, utils.IMAGE_DIGESTS_FILE_NAME)
+}
+
+// ResolveImages returns the images referenced by the manifest with their digest.
+// A tag is resolved to the digest it points to in the registry, with the docker
+// credentials of the controller. Images that can not be resolved have no digest.
+func ResolveImages(manifest []byte) ([]Image, error) {
+
+	references, err := ExtractImages(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []Image{}
+	for _, reference := range references {
+		image := Image{Reference: reference}
+		digest, pinned, err := ResolveDigest(reference)
+		if err != nil {
+			log.Warnf("Could not resolve digest of image %s: %s", reference, err.Error())
+		}
+		image.Digest = digest
+		image.Pinned = pinned
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// ResolveDigest returns the digest of the image and whether the reference is pinned
+// to it, otherwise the digest is the one of the tag in the registry
+func ResolveDigest(reference string) (string, bool, error) {
+
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", false, err
+	}
+	if digest, ok := ref.(name.Digest); ok {
+		return digest.DigestStr(), true, nil
+	}
+
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", false, err
+	}
+	return desc.Digest.String(), false, nil
+}
+
+// MutableImages returns the references of the manifest that are not pinned by digest
+func MutableImages(manifest []byte) ([]string, error) {
+
+	references, err := ExtractImages(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	mutable := []string{}
+	for _, reference := range references {
+		ref, err := name.ParseReference(reference)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ref.(name.Digest); !ok {
+			mutable = append(mutable, reference)
+		}
+	}
+	return mutable, nil
+}
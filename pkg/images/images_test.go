@@ -0,0 +1,226 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package images
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// pushRandomImage pushes a random image to the local registry and returns its digest
+func pushRandomImage(t *testing.T, reference string) string {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.Write(ref, img)
+	if err != nil {
+		t.Fatalf("push image %s: %s", reference, err.Error())
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
+
+func TestResolveImages(t *testing.T) {
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tagged := fmt.Sprintf("%s/app:v1", host)
+	taggedDigest := pushRandomImage(t, tagged)
+	otherDigest := pushRandomImage(t, fmt.Sprintf("%s/sidecar:v2", host))
+	pinned := fmt.Sprintf("%s/sidecar@%s", host, otherDigest)
+	missing := fmt.Sprintf("%s/app:missing", host)
+
+	manifest := fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: %s
+      containers:
+      - name: app
+        image: %s
+      - name: sidecar
+        image: %s
+`, missing, tagged, pinned)
+
+	resolved, err := ResolveImages([]byte(manifest))
+	if err != nil {
+		t.Fatalf("resolve images: %s", err.Error())
+	}
+
+	expected := map[string]Image{
+		tagged:  {Reference: tagged, Digest: taggedDigest, Pinned: false},
+		pinned:  {Reference: pinned, Digest: otherDigest, Pinned: true},
+		missing: {Reference: missing, Digest: "", Pinned: false},
+	}
+	if len(resolved) != len(expected) {
+		t.Fatalf("expected %d images, got %d: %+v", len(expected), len(resolved), resolved)
+	}
+	for _, image := range resolved {
+		if image != expected[image.Reference] {
+			t.Errorf("expected image %+v, got %+v", expected[image.Reference], image)
+		}
+	}
+
+	mutable, err := MutableImages([]byte(manifest))
+	if err != nil {
+		t.Fatalf("mutable images: %s", err.Error())
+	}
+	if len(mutable) != 2 {
+		t.Errorf("expected the tagged images to be mutable, got %v", mutable)
+	}
+}
+
+// podWithImages returns a pod with a container of each image
+func podWithImages(t *testing.T, images ...string) map[string]interface{} {
+	containers := ""
+	for i, image := range images {
+		containers += fmt.Sprintf("  - name: c%d\n    image: %s\n", i, image)
+	}
+	pod := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: app\nspec:\n  containers:\n"+containers), &pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func TestPinImages(t *testing.T) {
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tagged := fmt.Sprintf("%s/app:v1", host)
+	taggedDigest := pushRandomImage(t, tagged)
+	pinned := fmt.Sprintf("%s/sidecar@%s", host, pushRandomImage(t, fmt.Sprintf("%s/sidecar:v2", host)))
+	// The digest of a reference already resolved is not resolved again
+	cached := fmt.Sprintf("%s/cached:v1", host)
+	cachedDigest := "sha256:4cf0a4d8f4d6e6a5e1d4f1fa2a2e1b0c8d1f0f2e3c4b5a69788796a5b4c3d2e1"
+	missing := fmt.Sprintf("%s/app:missing", host)
+
+	tests := []struct {
+		name        string
+		images      []string
+		digests     map[string]string
+		wantImages  []string
+		wantDigests map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "tag is pinned to its digest",
+			images:      []string{tagged},
+			digests:     map[string]string{},
+			wantImages:  []string{tagged + "@" + taggedDigest},
+			wantDigests: map[string]string{tagged: taggedDigest},
+		},
+		{
+			name:        "pinned reference is kept",
+			images:      []string{pinned},
+			digests:     map[string]string{},
+			wantImages:  []string{pinned},
+			wantDigests: map[string]string{},
+		},
+		{
+			name:        "cached digest is used",
+			images:      []string{cached, tagged},
+			digests:     map[string]string{cached: cachedDigest},
+			wantImages:  []string{cached + "@" + cachedDigest, tagged + "@" + taggedDigest},
+			wantDigests: map[string]string{cached: cachedDigest, tagged: taggedDigest},
+		},
+		{
+			name:        "tag that can not be resolved",
+			images:      []string{missing},
+			digests:     map[string]string{},
+			wantImages:  []string{missing},
+			wantDigests: map[string]string{},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := podWithImages(t, tt.images...)
+			err := PinImages(pod, tt.digests)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PinImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := findImages(pod); !reflect.DeepEqual(got, tt.wantImages) {
+				t.Errorf("PinImages() images = %v, want %v", got, tt.wantImages)
+			}
+			if !reflect.DeepEqual(tt.digests, tt.wantDigests) {
+				t.Errorf("PinImages() digests = %v, want %v", tt.digests, tt.wantDigests)
+			}
+		})
+	}
+}
+
+func TestImageDigestsFile(t *testing.T) {
+
+	appDirPath := t.TempDir()
+	digests := map[string]string{"nginx:1.21": "sha256:4cf0a4d8f4d6e6a5e1d4f1fa2a2e1b0c8d1f0f2e3c4b5a69788796a5b4c3d2e1"}
+
+	err := WriteImageDigests(appDirPath, digests)
+	if err != nil {
+		t.Fatalf("write image digests: %s", err.Error())
+	}
+	read, err := ReadImageDigests(appDirPath)
+	if err != nil {
+		t.Fatalf("read image digests: %s", err.Error())
+	}
+	if !reflect.DeepEqual(read, digests) {
+		t.Errorf("expected image digests %v, got %v", digests, read)
+	}
+
+	// No pinned image removes the digests of a previous manifest
+	err = WriteImageDigests(appDirPath, nil)
+	if err != nil {
+		t.Fatalf("write image digests: %s", err.Error())
+	}
+	if utils.FileExist(filepath.Join(appDirPath, utils.IMAGE_DIGESTS_FILE_NAME)) {
+		t.Error("expected the image digests file to be removed")
+	}
+	read, err = ReadImageDigests(appDirPath)
+	if err != nil || read != nil {
+		t.Errorf("expected no image digests, got %v, %v", read, err)
+	}
+}
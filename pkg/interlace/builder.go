@@ -18,15 +18,21 @@ package interlace
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
 	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/images"
 	"github.com/IBM/argocd-interlace/pkg/manifest"
+	"github.com/IBM/argocd-interlace/pkg/provenance"
 	helmprov "github.com/IBM/argocd-interlace/pkg/provenance/helm"
 	"github.com/IBM/argocd-interlace/pkg/provenance/kustomize"
 	kustprov "github.com/IBM/argocd-interlace/pkg/provenance/kustomize"
+	"github.com/IBM/argocd-interlace/pkg/sign"
 	"github.com/IBM/argocd-interlace/pkg/storage"
 	"github.com/IBM/argocd-interlace/pkg/storage/annotation"
 	"github.com/IBM/argocd-interlace/pkg/utils"
@@ -38,16 +44,12 @@ func CreateEventHandler(app *appv1.Application) error {
 
 	appName := app.ObjectMeta.Name
 	appClusterUrl := app.Spec.Destination.Server
+	appDestinationNamespace := app.Spec.Destination.Namespace
 
 	// Do not use app.Status  in create event.
 	appSourceRepoUrl := app.Spec.Source.RepoURL
 	appSourceRevision := app.Spec.Source.TargetRevision
 	appSourceCommitSha := ""
-	// Create does not have app.Status.Sync.Revision information, we need to extract commitsha by API
-	commitSha := kustomize.GitLatestCommitSha(app.Spec.Source.RepoURL, app.Spec.Source.TargetRevision)
-	if commitSha != "" {
-		appSourceCommitSha = commitSha
-	}
 
 	log.Infof("[INFO][%s]: Interlace detected creation of new Application resource: %s", appName, appName)
 	appPath := ""
@@ -56,6 +58,7 @@ func CreateEventHandler(app *appv1.Application) error {
 	var releaseName string
 	var values string
 	var version string
+	var repoCreds *kustomize.RepoCredentials
 	isHelm := app.Spec.Source.IsHelm()
 	if isHelm {
 		appPath = fmt.Sprintf("%s/%s", "/tmp", appName)
@@ -74,6 +77,14 @@ func CreateEventHandler(app *appv1.Application) error {
 		appPath = app.Spec.Source.Path
 		appDirPath = filepath.Join(utils.TMP_DIR, appName, appPath)
 
+		// Create does not have app.Status.Sync.Revision information, we need to resolve the commitsha of the revision
+		repoCreds = kustomize.GetRepoCredentials(app.Spec.Source.RepoURL)
+		commitSha, err := kustomize.GitLatestCommitSha(app.Spec.Source.RepoURL, app.Spec.Source.TargetRevision, repoCreds)
+		if err != nil {
+			log.Errorf("[%s] Error in resolving the latest commit of the Application source: %s", appName, err.Error())
+			return err
+		}
+		appSourceCommitSha = commitSha
 	}
 
 	appSourcePreiviousCommitSha := ""
@@ -81,32 +92,33 @@ func CreateEventHandler(app *appv1.Application) error {
 	sourceVerified := false
 
 	chart := app.Spec.Source.Chart
-	appData, _ := application.NewApplicationData(appName, appPath, appDirPath, appClusterUrl,
+	appData, _ := application.NewApplicationData(appName, appPath, appDirPath, appClusterUrl, appDestinationNamespace,
 		appSourceRepoUrl, appSourceRevision, appSourceCommitSha, appSourcePreiviousCommitSha,
 		chart, isHelm, valueFiles, releaseName, values, version)
+	appData.Kustomize = kustomizeOptions(app.Spec.Source.Kustomize)
 
+	// The source is checked out once for the verification, the rebuild and the provenance
+	var prov provenance.Provenance
 	if isHelm {
 		log.Infof("[INFO][%s]: Interlace detected creation of new Application resource: %s", appName, appName)
-		prov, _ := helmprov.NewProvenance(*appData)
-		sourceVerified, err = prov.VerifySourceMaterial()
-		if err != nil {
-			log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
-			return err
-		}
+		prov, _ = helmprov.NewProvenance(*appData)
 	} else {
-		prov, _ := kustprov.NewProvenance(*appData)
-		sourceVerified, err = prov.VerifySourceMaterial()
+		prov, _ = kustprov.NewProvenanceWithCredentials(*appData, repoCreds)
+	}
+	defer prov.Cleanup()
 
-		if err != nil {
-			log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
-			return err
-		}
+	verification, err := prov.VerifySourceMaterial()
+	storeSourceVerification(*appData, verification)
+	if err != nil {
+		log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
+		return err
 	}
+	sourceVerified = verification.Verified
 	log.Info("sourceVerified ", sourceVerified)
 	if sourceVerified {
 		log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials succeeded: %s", appName, appName)
 
-		err = signManifestAndGenerateProvenance(*appData, true, sourceVerified)
+		err = signManifestAndGenerateProvenance(prov, *appData, true, sourceVerified)
 
 		if err != nil {
 			return err
@@ -146,6 +158,7 @@ func UpdateEventHandler(oldApp, newApp *appv1.Application) error {
 		appSourceRevision := newApp.Status.Sync.ComparedTo.Source.TargetRevision
 		appSourceCommitSha := newApp.Status.Sync.Revision
 		appClusterUrl := newApp.Status.Sync.ComparedTo.Destination.Server
+		appDestinationNamespace := newApp.Status.Sync.ComparedTo.Destination.Namespace
 		revisionHistories := newApp.Status.History
 		appSourcePreiviousCommitSha := ""
 		if revisionHistories != nil {
@@ -180,35 +193,30 @@ func UpdateEventHandler(oldApp, newApp *appv1.Application) error {
 
 		appDirPath := filepath.Join(utils.TMP_DIR, appName, appPath)
 		chart := newApp.Spec.Source.Chart
-		appData, _ := application.NewApplicationData(appName, appPath, appDirPath, appClusterUrl,
+		appData, _ := application.NewApplicationData(appName, appPath, appDirPath, appClusterUrl, appDestinationNamespace,
 			appSourceRepoUrl, appSourceRevision, appSourceCommitSha, appSourcePreiviousCommitSha,
 			chart, isHelm, valueFiles, releaseName, values, version)
+		appData.Kustomize = kustomizeOptions(newApp.Spec.Source.Kustomize)
 
 		log.Infof("[INFO][%s]: Interlace detected update of an exsiting Application resource: %s", appName, appName)
 
-		if isHelm {
+		// The source is checked out once for the verification, the rebuild and the provenance
+		prov, _ := provenance.NewProvenance(*appData)
+		defer prov.Cleanup()
 
-			prov, _ := helmprov.NewProvenance(*appData)
-			sourceVerified, err = prov.VerifySourceMaterial()
-			if err != nil {
-				log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
-				return err
-			}
-		} else {
-			prov, _ := kustprov.NewProvenance(*appData)
-			sourceVerified, err = prov.VerifySourceMaterial()
-
-			if err != nil {
-				log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
-				return err
-			}
+		verification, err := prov.VerifySourceMaterial()
+		storeSourceVerification(*appData, verification)
+		if err != nil {
+			log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials failed: %s", appName, appName)
+			return err
 		}
 
+		sourceVerified = verification.Verified
 		log.Info("sourceVerified ", sourceVerified)
 		if sourceVerified {
 			log.Infof("[INFO][%s]: Interlace's signature verification of Application source materials succeeded: %s", appName, appName)
 
-			err := signManifestAndGenerateProvenance(*appData, created, sourceVerified)
+			err := signManifestAndGenerateProvenance(prov, *appData, created, sourceVerified)
 			if err != nil {
 				return err
 			}
@@ -218,7 +226,7 @@ func UpdateEventHandler(oldApp, newApp *appv1.Application) error {
 	return nil
 }
 
-func signManifestAndGenerateProvenance(appData application.ApplicationData, created bool, sourceVerified bool) error {
+func signManifestAndGenerateProvenance(prov provenance.Provenance, appData application.ApplicationData, created bool, sourceVerified bool) error {
 
 	interlaceConfig, err := config.GetInterlaceConfig()
 	if err != nil {
@@ -226,97 +234,243 @@ func signManifestAndGenerateProvenance(appData application.ApplicationData, crea
 		return nil
 	}
 
-	manifestStorageType := interlaceConfig.ManifestStorageType
+	manifestStorageTypes := interlaceConfig.ManifestStorageTypes
 
-	allStorageBackEnds, err := storage.InitializeStorageBackends(appData, manifestStorageType)
+	allStorageBackEnds, err := storage.InitializeStorageBackends(appData, manifestStorageTypes)
 
 	if err != nil {
 		log.Errorf("Error in initializing storage backends: %s", err.Error())
 		return err
 	}
 
-	storageBackend := allStorageBackEnds[manifestStorageType]
+	if len(allStorageBackEnds) == 0 {
+		return fmt.Errorf("Could not find storage backend")
+	}
 
-	if storageBackend != nil {
+	// The first configured backend is the primary one, the previously signed manifest is read from it
+	storageBackend := allStorageBackEnds[manifestStorageTypes[0]]
 
-		manifestGenerated := false
+	manifestGenerated := false
 
-		loc, _ := time.LoadLocation("UTC")
-		buildStartedOn := time.Now().In(loc)
+	loc, _ := time.LoadLocation("UTC")
+	buildStartedOn := time.Now().In(loc)
 
-		log.Info("buildStartedOn:", buildStartedOn, " loc ", loc)
+	log.Info("buildStartedOn:", buildStartedOn, " loc ", loc)
 
-		if created {
+	if created {
 
-			log.Infof("[INFO][%s] Interlace downloads desired manifest from ArgoCD REST API", appData.AppName)
-			manifestGenerated, err = manifest.GenerateInitialManifest(appData)
-			if err != nil {
-				log.Errorf("Error in generating initial manifest: %s", err.Error())
-				return err
-			}
-		} else {
+		log.Infof("[INFO][%s] Interlace downloads desired manifest from ArgoCD REST API", appData.AppName)
+		manifestGenerated, err = manifest.GenerateInitialManifest(appData)
+		if err != nil {
+			log.Errorf("Error in generating initial manifest: %s", err.Error())
+			return err
+		}
+	} else {
 
-			log.Infof("[INFO][%s] Interlace downloads desired manifest from ArgoCD REST API", appData.AppName)
-			yamlBytes, err := storageBackend.GetLatestManifestContent()
-			if err != nil {
-				log.Errorf("Error in retriving latest manifest content: %s", err.Error())
-
-				if storageBackend.Type() == annotation.StorageBackendAnnotation {
-					log.Info("Going to try generating initial manifest again")
-					manifestGenerated, err = manifest.GenerateInitialManifest(appData)
-					log.Info("manifestGenerated after generating initial manifest again: ", manifestGenerated)
-					if err != nil {
-						log.Errorf("Error in generating initial manifest: %s", err.Error())
-						return err
-					}
-				} else {
+		log.Infof("[INFO][%s] Interlace downloads desired manifest from ArgoCD REST API", appData.AppName)
+		yamlBytes, err := storageBackend.GetLatestManifestContent()
+		if err != nil {
+			log.Errorf("Error in retriving latest manifest content: %s", err.Error())
+
+			if storageBackend.Type() == annotation.StorageBackendAnnotation {
+				log.Info("Going to try generating initial manifest again")
+				manifestGenerated, err = manifest.GenerateInitialManifest(appData)
+				log.Info("manifestGenerated after generating initial manifest again: ", manifestGenerated)
+				if err != nil {
+					log.Errorf("Error in generating initial manifest: %s", err.Error())
 					return err
 				}
-
-			}
-			log.Infof("[INFO]: Argocd Interlace generates manifest %s", appData.AppName)
-			manifestGenerated, err = manifest.GenerateManifest(appData, yamlBytes)
-			if err != nil {
-				log.Errorf("Error in generating latest manifest: %s", err.Error())
+			} else {
 				return err
 			}
+
 		}
-		log.Info("manifestGenerated ", manifestGenerated)
-		if manifestGenerated {
+		log.Infof("[INFO]: Argocd Interlace generates manifest %s", appData.AppName)
+		manifestGenerated, err = manifest.GenerateManifest(appData, yamlBytes)
+		if err != nil {
+			log.Errorf("Error in generating latest manifest: %s", err.Error())
+			return err
+		}
+	}
+	log.Info("manifestGenerated ", manifestGenerated)
 
-			err = storageBackend.StoreManifestBundle(sourceVerified)
-			if err != nil {
-				log.Errorf("Error in storing latest manifest bundle(signature, prov) %s", err.Error())
-				return err
-			}
+	if manifestGenerated && interlaceConfig.RejectMutableImageTags {
+		err = verifyImageReferences(appData)
+		if err != nil {
+			return err
+		}
+	}
 
+	// The manifest is only known to be reproducible when it was built again from source
+	reproducible := false
+	if interlaceConfig.ManifestRebuildCheck && (manifestGenerated || interlaceConfig.AlwaysGenerateProv) {
+		err = verifyManifestRebuild(prov, appData)
+		if err != nil {
+			return err
 		}
+		reproducible = true
+	}
+
+	// The manifest is signed and its provenance generated and uploaded once,
+	// every storage backend then stores the same signature and attestation
+	if manifestGenerated {
+		manifestPath := filepath.Join(appData.AppDirPath, utils.MANIFEST_FILE_NAME)
+		signedManifestPath := filepath.Join(appData.AppDirPath, utils.SIGNED_MANIFEST_FILE_NAME)
+		_, err = sign.SignManifest(manifestPath, signedManifestPath)
+		if err != nil {
+			log.Errorf("Error in signing manifest: %s", err.Error())
+			return err
+		}
+	}
 
-		buildFinishedOn := time.Now().In(loc)
+	buildFinishedOn := time.Now().In(loc)
 
-		log.Info("buildFinishedOn:", buildFinishedOn, " loc ", loc)
+	log.Info("buildFinishedOn:", buildFinishedOn, " loc ", loc)
+
+	provenanceGenerated := interlaceConfig.AlwaysGenerateProv || manifestGenerated
+	if provenanceGenerated {
+		err = removeStaleProvenanceFiles(appData)
+		if err != nil {
+			return err
+		}
+		err = provenance.GenerateProvenance(prov, appData, buildStartedOn, buildFinishedOn, reproducible)
+		if err != nil {
+			log.Errorf("Error in generating manifest provenance: %s", err.Error())
+			return err
+		}
+	}
 
-		if interlaceConfig.AlwaysGenerateProv {
+	// Each backend is tried even when another one fails, failures are reported together
+	failedBackends := []string{}
 
-			err = storageBackend.StoreManifestProvenance(buildStartedOn, buildFinishedOn)
+	for _, backendType := range manifestStorageTypes {
+		if manifestGenerated {
+			err = allStorageBackEnds[backendType].StoreManifestBundle(sourceVerified)
 			if err != nil {
-				log.Errorf("Error in storing manifest provenance: %s", err.Error())
-				return err
+				log.Errorf("[%s] Error in storing latest manifest bundle(signature, prov) %s", backendType, err.Error())
+				failedBackends = append(failedBackends, backendType)
+				continue
 			}
-
-		} else {
-			if manifestGenerated {
-				err = storageBackend.StoreManifestProvenance(buildStartedOn, buildFinishedOn)
-				if err != nil {
-					log.Errorf("Error in storing manifest provenance: %s", err.Error())
-					return err
-				}
+		}
+		if provenanceGenerated {
+			err = allStorageBackEnds[backendType].StoreManifestProvenance(buildStartedOn, buildFinishedOn, reproducible)
+			if err != nil {
+				log.Errorf("[%s] Error in storing manifest provenance: %s", backendType, err.Error())
+				failedBackends = append(failedBackends, backendType)
+				continue
 			}
+			log.Infof("[INFO][%s] Interlace stored manifest provenance in storage backend: %s", appData.AppName, backendType)
 		}
-	} else {
+	}
 
-		return fmt.Errorf("Could not find storage backend")
+	if len(failedBackends) > 0 {
+		return fmt.Errorf("Failed to store manifest bundle in storage backends: %s", strings.Join(failedBackends, ", "))
 	}
 
 	return nil
 }
+
+// kustomizeOptions returns the kustomize options of the application source
+func kustomizeOptions(source *appv1.ApplicationSourceKustomize) application.KustomizeOptions {
+	if source == nil {
+		return application.KustomizeOptions{}
+	}
+	images := []string{}
+	for _, image := range source.Images {
+		images = append(images, string(image))
+	}
+	return application.KustomizeOptions{
+		NamePrefix:             source.NamePrefix,
+		NameSuffix:             source.NameSuffix,
+		Images:                 images,
+		CommonLabels:           source.CommonLabels,
+		CommonAnnotations:      source.CommonAnnotations,
+		ForceCommonLabels:      source.ForceCommonLabels,
+		ForceCommonAnnotations: source.ForceCommonAnnotations,
+	}
+}
+
+// storeSourceVerification records the outcome of the source material verification in every
+// storage backend, also when it failed. Errors are logged only, they do not change the outcome.
+func storeSourceVerification(appData application.ApplicationData, verification application.SourceVerification) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return
+	}
+
+	allStorageBackEnds, err := storage.InitializeStorageBackends(appData, interlaceConfig.ManifestStorageTypes)
+	if err != nil {
+		log.Errorf("Error in initializing storage backends: %s", err.Error())
+		return
+	}
+
+	for backendType, storageBackend := range allStorageBackEnds {
+		err = storageBackend.StoreSourceVerification(verification)
+		if err != nil {
+			log.Errorf("[%s] Error in storing source verification: %s", backendType, err.Error())
+		}
+	}
+}
+
+// removeStaleProvenanceFiles removes the provenance files a previous revision left in the
+// application directory, so that storage backends never store them with this revision
+func removeStaleProvenanceFiles(appData application.ApplicationData) error {
+	for _, fileName := range []string{utils.PROVENANCE_FILE_NAME, utils.ATTESTATION_FILE_NAME,
+		utils.REKOR_ENTRY_FILE_NAME, utils.CERTIFICATE_FILE_NAME} {
+		err := os.Remove(filepath.Join(appData.AppDirPath, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error in removing stale %s: %s", fileName, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyManifestRebuild builds the manifest again from the application source and
+// fails when it differs from the desired manifest returned by the Argo CD API, so
+// that a manifest rendered differently by the repo server is not signed
+func verifyManifestRebuild(prov provenance.Provenance, appData application.ApplicationData) error {
+
+	rebuiltManifest, err := prov.RebuildManifest()
+	if err != nil {
+		log.Errorf("Error in rebuilding manifest: %s", err.Error())
+		return err
+	}
+
+	differences, err := manifest.CompareRebuiltManifest(appData, rebuiltManifest)
+	if err != nil {
+		log.Errorf("Error in comparing rebuilt manifest: %s", err.Error())
+		return err
+	}
+	if len(differences) > 0 {
+		log.Errorf("[%s] Desired manifest differs from the manifest rebuilt from source: %s", appData.AppName, strings.Join(differences, "; "))
+		return fmt.Errorf("Refusing to sign manifest of %s, it differs from the manifest rebuilt from source", appData.AppName)
+	}
+
+	log.Infof("[INFO][%s] Desired manifest matches the manifest rebuilt from source", appData.AppName)
+	return nil
+}
+
+// verifyImageReferences fails when the manifest references container images by
+// tag, which may later point to other images than the ones signed
+func verifyImageReferences(appData application.ApplicationData) error {
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(appData.AppDirPath, utils.MANIFEST_FILE_NAME))
+	if err != nil {
+		log.Errorf("Error in reading manifest: %s", err.Error())
+		return err
+	}
+
+	mutableImages, err := images.MutableImages(manifestBytes)
+	if err != nil {
+		log.Errorf("Error in extracting images: %s", err.Error())
+		return err
+	}
+	if len(mutableImages) > 0 {
+		log.Errorf("[%s] Manifest references images by mutable tags: %s", appData.AppName, strings.Join(mutableImages, ", "))
+		return fmt.Errorf("Refusing to sign manifest of %s, images are not pinned by digest: %s", appData.AppName, strings.Join(mutableImages, ", "))
+	}
+	return nil
+}
@@ -22,6 +22,8 @@ import (
 	"strings"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/images"
 	"github.com/IBM/argocd-interlace/pkg/utils"
 	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
 	"github.com/sigstore/k8s-manifest-sigstore/pkg/util/mapnode"
@@ -47,14 +49,26 @@ func GenerateInitialManifest(appData application.ApplicationData) (bool, error)
 	items := gjson.Get(desiredManifest, "items")
 
 	finalManifest := ""
+	imageDigests := map[string]string{}
 
 	for i, item := range items.Array() {
 
 		targetState := gjson.Get(item.String(), "targetState").String()
 
+		targetState, err = pinImages(targetState, imageDigests)
+		if err != nil {
+			return false, err
+		}
+
 		finalManifest = prepareFinalManifest(targetState, finalManifest, i, len(items.Array())-1)
 	}
 
+	err = images.WriteImageDigests(appDirPath, imageDigests)
+	if err != nil {
+		log.Errorf("Error in writing image digests to file: %s", err.Error())
+		return false, err
+	}
+
 	if finalManifest != "" {
 
 		err := utils.WriteToFile(string(finalManifest), appDirPath, utils.MANIFEST_FILE_NAME)
@@ -68,6 +82,8 @@ func GenerateInitialManifest(appData application.ApplicationData) (bool, error)
 	return false, nil
 }
 
+// GenerateManifest writes the desired manifest of the application to manifest.yaml
+// and reports whether it differs from the previously signed manifest in yamlBytes.
 func GenerateManifest(appData application.ApplicationData, yamlBytes []byte) (bool, error) {
 
 	diffCount := 0
@@ -84,16 +100,29 @@ func GenerateManifest(appData application.ApplicationData, yamlBytes []byte) (bo
 
 	items := gjson.Get(desiredManifest, "items")
 
+	// Resources added to or removed from the application change the bundle as well
+	if len(items.Array()) != len(manifestYAMLs) {
+		diffCount += 1
+	}
+
 	// For each resource in desired manifest
 	// Check if it has changed from the version that exist in the bundle manifest
+	imageDigests := map[string]string{}
 	for i, item := range items.Array() {
 		targetState := gjson.Get(item.String(), "targetState").String()
+
+		// Images are pinned before comparing, a tag pointing to another image is a change
+		targetState, err = pinImages(targetState, imageDigests)
+		if err != nil {
+			return false, err
+		}
+
 		if diffCount == 0 {
-			diffExist, err := checkDiff([]byte(targetState), manifestYAMLs)
+			found, err := checkDiff([]byte(targetState), manifestYAMLs)
 			if err != nil {
 				return false, err
 			}
-			if diffExist {
+			if !found {
 				diffCount += 1
 			}
 		}
@@ -102,18 +131,29 @@ func GenerateManifest(appData application.ApplicationData, yamlBytes []byte) (bo
 
 	}
 
+	err = images.WriteImageDigests(appData.AppDirPath, imageDigests)
+	if err != nil {
+		log.Errorf("Error in writing image digests to file: %s", err.Error())
+		return false, err
+	}
+
 	if finalManifest != "" {
 		err := utils.WriteToFile(string(finalManifest), appData.AppDirPath, utils.MANIFEST_FILE_NAME)
 		if err != nil {
 			log.Errorf("Error in writing manifest to file: %s", err.Error())
 			return false, err
 		}
+		if diffCount == 0 {
+			log.Infof("[INFO][%s] Desired manifest is unchanged from the previously signed manifest", appData.AppName)
+			return false, nil
+		}
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// checkDiff returns true when a manifest identical to the target object exists in manifestYAMLs
 func checkDiff(targetObjYAMLBytes []byte, manifestYAMLs [][]byte) (bool, error) {
 
 	objNode, err := mapnode.NewFromBytes(targetObjYAMLBytes) // json
@@ -146,6 +186,41 @@ func checkDiff(targetObjYAMLBytes []byte, manifestYAMLs [][]byte) (bool, error)
 
 }
 
+// pinImages rewrites the images of the target state referenced by tag to their
+// digest when PIN_IMAGE_DIGESTS is set, see images.PinImages
+func pinImages(targetState string, imageDigests map[string]string) (string, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return "", err
+	}
+	if !interlaceConfig.PinImageDigests {
+		return targetState, nil
+	}
+
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(targetState))
+	decoder.UseNumber()
+	err = decoder.Decode(&obj)
+	if err != nil {
+		log.Errorf("Error in unmarshaling target state: %s", err.Error())
+		return "", err
+	}
+
+	err = images.PinImages(obj, imageDigests)
+	if err != nil {
+		log.Errorf("Error in pinning images to digests: %s", err.Error())
+		return "", err
+	}
+
+	pinnedState, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(pinnedState), nil
+}
+
 func prepareFinalManifest(targetState, finalManifest string, counter int, numberOfitems int) string {
 
 	var obj *unstructured.Unstructured
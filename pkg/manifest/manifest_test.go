@@ -0,0 +1,95 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package manifest
+
+import (
+	"testing"
+
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+)
+
+// signedManifest is the previous manifest, as the storage backends return it
+const signedManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  namespace: default
+data:
+  key: value
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  namespace: default
+spec:
+  ports:
+  - port: 80
+`
+
+func TestCheckDiff(t *testing.T) {
+	manifestYAMLs := k8smnfutil.SplitConcatYAMLs([]byte(signedManifest))
+
+	tests := []struct {
+		name        string
+		targetState string
+		manifest    [][]byte
+		wantFound   bool
+	}{
+		{
+			name:        "unchanged resource",
+			targetState: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"app-config","namespace":"default"},"data":{"key":"value"}}`,
+			manifest:    manifestYAMLs,
+			wantFound:   true,
+		},
+		{
+			name:        "unchanged resource in another key order",
+			targetState: `{"kind":"Service","spec":{"ports":[{"port":80}]},"metadata":{"namespace":"default","name":"app"},"apiVersion":"v1"}`,
+			manifest:    manifestYAMLs,
+			wantFound:   true,
+		},
+		{
+			name:        "changed value",
+			targetState: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"app-config","namespace":"default"},"data":{"key":"changed"}}`,
+			manifest:    manifestYAMLs,
+			wantFound:   false,
+		},
+		{
+			name:        "added resource",
+			targetState: `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"app-secret","namespace":"default"}}`,
+			manifest:    manifestYAMLs,
+			wantFound:   false,
+		},
+		{
+			name:        "no previous manifest",
+			targetState: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"app-config","namespace":"default"},"data":{"key":"value"}}`,
+			manifest:    nil,
+			wantFound:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := checkDiff([]byte(tt.targetState), tt.manifest)
+			if err != nil {
+				t.Fatalf("checkDiff() error = %v", err)
+			}
+			if found != tt.wantFound {
+				t.Errorf("checkDiff() = %v, want %v", found, tt.wantFound)
+			}
+		})
+	}
+}
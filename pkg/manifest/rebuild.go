@@ -0,0 +1,206 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/images"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	"github.com/sigstore/k8s-manifest-sigstore/pkg/util/mapnode"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// argocdTrackingLabels and argocdTrackingAnnotations are added by Argo CD to the
+// desired state of the resources it manages
+var argocdTrackingLabels = []string{
+	"app.kubernetes.io/instance",
+}
+var argocdTrackingAnnotations = []string{
+	"argocd.argoproj.io/tracking-id",
+}
+
+// hookAnnotations mark resources that Argo CD runs as hooks and leaves out of the desired state
+var hookAnnotations = []string{
+	"argocd.argoproj.io/hook",
+	"helm.sh/hook",
+}
+
+// CompareRebuiltManifest compares the desired manifest written by GenerateManifest with
+// the manifest rebuilt from the application source, and returns the differences.
+func CompareRebuiltManifest(appData application.ApplicationData, rebuiltManifest []byte) ([]string, error) {
+
+	desiredManifest, err := ioutil.ReadFile(filepath.Join(appData.AppDirPath, utils.MANIFEST_FILE_NAME))
+	if err != nil {
+		log.Errorf("Error in reading desired manifest: %s", err.Error())
+		return nil, err
+	}
+
+	desiredObjs, err := splitObjects(desiredManifest)
+	if err != nil {
+		return nil, err
+	}
+	rebuiltObjs, err := splitObjects(rebuiltManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images of the desired manifest may be pinned to digests, those of the rebuilt one are pinned alike
+	imageDigests, err := images.ReadImageDigests(appData.AppDirPath)
+	if err != nil {
+		log.Errorf("Error in reading image digests: %s", err.Error())
+		return nil, err
+	}
+	if len(imageDigests) > 0 {
+		for _, rebuiltObj := range rebuiltObjs {
+			err = images.PinImages(rebuiltObj.Object, imageDigests)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	differences := []string{}
+	matched := map[int]bool{}
+	for _, rebuiltObj := range rebuiltObjs {
+		if isHook(rebuiltObj) {
+			continue
+		}
+
+		desiredIndex := -1
+		for i, desiredObj := range desiredObjs {
+			if !matched[i] && sameObject(desiredObj, rebuiltObj, appData.AppDestinationNamespace) {
+				desiredIndex = i
+				break
+			}
+		}
+		if desiredIndex < 0 {
+			differences = append(differences, fmt.Sprintf("%s is not in the desired manifest", objectName(rebuiltObj)))
+			continue
+		}
+		matched[desiredIndex] = true
+		normalizeDesiredObject(desiredObjs[desiredIndex], rebuiltObj)
+
+		desiredNode, err := mapnode.NewFromMap(desiredObjs[desiredIndex].Object)
+		if err != nil {
+			log.Errorf("desiredNode error from NewFromMap %s", err.Error())
+			return nil, err
+		}
+		rebuiltNode, err := mapnode.NewFromMap(rebuiltObj.Object)
+		if err != nil {
+			log.Errorf("rebuiltNode error from NewFromMap %s", err.Error())
+			return nil, err
+		}
+		diff := desiredNode.Diff(rebuiltNode)
+		if diff != nil && diff.Size() > 0 {
+			differences = append(differences, fmt.Sprintf("%s differs in %s", objectName(rebuiltObj), strings.Join(diff.Keys(), ", ")))
+		}
+	}
+
+	for i, desiredObj := range desiredObjs {
+		if !matched[i] {
+			differences = append(differences, fmt.Sprintf("%s is not in the rebuilt manifest", objectName(desiredObj)))
+		}
+	}
+
+	return differences, nil
+}
+
+func splitObjects(manifest []byte) ([]*unstructured.Unstructured, error) {
+
+	objs := []*unstructured.Unstructured{}
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifest) {
+		obj := &unstructured.Unstructured{}
+		err := yaml.Unmarshal(item, &obj.Object)
+		if err != nil {
+			log.Errorf("Error in unmarshaling manifest: %s", err.Error())
+			return nil, err
+		}
+		if obj.GetKind() == "" {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// normalizeDesiredObject removes what Argo CD adds to the desired object and is
+// not in the rebuilt one: tracking labels and annotations, and the destination
+// namespace of namespaced resources.
+func normalizeDesiredObject(desiredObj, rebuiltObj *unstructured.Unstructured) {
+
+	if labels := desiredObj.GetLabels(); labels != nil {
+		for _, label := range argocdTrackingLabels {
+			if _, ok := rebuiltObj.GetLabels()[label]; !ok {
+				delete(labels, label)
+			}
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		desiredObj.SetLabels(labels)
+	}
+
+	if annotations := desiredObj.GetAnnotations(); annotations != nil {
+		for _, annotation := range argocdTrackingAnnotations {
+			if _, ok := rebuiltObj.GetAnnotations()[annotation]; !ok {
+				delete(annotations, annotation)
+			}
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		desiredObj.SetAnnotations(annotations)
+	}
+
+	if rebuiltObj.GetNamespace() == "" {
+		desiredObj.SetNamespace("")
+	}
+}
+
+// sameObject returns whether the desired and rebuilt objects are the same resource,
+// a rebuilt object without namespace is deployed in the destination namespace
+func sameObject(desiredObj, rebuiltObj *unstructured.Unstructured, namespace string) bool {
+	return desiredObj.GroupVersionKind().Group == rebuiltObj.GroupVersionKind().Group &&
+		desiredObj.GetKind() == rebuiltObj.GetKind() &&
+		desiredObj.GetName() == rebuiltObj.GetName() &&
+		(desiredObj.GetNamespace() == rebuiltObj.GetNamespace() ||
+			(rebuiltObj.GetNamespace() == "" && desiredObj.GetNamespace() == namespace))
+}
+
+func isHook(obj *unstructured.Unstructured) bool {
+	for _, annotation := range hookAnnotations {
+		if _, ok := obj.GetAnnotations()[annotation]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func objectName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() != "" {
+		return fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+}
@@ -0,0 +1,306 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/images"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const nginxDigest = "sha256:4cf0a4d8f4d6e6a5e1d4f1fa2a2e1b0c8d1f0f2e3c4b5a69788796a5b4c3d2e1"
+
+// rebuiltManifest is the manifest kustomize builds from the source
+const rebuiltManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: guestbook-ui
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: nginx:1.21
+`
+
+// desiredManifest is the manifest Argo CD renders from the same source, with its
+// tracking label and annotation, the destination namespace and the pinned image
+const desiredManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  labels:
+    app.kubernetes.io/instance: guestbook
+  annotations:
+    argocd.argoproj.io/tracking-id: guestbook:/Service:guestbook/guestbook-ui
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  labels:
+    app.kubernetes.io/instance: guestbook
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: nginx:1.21@` + nginxDigest + `
+`
+
+func TestCompareRebuiltManifest(t *testing.T) {
+	tests := []struct {
+		name            string
+		desiredManifest string
+		rebuiltManifest string
+		want            []string
+	}{
+		{
+			name:            "same manifest",
+			desiredManifest: desiredManifest,
+			rebuiltManifest: rebuiltManifest,
+			want:            []string{},
+		},
+		{
+			name:            "hooks are not in the desired manifest",
+			desiredManifest: desiredManifest,
+			rebuiltManifest: rebuiltManifest + `---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    argocd.argoproj.io/hook: PreSync
+`,
+			want: []string{},
+		},
+		{
+			name:            "object not in the desired manifest",
+			desiredManifest: desiredManifest,
+			rebuiltManifest: rebuiltManifest + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: injected
+`,
+			want: []string{"ConfigMap injected is not in the desired manifest"},
+		},
+		{
+			name: "object not in the rebuilt manifest",
+			desiredManifest: desiredManifest + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: injected
+  namespace: guestbook
+`,
+			rebuiltManifest: rebuiltManifest,
+			want:            []string{"ConfigMap guestbook/injected is not in the rebuilt manifest"},
+		},
+		{
+			name:            "object in another namespace",
+			desiredManifest: desiredManifest,
+			rebuiltManifest: `apiVersion: v1
+kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: other
+spec:
+  ports:
+  - port: 80
+`,
+			want: []string{
+				"Service other/guestbook-ui is not in the desired manifest",
+				"Service guestbook/guestbook-ui is not in the rebuilt manifest",
+				"Deployment guestbook/guestbook-ui is not in the rebuilt manifest",
+			},
+		},
+		{
+			name:            "image differs",
+			desiredManifest: desiredManifest,
+			rebuiltManifest: `apiVersion: v1
+kind: Service
+metadata:
+  name: guestbook-ui
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: nginx@` + nginxDigest + `
+`,
+			want: []string{"Deployment guestbook-ui differs in spec.template.spec.containers.0.image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDirPath := t.TempDir()
+			err := ioutil.WriteFile(filepath.Join(appDirPath, utils.MANIFEST_FILE_NAME), []byte(tt.desiredManifest), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = images.WriteImageDigests(appDirPath, map[string]string{"nginx:1.21": nginxDigest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			appData := application.ApplicationData{AppDirPath: appDirPath, AppDestinationNamespace: "guestbook"}
+
+			differences, err := CompareRebuiltManifest(appData, []byte(tt.rebuiltManifest))
+			if err != nil {
+				t.Fatalf("CompareRebuiltManifest() error = %v", err)
+			}
+			if !reflect.DeepEqual(differences, tt.want) {
+				t.Errorf("CompareRebuiltManifest() = %q, want %q", differences, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareRebuiltManifestWithoutDesiredManifest(t *testing.T) {
+	appData := application.ApplicationData{AppDirPath: t.TempDir()}
+	if _, err := CompareRebuiltManifest(appData, []byte(rebuiltManifest)); err == nil {
+		t.Error("CompareRebuiltManifest() without desired manifest succeeded")
+	}
+}
+
+func TestNormalizeDesiredObject(t *testing.T) {
+	tests := []struct {
+		name       string
+		desiredObj string
+		rebuiltObj string
+		want       string
+	}{
+		{
+			name: "tracking label, annotation and destination namespace are removed",
+			desiredObj: `kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  labels:
+    app.kubernetes.io/instance: guestbook
+  annotations:
+    argocd.argoproj.io/tracking-id: guestbook:/Service:guestbook/guestbook-ui
+`,
+			rebuiltObj: `kind: Service
+metadata:
+  name: guestbook-ui
+`,
+			want: `kind: Service
+metadata:
+  name: guestbook-ui
+`,
+		},
+		{
+			name: "other labels and annotations are kept",
+			desiredObj: `kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+  labels:
+    app: guestbook
+    app.kubernetes.io/instance: guestbook
+  annotations:
+    team: web
+`,
+			rebuiltObj: `kind: Service
+metadata:
+  name: guestbook-ui
+  labels:
+    app: guestbook
+`,
+			want: `kind: Service
+metadata:
+  name: guestbook-ui
+  labels:
+    app: guestbook
+  annotations:
+    team: web
+`,
+		},
+		{
+			name: "tracking label and namespace of the source are kept",
+			desiredObj: `kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: web
+  labels:
+    app.kubernetes.io/instance: web
+`,
+			rebuiltObj: `kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: web
+  labels:
+    app.kubernetes.io/instance: web
+`,
+			want: `kind: Service
+metadata:
+  name: guestbook-ui
+  namespace: web
+  labels:
+    app.kubernetes.io/instance: web
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desiredObj := testObject(t, tt.desiredObj)
+			normalizeDesiredObject(desiredObj, testObject(t, tt.rebuiltObj))
+			if want := testObject(t, tt.want); !reflect.DeepEqual(desiredObj.Object, want.Object) {
+				t.Errorf("normalizeDesiredObject() = %v, want %v", desiredObj.Object, want.Object)
+			}
+		})
+	}
+}
+
+func testObject(t *testing.T, s string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(s), &obj.Object); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
@@ -0,0 +1,70 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace = "argocd_interlace"
+)
+
+var (
+	// DriftedResources is the number of resources of an application whose live
+	// state diverges from the signed manifest at the last drift check
+	DriftedResources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "drifted_resources",
+			Help:      "Number of live resources diverging from the signed manifest of the application.",
+		},
+		[]string{"application"},
+	)
+
+	// DriftChecks counts the drift checks of an application by result
+	DriftChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "drift_checks_total",
+			Help:      "Number of drift checks of the application by result (in_sync, drifted, error).",
+		},
+		[]string{"application", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(DriftedResources, DriftChecks)
+}
+
+// StartServer serves the Prometheus metrics at /metrics on addr
+func StartServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Infof("Serving metrics on %s/metrics", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Errorf("Error in serving metrics: %s", err.Error())
+		}
+	}()
+}
@@ -19,102 +19,85 @@ package attestation
 import (
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 
 	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/sign"
 	"github.com/IBM/argocd-interlace/pkg/utils"
 	"github.com/in-toto/in-toto-golang/in_toto"
 	"github.com/secure-systems-lab/go-securesystemslib/dsse"
-	"github.com/sigstore/cosign/pkg/cosign"
 	log "github.com/sirupsen/logrus"
-	"github.com/theupdateframework/go-tuf/encrypted"
-	"golang.org/x/term"
 )
 
+// IntotoSigner signs DSSE envelopes with the configured signer. It records the
+// public key, or in keyless mode the certificate chain, that made its last signature.
 type IntotoSigner struct {
-	priv *ecdsa.PrivateKey
+	signer    sign.Signer
+	pubKey    []byte
+	certChain []byte
 }
 
-const (
-	cli = "/usr/local/bin/rekor-cli"
-)
-
-type SignOpts struct {
-	Pf cosign.PassFunc
+// IntotoVerifier verifies DSSE signatures with the public key of the signing key
+type IntotoVerifier struct {
+	pub   crypto.PublicKey
+	keyID string
 }
 
-var (
-	// Read is for fuzzing
-	Read = readPasswordFn
-)
-
-func GenerateSignedAttestation(it in_toto.Statement, appName, appDirPath string, uploadTLog bool) error {
+// GenerateSignedAttestation signs the statement as a DSSE envelope, writes it to
+// attestation.json and, when uploadTLog is set, uploads it to the Rekor transparency log.
+// The returned entry is nil when nothing was uploaded.
+func GenerateSignedAttestation(it in_toto.Statement, appName, appDirPath string, uploadTLog bool) (*RekorEntry, error) {
 
 	b, err := json.Marshal(it)
 	if err != nil {
 		log.Errorf("Error in marshaling attestation:  %s", err.Error())
-		return err
-	}
-
-	ecdsaPriv, err := ioutil.ReadFile(filepath.Clean(utils.PRIVATE_KEY_PATH))
-	if err != nil {
-		log.Errorf("Error in reading private key:  %s", err.Error())
-		return err
+		return nil, err
 	}
 
-	pb, _ := pem.Decode(ecdsaPriv)
-
-	pwd := ""
-
-	x509Encoded, err := encrypted.Decrypt(pb.Bytes, []byte(pwd))
-
+	intotoSigners, err := NewIntotoSigners()
 	if err != nil {
-		log.Errorf("Error in dycrypting private key: %s", err.Error())
-		return err
+		log.Errorf("Error in creating signer: %s", err.Error())
+		return nil, err
 	}
-	priv, err := x509.ParsePKCS8PrivateKey(x509Encoded)
 
-	if err != nil {
-		log.Errorf("Error in parsing private key: %s", err.Error())
-		return err
+	signVerifiers := []dsse.SignVerifier{}
+	for _, intotoSigner := range intotoSigners {
+		signVerifiers = append(signVerifiers, intotoSigner)
 	}
 
-	signer, err := dsse.NewEnvelopeSigner(&IntotoSigner{
-		priv: priv.(*ecdsa.PrivateKey),
-	})
+	signer, err := dsse.NewEnvelopeSigner(signVerifiers...)
 	if err != nil {
 		log.Errorf("Error in creating new signer: %s", err.Error())
-		return err
+		return nil, err
 	}
 
 	env, err := signer.SignPayload("application/vnd.in-toto+json", b)
 	if err != nil {
 		log.Errorf("Error in signing payload: %s", err.Error())
-		return err
+		return nil, err
 	}
 
-	// Now verify
+	// Now verify, every signature has to be valid
 	err = signer.Verify(env)
 	if err != nil {
 		log.Errorf("Error in verifying env: %s", err.Error())
-		return err
+		return nil, err
 	}
 
 	eb, err := json.Marshal(env)
 	if err != nil {
 		log.Errorf("Error in marshaling env: %s", err.Error())
-		return err
+		return nil, err
 	}
 
 	log.Debug("attestation.json", string(eb))
@@ -122,151 +105,341 @@ func GenerateSignedAttestation(it in_toto.Statement, appName, appDirPath string,
 	err = utils.WriteToFile(string(eb), appDirPath, utils.ATTESTATION_FILE_NAME)
 	if err != nil {
 		log.Errorf("Error in writing attestation to a file: %s", err.Error())
-		return err
+		return nil, err
 	}
 
-	attestationPath := filepath.Join(appDirPath, utils.ATTESTATION_FILE_NAME)
-
-	if uploadTLog {
-		upload(it, attestationPath, appName)
+	// In keyless mode the envelope is verified with the certificate of the ephemeral key
+	var certChain []byte
+	for _, intotoSigner := range intotoSigners {
+		certChain = intotoSigner.certChain
+		if certChain != nil {
+			break
+		}
+	}
+	err = writeCertificateChain(certChain, appDirPath)
+	if err != nil {
+		log.Errorf("Error in writing certificate chain to a file: %s", err.Error())
+		return nil, err
 	}
 
-	return nil
-
-}
+	rekorEntryPath := filepath.Join(appDirPath, utils.REKOR_ENTRY_FILE_NAME)
 
-func readPasswordFn() func() ([]byte, error) {
-	pw, ok := os.LookupEnv("COSIGN_PASSWORD")
-	switch {
-	case ok:
-		return func() ([]byte, error) {
-			return []byte(pw), nil
-		}
-	case term.IsTerminal(0):
-		return func() ([]byte, error) {
-			return term.ReadPassword(0)
-		}
-	// Handle piped in passwords.
-	default:
-		return func() ([]byte, error) {
-			return ioutil.ReadAll(os.Stdin)
+	if !uploadTLog {
+		// Do not leave the entry of a previous attestation next to this one
+		if utils.FileExist(rekorEntryPath) {
+			err = os.Remove(rekorEntryPath)
+			if err != nil {
+				log.Errorf("Error in removing previous transparency log entry: %s", err.Error())
+				return nil, err
+			}
 		}
+		return nil, nil
 	}
-}
 
-func GetPass(confirm bool) ([]byte, error) {
-	read := Read()
-	fmt.Fprint(os.Stderr, "Enter password for private key: ")
-	pw1, err := read()
-	fmt.Fprintln(os.Stderr)
+	rekorEntry, err := upload(env, intotoSigners[0], appName)
 	if err != nil {
+		log.Errorf("Error in uploading attestation to transparency log: %s", err.Error())
 		return nil, err
 	}
-	if !confirm {
-		return pw1, nil
+
+	// Record the entry next to the attestation so that storage backends can persist it
+	rb, err := json.Marshal(rekorEntry)
+	if err != nil {
+		log.Errorf("Error in marshaling transparency log entry: %s", err.Error())
+		return nil, err
+	}
+
+	err = utils.WriteToFile(string(rb), appDirPath, utils.REKOR_ENTRY_FILE_NAME)
+	if err != nil {
+		log.Errorf("Error in writing transparency log entry to a file: %s", err.Error())
+		return nil, err
 	}
-	fmt.Fprint(os.Stderr, "Enter again: ")
-	pw2, err := read()
-	fmt.Fprintln(os.Stderr)
+
+	return rekorEntry, nil
+
+}
+
+// NewIntotoSigners returns a DSSE signer for each key configured by ATTESTATION_KEY_REFS
+func NewIntotoSigners() ([]*IntotoSigner, error) {
+
+	signers, err := sign.GetAttestationSigners()
 	if err != nil {
 		return nil, err
 	}
 
-	if string(pw1) != string(pw2) {
-		return nil, errors.New("passwords do not match")
+	intotoSigners := []*IntotoSigner{}
+	for _, signer := range signers {
+		intotoSigners = append(intotoSigners, &IntotoSigner{signer: signer})
 	}
-	return pw1, nil
+	return intotoSigners, nil
 }
 
+// Sign signs data and returns the fingerprint of the public key as the keyid
 func (it *IntotoSigner) Sign(data []byte) ([]byte, string, error) {
-	h := sha256.Sum256(data)
-	sig, err := it.priv.Sign(rand.Reader, h[:], crypto.SHA256)
+	sig, certChain, err := sign.SignWithCertificate(it.signer, data)
 	if err != nil {
 		return nil, "", err
 	}
-	return sig, "", nil
+
+	// The key of a certificate is the one that made the signature, even when the
+	// signer replaced its ephemeral key since
+	pubKey := certChain
+	if pubKey == nil {
+		pubKey, err = it.signer.PublicKey()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	it.pubKey = pubKey
+	it.certChain = certChain
+
+	pub, err := parsePublicKey(pubKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyID, err := KeyID(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	return sig, keyID, nil
 }
 
-func (it *IntotoSigner) Verify(_ string, data, sig []byte) error {
-	h := sha256.Sum256(data)
-	ok := ecdsa.VerifyASN1(&it.priv.PublicKey, h[:], sig)
-	if ok {
-		return nil
+// Verify checks sig with the public key or certificate that made the last signature
+func (it *IntotoSigner) Verify(keyID string, data, sig []byte) error {
+	pubKey := it.pubKey
+	if pubKey == nil {
+		var err error
+		pubKey, err = it.signer.PublicKey()
+		if err != nil {
+			return err
+		}
 	}
-	return errors.New("invalid signature")
+
+	verifier, err := NewIntotoVerifier(pubKey)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(keyID, data, sig)
 }
 
-func upload(it in_toto.Statement, attestationPath, appName string) {
+// NewIntotoVerifier returns a verifier for the PEM encoded ECDSA, RSA or Ed25519 public
+// key, or for the key of the first certificate of a PEM certificate chain
+func NewIntotoVerifier(pubKey []byte) (*IntotoVerifier, error) {
 
-	pubKeyPath := utils.PUB_KEY_PATH
-	// If we do it twice, it should already exist
-	out := runCli("upload", "--artifact", attestationPath, "--type", "intoto", "--public-key", pubKeyPath, "--pki-format", "x509")
+	pub, err := parsePublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
 
-	outputContains(out, "Created entry at")
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
 
-	_ = getUUIDFromUploadOutput(out)
+	keyID, err := KeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &IntotoVerifier{pub: pub, keyID: keyID}, nil
+}
 
-	log.Infof("[INFO][%s] Interlace generated provenance record of manifest build", appName)
+// Verify checks the signature of data. Signatures with the keyid of another key
+// are reported as dsse.ErrUnknownKey; RSA signatures may use PSS or PKCS#1 v1.5.
+func (iv *IntotoVerifier) Verify(keyID string, data, sig []byte) error {
 
-	log.Infof("[INFO][%s] Interlace stores attestation to provenance record to Rekor transparency log", appName)
+	if keyID != "" && keyID != iv.keyID {
+		return dsse.ErrUnknownKey
+	}
 
-	log.Infof("[INFO][%s] %s", appName, out)
+	h := sha256.Sum256(data)
 
+	switch pub := iv.pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, h[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+		if rsa.VerifyPSS(pub, crypto.SHA256, h[:], sig, pssOpts) == nil {
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, data, sig) {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
 }
 
-func outputContains(output, sub string) {
+// VerifyEnvelope checks the signatures of the envelope against the verifiers and returns
+// the number of verifiers, one per distinct key, with a valid signature. It fails when
+// fewer than threshold keys signed the envelope.
+func VerifyEnvelope(env *dsse.Envelope, verifiers []*IntotoVerifier, threshold int) (int, error) {
 
-	if !strings.Contains(output, sub) {
-		log.Infof(fmt.Sprintf("Expected [%s] in response, got %s", sub, output))
+	if len(env.Signatures) == 0 {
+		return 0, dsse.ErrNoSignature
 	}
+
+	body, err := decodeBase64(env.Payload)
+	if err != nil {
+		return 0, err
+	}
+	paeEnc := dsse.PAE(env.PayloadType, string(body))
+
+	validKeys := map[string]bool{}
+	for _, verifier := range verifiers {
+		if validKeys[verifier.keyID] {
+			continue
+		}
+		for _, signature := range env.Signatures {
+			sig, err := decodeBase64(signature.Sig)
+			if err != nil {
+				continue
+			}
+			if verifier.Verify(signature.KeyID, paeEnc, sig) == nil {
+				validKeys[verifier.keyID] = true
+				break
+			}
+		}
+	}
+
+	if len(validKeys) < threshold {
+		return len(validKeys), fmt.Errorf("%d of the required %d signatures are valid", len(validKeys), threshold)
+	}
+	return len(validKeys), nil
 }
 
-func getUUIDFromUploadOutput(out string) string {
+// SingleSignatureEnvelope returns a copy of the envelope with the signature of the PEM
+// encoded public key or certificate only. Rekor verifies every signature of an intoto
+// entry with the uploaded key, so an envelope signed by several keys is uploaded this way.
+func SingleSignatureEnvelope(env *dsse.Envelope, pubKey []byte) (*dsse.Envelope, error) {
 
-	// Output looks like "Artifact timestamped at ...\m Wrote response \n Created entry at index X, available at $URL/UUID", so grab the UUID:
-	urlTokens := strings.Split(strings.TrimSpace(out), " ")
-	url := urlTokens[len(urlTokens)-1]
-	splitUrl := strings.Split(url, "/")
-	return splitUrl[len(splitUrl)-1]
+	verifier, err := NewIntotoVerifier(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := decodeBase64(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+	paeEnc := dsse.PAE(env.PayloadType, string(body))
+
+	for _, signature := range env.Signatures {
+		sig, err := decodeBase64(signature.Sig)
+		if err != nil {
+			continue
+		}
+		if verifier.Verify(signature.KeyID, paeEnc, sig) == nil {
+			return &dsse.Envelope{
+				PayloadType: env.PayloadType,
+				Payload:     env.Payload,
+				Signatures:  []dsse.Signature{signature},
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("envelope has no signature of key %s", verifier.keyID)
 }
 
-func runCli(arg ...string) string {
-	interlaceConfig, err := config.GetInterlaceConfig()
+// decodeBase64 decodes the standard or the URL safe encoding, both are allowed by DSSE
+func decodeBase64(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		log.Errorf("Error in loading config: %s", err.Error())
-		return ""
+		return base64.URLEncoding.DecodeString(s)
+	}
+	return b, nil
+}
+
+// KeyID returns the fingerprint of the public key used as DSSE keyid: the hex
+// encoded SHA-256 digest of its DER encoded SubjectPublicKeyInfo
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(der)), nil
+}
+
+// parsePublicKey returns the key of a PEM encoded public key or certificate
+func parsePublicKey(pubKey []byte) (crypto.PublicKey, error) {
+	pb, _ := pem.Decode(pubKey)
+	if pb == nil {
+		return nil, errors.New("failed to decode PEM block of public key")
 	}
 
-	rekorServer := interlaceConfig.RekorServer
+	if pb.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(pb.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(pb.Bytes)
+}
 
-	argStr := fmt.Sprintf("--rekor_server=%s", rekorServer)
+// writeCertificateChain writes the certificate chain next to the attestation, or
+// removes the one of a previous attestation when the signer has none.
+func writeCertificateChain(certChain []byte, appDirPath string) error {
 
-	arg = append(arg, argStr)
-	// use a blank config file to ensure no collision
-	if interlaceConfig.RekorTmpDir != "" {
-		arg = append(arg, "--config="+interlaceConfig.RekorTmpDir+".rekor.yaml")
+	if certChain != nil {
+		return utils.WriteToFile(string(certChain), appDirPath, utils.CERTIFICATE_FILE_NAME)
 	}
-	return run("", cli, arg...)
 
+	certPath := filepath.Join(appDirPath, utils.CERTIFICATE_FILE_NAME)
+	if utils.FileExist(certPath) {
+		return os.Remove(certPath)
+	}
+	return nil
 }
 
-func run(stdin, cmd string, arg ...string) string {
+// upload uploads the envelope stored in attestation.json to Rekor with the certificate
+// chain of the first signer, or with its public key when there is no certificate.
+// Rekor verifies every signature of the intoto entry with that key, so the entry holds
+// the signature of the first signer only.
+func upload(env *dsse.Envelope, primary *IntotoSigner, appName string) (*RekorEntry, error) {
 	interlaceConfig, err := config.GetInterlaceConfig()
 	if err != nil {
 		log.Errorf("Error in loading config: %s", err.Error())
-		return ""
+		return nil, err
 	}
-	c := exec.Command(cmd, arg...)
-	if stdin != "" {
-		c.Stdin = strings.NewReader(stdin)
+
+	pubKey := primary.pubKey
+	if pubKey == nil {
+		pubKey, err = primary.signer.PublicKey()
+		if err != nil {
+			log.Errorf("Error in getting public key:  %s", err.Error())
+			return nil, err
+		}
 	}
-	if interlaceConfig.RekorTmpDir != "" {
-		// ensure that we use a clean state.json file for each run
-		c.Env = append(c.Env, "HOME="+interlaceConfig.RekorTmpDir)
+
+	singleEnv, err := SingleSignatureEnvelope(env, pubKey)
+	if err != nil {
+		log.Errorf("Error in selecting signature to upload: %s", err.Error())
+		return nil, err
 	}
-	b, err := c.CombinedOutput()
+
+	envelope, err := json.Marshal(singleEnv)
 	if err != nil {
-		log.Errorf("Error in executing CLI: %s", string(b))
+		log.Errorf("Error in marshaling env: %s", err.Error())
+		return nil, err
 	}
-	return string(b)
+
+	rekorEntry, err := UploadToRekor(interlaceConfig.RekorServer, envelope, pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("[INFO][%s] Interlace generated provenance record of manifest build", appName)
+
+	log.Infof("[INFO][%s] Interlace stores attestation to provenance record to Rekor transparency log", appName)
+
+	log.Infof("[INFO][%s] Created entry at index %d, available at %s/api/v1/log/entries/%s", appName,
+		rekorEntry.LogIndex, interlaceConfig.RekorServer, rekorEntry.UUID)
+
+	return rekorEntry, nil
 }
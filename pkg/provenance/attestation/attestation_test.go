@@ -0,0 +1,376 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package attestation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+)
+
+// testSigner signs with an in-memory key
+type testSigner struct {
+	key crypto.Signer
+	// pss signs with RSA-PSS instead of PKCS#1 v1.5
+	pss bool
+}
+
+func (s *testSigner) Sign(payload []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	if s.pss {
+		return s.key.Sign(rand.Reader, h[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	}
+	return s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+func (s *testSigner) PublicKey() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func newTestIntotoSigners(t *testing.T, n int) []*IntotoSigner {
+	t.Helper()
+	signers := []*IntotoSigner{}
+	for i := 0; i < n; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, &IntotoSigner{signer: &testSigner{key: key}})
+	}
+	return signers
+}
+
+// signTestEnvelope signs an empty statement with each of the signers
+func signTestEnvelope(t *testing.T, signers ...*IntotoSigner) *dsse.Envelope {
+	t.Helper()
+	signVerifiers := []dsse.SignVerifier{}
+	for _, signer := range signers {
+		signVerifiers = append(signVerifiers, signer)
+	}
+	envSigner, err := dsse.NewEnvelopeSigner(signVerifiers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := envSigner.SignPayload("application/vnd.in-toto+json", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func newTestVerifiers(t *testing.T, signers []*IntotoSigner) []*IntotoVerifier {
+	t.Helper()
+	verifiers := []*IntotoVerifier{}
+	for _, signer := range signers {
+		pubKey, err := signer.signer.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier, err := NewIntotoVerifier(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifiers = append(verifiers, verifier)
+	}
+	return verifiers
+}
+
+func TestVerifyEnvelope(t *testing.T) {
+	signers := newTestIntotoSigners(t, 3)
+	verifiers := newTestVerifiers(t, signers)
+
+	tests := []struct {
+		name      string
+		env       *dsse.Envelope
+		verifiers []*IntotoVerifier
+		threshold int
+		wantValid int
+		wantErr   bool
+	}{
+		{
+			name:      "2 of 3 met",
+			env:       signTestEnvelope(t, signers[0], signers[1]),
+			verifiers: verifiers,
+			threshold: 2,
+			wantValid: 2,
+		},
+		{
+			name:      "3 of 3 met",
+			env:       signTestEnvelope(t, signers...),
+			verifiers: verifiers,
+			threshold: 3,
+			wantValid: 3,
+		},
+		{
+			name:      "2 of 3 not met",
+			env:       signTestEnvelope(t, signers[2]),
+			verifiers: verifiers,
+			threshold: 2,
+			wantValid: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "duplicate signatures of one key count once",
+			env:       signTestEnvelope(t, signers[0], signers[0]),
+			verifiers: verifiers,
+			threshold: 2,
+			wantValid: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "duplicate verifiers of one key count once",
+			env:       signTestEnvelope(t, signers[0], signers[1]),
+			verifiers: []*IntotoVerifier{verifiers[0], verifiers[0]},
+			threshold: 2,
+			wantValid: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "signature of unknown key",
+			env:       signTestEnvelope(t, signers[1]),
+			verifiers: verifiers[:1],
+			threshold: 1,
+			wantValid: 0,
+			wantErr:   true,
+		},
+		{
+			name:      "no signature",
+			env:       &dsse.Envelope{PayloadType: "application/vnd.in-toto+json", Payload: "e30="},
+			verifiers: verifiers,
+			threshold: 1,
+			wantValid: 0,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := VerifyEnvelope(tt.env, tt.verifiers, tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyEnvelope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if valid != tt.wantValid {
+				t.Errorf("VerifyEnvelope() = %d valid signatures, want %d", valid, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestSingleSignatureEnvelope(t *testing.T) {
+	signers := newTestIntotoSigners(t, 3)
+	env := signTestEnvelope(t, signers[0], signers[1])
+
+	single, err := SingleSignatureEnvelope(env, signers[1].pubKey)
+	if err != nil {
+		t.Fatalf("SingleSignatureEnvelope() error = %v", err)
+	}
+	if len(single.Signatures) != 1 || single.Signatures[0] != env.Signatures[1] {
+		t.Errorf("SingleSignatureEnvelope() signatures = %+v, want %+v", single.Signatures, env.Signatures[1:])
+	}
+	if single.Payload != env.Payload || single.PayloadType != env.PayloadType {
+		t.Errorf("SingleSignatureEnvelope() changed the payload")
+	}
+
+	otherKey, _ := signers[2].signer.PublicKey()
+	if _, err := SingleSignatureEnvelope(env, otherKey); err == nil {
+		t.Error("SingleSignatureEnvelope() with key of no signature succeeded")
+	}
+}
+
+// newTestKeySigners returns a signer of each supported key type
+func newTestKeySigners(t *testing.T) map[string]*testSigner {
+	t.Helper()
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*testSigner{
+		"ECDSA P-256":  {key: ecdsaKey},
+		"RSA-PSS":      {key: rsaKey, pss: true},
+		"RSA PKCS1v15": {key: rsaKey},
+		"Ed25519":      {key: ed25519Key},
+	}
+}
+
+func TestIntotoSignerKeyTypes(t *testing.T) {
+	for name, keySigner := range newTestKeySigners(t) {
+		keySigner := keySigner
+		t.Run(name, func(t *testing.T) {
+			signer := &IntotoSigner{signer: keySigner}
+			data := []byte("payload")
+
+			sig, keyID, err := signer.Sign(data)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			wantKeyID, err := KeyID(keySigner.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyID != wantKeyID {
+				t.Errorf("Sign() keyid = %s, want %s", keyID, wantKeyID)
+			}
+
+			if err := signer.Verify(keyID, data, sig); err != nil {
+				t.Errorf("IntotoSigner.Verify() error = %v", err)
+			}
+
+			pubKey, err := keySigner.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, err := NewIntotoVerifier(pubKey)
+			if err != nil {
+				t.Fatalf("NewIntotoVerifier() error = %v", err)
+			}
+			if err := verifier.Verify(keyID, data, sig); err != nil {
+				t.Errorf("IntotoVerifier.Verify() error = %v", err)
+			}
+			if err := verifier.Verify("", data, sig); err != nil {
+				t.Errorf("IntotoVerifier.Verify() without keyid error = %v", err)
+			}
+			if err := verifier.Verify(keyID, []byte("other payload"), sig); err == nil {
+				t.Error("IntotoVerifier.Verify() of other data succeeded")
+			}
+			if err := verifier.Verify("other", data, sig); err != dsse.ErrUnknownKey {
+				t.Errorf("IntotoVerifier.Verify() of other keyid error = %v, want %v", err, dsse.ErrUnknownKey)
+			}
+
+			// The envelope signed with the key verifies with the verifier of the key
+			env := signTestEnvelope(t, signer)
+			valid, err := VerifyEnvelope(env, []*IntotoVerifier{verifier}, 1)
+			if err != nil || valid != 1 {
+				t.Errorf("VerifyEnvelope() = %d, %v, want 1 valid signature", valid, err)
+			}
+		})
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	for name, keySigner := range newTestKeySigners(t) {
+		keySigner := keySigner
+		t.Run(name, func(t *testing.T) {
+			der, err := x509.MarshalPKIXPublicKey(keySigner.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256(der)
+
+			keyID, err := KeyID(keySigner.key.Public())
+			if err != nil {
+				t.Fatalf("KeyID() error = %v", err)
+			}
+			if keyID != hex.EncodeToString(digest[:]) {
+				t.Errorf("KeyID() = %s, want the SHA-256 of the DER public key %x", keyID, digest)
+			}
+
+			// The verifier of a certificate has the keyid of the certificate key
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "signer"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			certDER, err := x509.CreateCertificate(rand.Reader, template, template, keySigner.key.Public(), keySigner.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+			verifier, err := NewIntotoVerifier(certPEM)
+			if err != nil {
+				t.Fatalf("NewIntotoVerifier() of certificate error = %v", err)
+			}
+			if verifier.keyID != keyID {
+				t.Errorf("NewIntotoVerifier() of certificate keyid = %s, want %s", verifier.keyID, keyID)
+			}
+		})
+	}
+}
+
+func TestNewIntotoVerifierUnsupportedKey(t *testing.T) {
+	// A DSA public key, that x509 parses but DSSE signatures are not made with
+	params, err := asn1.Marshal(struct{ P, Q, G *big.Int }{big.NewInt(23), big.NewInt(11), big.NewInt(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := asn1.Marshal(big.NewInt(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsaDER, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1},
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: y, BitLength: len(y) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pubKey  []byte
+		wantErr string
+	}{
+		{"DSA key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: dsaDER}), "unsupported public key type *dsa.PublicKey"},
+		{"not PEM", []byte("not a key"), "failed to decode PEM block"},
+		{"invalid DER", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("invalid")}), "asn1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewIntotoVerifier(tt.pubKey)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewIntotoVerifier() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
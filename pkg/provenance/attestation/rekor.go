@@ -0,0 +1,347 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package attestation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
+	"github.com/google/trillian/merkle/logverifier"
+	"github.com/google/trillian/merkle/rfc6962/hasher"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	rekorclient "github.com/sigstore/rekor/pkg/client"
+	"github.com/sigstore/rekor/pkg/generated/client"
+	"github.com/sigstore/rekor/pkg/generated/client/entries"
+	"github.com/sigstore/rekor/pkg/generated/models"
+	"github.com/sigstore/sigstore/pkg/signature"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	intotoAPIVersion = "0.0.1"
+)
+
+// RekorEntry is the transparency log entry created for an attestation. Body is the
+// base64 encoded canonical entry, which records the hash of the uploaded envelope.
+type RekorEntry struct {
+	UUID                 string                 `json:"uuid"`
+	Body                 string                 `json:"body,omitempty"`
+	LogIndex             int64                  `json:"logIndex"`
+	IntegratedTime       int64                  `json:"integratedTime"`
+	LogID                string                 `json:"logID"`
+	SignedEntryTimestamp string                 `json:"signedEntryTimestamp,omitempty"`
+	InclusionProof       *models.InclusionProof `json:"inclusionProof,omitempty"`
+}
+
+// UploadToRekor uploads the DSSE envelope as an intoto entry to the Rekor server
+// and returns the created entry. When the entry already exists, the existing one is returned.
+func UploadToRekor(rekorServer string, envelope, pubKey []byte) (*RekorEntry, error) {
+
+	rekorClient, err := rekorclient.GetRekorClient(rekorServer)
+	if err != nil {
+		log.Errorf("Error in creating rekor client: %s", err.Error())
+		return nil, err
+	}
+
+	pub := strfmt.Base64(pubKey)
+	proposedEntry := &models.Intoto{
+		APIVersion: swag.String(intotoAPIVersion),
+		Spec: models.IntotoV001Schema{
+			Content: &models.IntotoV001SchemaContent{
+				Envelope: string(envelope),
+			},
+			PublicKey: &pub,
+		},
+	}
+
+	params := entries.NewCreateLogEntryParams()
+	params.SetProposedEntry(proposedEntry)
+
+	resp, err := rekorClient.Entries.CreateLogEntry(params)
+	if err != nil {
+		if existsErr, ok := err.(*entries.CreateLogEntryConflict); ok {
+			uuid := uuidFromLocation(existsErr.Location.String())
+			log.Infof("Attestation already exists in transparency log with UUID %s", uuid)
+			return GetRekorEntry(rekorClient, uuid)
+		}
+		log.Errorf("Error in creating transparency log entry: %s", err.Error())
+		return nil, err
+	}
+
+	for uuid, entry := range resp.Payload {
+		rekorEntry := newRekorEntry(uuid, entry)
+
+		// Inclusion proof is not always part of the creation response, fetch the entry to get it
+		if rekorEntry.InclusionProof == nil {
+			fetched, err := GetRekorEntry(rekorClient, uuid)
+			if err != nil {
+				log.Warnf("Could not retrieve inclusion proof of entry %s: %s", uuid, err.Error())
+				return rekorEntry, nil
+			}
+			return fetched, nil
+		}
+		return rekorEntry, nil
+	}
+
+	return nil, fmt.Errorf("Bad response from rekor server %s, no entry created", rekorServer)
+}
+
+// GetRekorEntry returns the transparency log entry with the given UUID
+func GetRekorEntry(rekorClient *client.Rekor, uuid string) (*RekorEntry, error) {
+
+	params := entries.NewGetLogEntryByUUIDParams()
+	params.SetEntryUUID(uuid)
+
+	resp, err := rekorClient.Entries.GetLogEntryByUUID(params)
+	if err != nil {
+		log.Errorf("Error in getting transparency log entry %s: %s", uuid, err.Error())
+		return nil, err
+	}
+
+	for entryUUID, entry := range resp.Payload {
+		return newRekorEntry(entryUUID, entry), nil
+	}
+
+	return nil, fmt.Errorf("Transparency log entry %s not found", uuid)
+}
+
+// ReadRekorEntry returns the transparency log entry recorded in the application
+// directory by GenerateSignedAttestation, or nil when no entry was recorded.
+func ReadRekorEntry(appDirPath string) (*RekorEntry, error) {
+
+	rekorEntryPath := filepath.Join(appDirPath, utils.REKOR_ENTRY_FILE_NAME)
+	if !utils.FileExist(rekorEntryPath) {
+		return nil, nil
+	}
+
+	rb, err := ioutil.ReadFile(filepath.Clean(rekorEntryPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var rekorEntry RekorEntry
+	err = json.Unmarshal(rb, &rekorEntry)
+	if err != nil {
+		return nil, err
+	}
+	return &rekorEntry, nil
+}
+
+// VerifySignedEntryTimestamp checks the signed entry timestamp of the entry with the PEM
+// public key of the Rekor server. The timestamp is the promise of the server that the
+// entry is in the log, it makes the body, integrated time, index and log ID authentic.
+func VerifySignedEntryTimestamp(rekorEntry *RekorEntry, rekorPubKey []byte) error {
+
+	if rekorEntry.SignedEntryTimestamp == "" || rekorEntry.Body == "" {
+		return fmt.Errorf("Transparency log entry %s has no signed entry timestamp", rekorEntry.UUID)
+	}
+
+	pub, err := parsePublicKey(rekorPubKey)
+	if err != nil {
+		return fmt.Errorf("Invalid transparency log public key: %s", err.Error())
+	}
+
+	// The log ID is the fingerprint of the key of the log
+	logID, err := KeyID(pub)
+	if err != nil {
+		return err
+	}
+	if rekorEntry.LogID != logID {
+		return fmt.Errorf("Transparency log entry %s is in log %s, not in the log of the given public key %s", rekorEntry.UUID, rekorEntry.LogID, logID)
+	}
+
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	set, err := base64.StdEncoding.DecodeString(rekorEntry.SignedEntryTimestamp)
+	if err != nil {
+		return fmt.Errorf("Invalid signed entry timestamp: %s", err.Error())
+	}
+
+	// Rekor signs the canonical JSON of the entry without its verification
+	payload, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	}{
+		Body:           rekorEntry.Body,
+		IntegratedTime: rekorEntry.IntegratedTime,
+		LogIndex:       rekorEntry.LogIndex,
+		LogID:          rekorEntry.LogID,
+	})
+	if err != nil {
+		return err
+	}
+	canonicalized, err := jsoncanonicalizer.Transform(payload)
+	if err != nil {
+		return err
+	}
+
+	err = verifier.VerifySignature(bytes.NewReader(set), bytes.NewReader(canonicalized))
+	if err != nil {
+		return fmt.Errorf("Invalid signed entry timestamp of transparency log entry %s: %s", rekorEntry.UUID, err.Error())
+	}
+	return nil
+}
+
+// VerifyEntryBody checks that the body of the entry is the Merkle leaf of its UUID and that
+// it records the hash of the envelope uploaded for one of the signatures of env, see upload.
+func VerifyEntryBody(rekorEntry *RekorEntry, env *dsse.Envelope) error {
+
+	body, err := base64.StdEncoding.DecodeString(rekorEntry.Body)
+	if err != nil {
+		return fmt.Errorf("Invalid body of transparency log entry %s: %s", rekorEntry.UUID, err.Error())
+	}
+
+	leafHash, err := uuidLeafHash(rekorEntry.UUID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.DefaultHasher.HashLeaf(body), leafHash) {
+		return fmt.Errorf("Body of transparency log entry %s does not match its UUID", rekorEntry.UUID)
+	}
+
+	var intoto struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Content struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"content"`
+		} `json:"spec"`
+	}
+	err = json.Unmarshal(body, &intoto)
+	if err != nil {
+		return fmt.Errorf("Invalid body of transparency log entry %s: %s", rekorEntry.UUID, err.Error())
+	}
+	hash := intoto.Spec.Content.Hash
+	if intoto.Kind != (&models.Intoto{}).Kind() || hash.Algorithm != models.IntotoV001SchemaContentHashAlgorithmSha256 {
+		return fmt.Errorf("Transparency log entry %s is not an intoto entry with a sha256 envelope hash", rekorEntry.UUID)
+	}
+
+	for _, sig := range env.Signatures {
+		envelope, err := json.Marshal(&dsse.Envelope{
+			PayloadType: env.PayloadType,
+			Payload:     env.Payload,
+			Signatures:  []dsse.Signature{sig},
+		})
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(envelope)) == hash.Value {
+			return nil
+		}
+	}
+	return fmt.Errorf("Transparency log entry %s does not record a signature of the attestation", rekorEntry.UUID)
+}
+
+// VerifyInclusionProof checks that the inclusion proof recorded with the entry proves
+// the entry, whose UUID is its Merkle leaf hash, to be in the tree of the proof root hash.
+// The root hash is not signed, the proof only adds to VerifySignedEntryTimestamp.
+func VerifyInclusionProof(rekorEntry *RekorEntry) error {
+
+	proof := rekorEntry.InclusionProof
+	if proof == nil {
+		return fmt.Errorf("Transparency log entry %s has no inclusion proof", rekorEntry.UUID)
+	}
+
+	leafHash, err := uuidLeafHash(rekorEntry.UUID)
+	if err != nil {
+		return err
+	}
+
+	rootHash, err := hex.DecodeString(swag.StringValue(proof.RootHash))
+	if err != nil {
+		return fmt.Errorf("Invalid root hash of inclusion proof: %s", err.Error())
+	}
+
+	hashes := [][]byte{}
+	for _, h := range proof.Hashes {
+		hb, err := hex.DecodeString(h)
+		if err != nil {
+			return fmt.Errorf("Invalid hash of inclusion proof: %s", err.Error())
+		}
+		hashes = append(hashes, hb)
+	}
+
+	leafIndex := rekorEntry.LogIndex
+	if proof.LogIndex != nil {
+		leafIndex = *proof.LogIndex
+	}
+
+	verifier := logverifier.New(hasher.DefaultHasher)
+	return verifier.VerifyInclusionProof(leafIndex, swag.Int64Value(proof.TreeSize), hashes, rootHash, leafHash)
+}
+
+// uuidLeafHash returns the Merkle leaf hash of the entry UUID
+func uuidLeafHash(uuid string) ([]byte, error) {
+	// Sharded logs prefix the leaf hash with the tree ID
+	leaf := uuid
+	if len(leaf) > hex.EncodedLen(hasher.DefaultHasher.Size()) {
+		leaf = leaf[len(leaf)-hex.EncodedLen(hasher.DefaultHasher.Size()):]
+	}
+	leafHash, err := hex.DecodeString(leaf)
+	if err != nil || len(leafHash) != hasher.DefaultHasher.Size() {
+		return nil, errors.New("Invalid transparency log entry UUID " + uuid)
+	}
+	return leafHash, nil
+}
+
+func newRekorEntry(uuid string, entry models.LogEntryAnon) *RekorEntry {
+
+	rekorEntry := &RekorEntry{
+		UUID:           uuid,
+		LogIndex:       swag.Int64Value(entry.LogIndex),
+		IntegratedTime: swag.Int64Value(entry.IntegratedTime),
+		LogID:          swag.StringValue(entry.LogID),
+	}
+
+	// The body is the base64 encoded canonical entry
+	if body, ok := entry.Body.(string); ok {
+		rekorEntry.Body = body
+	}
+
+	if entry.Verification != nil {
+		rekorEntry.SignedEntryTimestamp = entry.Verification.SignedEntryTimestamp.String()
+		rekorEntry.InclusionProof = entry.Verification.InclusionProof
+	}
+	return rekorEntry
+}
+
+// uuidFromLocation returns the UUID at the end of an entry URL like $URL/api/v1/log/entries/UUID
+func uuidFromLocation(location string) string {
+	splitUrl := strings.Split(strings.TrimSuffix(location, "/"), "/")
+	return splitUrl[len(splitUrl)-1]
+}
@@ -0,0 +1,474 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package attestation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
+	"github.com/google/trillian/merkle/rfc6962/hasher"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/rekor/pkg/generated/models"
+)
+
+const (
+	entriesPath = "/api/v1/log/entries"
+	testUUID    = "362f8ecba72f4326972bc321d658ba3c9197f29bb8015967e755765ce2ebd9ca"
+)
+
+// fakeRekor is a Rekor server stand-in that creates one entry and answers
+// later uploads of the same entry with a conflict. Like Rekor, it rejects
+// envelopes with a signature that the uploaded key does not verify.
+type fakeRekor struct {
+	created          bool
+	proofOnCreate    bool
+	uploadedEnvelope string
+}
+
+func (f *fakeRekor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	location := "http://" + r.Host + entriesPath + "/" + testUUID
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == entriesPath:
+		body, _ := ioutil.ReadAll(r.Body)
+		var proposed struct {
+			Spec struct {
+				Content struct {
+					Envelope string `json:"envelope"`
+				} `json:"content"`
+				PublicKey []byte `json:"publicKey"`
+			} `json:"spec"`
+		}
+		_ = json.Unmarshal(body, &proposed)
+		f.uploadedEnvelope = proposed.Spec.Content.Envelope
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := verifyAllSignatures(proposed.Spec.Content.Envelope, proposed.Spec.PublicKey); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(models.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Location", location)
+		if f.created {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(models.Error{Code: http.StatusConflict, Message: "an equivalent entry already exists in the transparency log"})
+			return
+		}
+		f.created = true
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(testLogEntry(f.proofOnCreate))
+
+	case r.Method == http.MethodGet && r.URL.Path == entriesPath+"/"+testUUID:
+		if !f.created {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(testLogEntry(true))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// verifyAllSignatures checks every signature of the envelope with the public key,
+// as the intoto type of Rekor does
+func verifyAllSignatures(envelope string, pubKey []byte) error {
+	var env dsse.Envelope
+	if err := json.Unmarshal([]byte(envelope), &env); err != nil {
+		return err
+	}
+	if len(env.Signatures) == 0 {
+		return dsse.ErrNoSignature
+	}
+
+	verifier, err := NewIntotoVerifier(pubKey)
+	if err != nil {
+		return err
+	}
+	body, err := decodeBase64(env.Payload)
+	if err != nil {
+		return err
+	}
+	paeEnc := dsse.PAE(env.PayloadType, string(body))
+	for _, signature := range env.Signatures {
+		sig, err := decodeBase64(signature.Sig)
+		if err != nil {
+			return err
+		}
+		if err := verifier.Verify(signature.KeyID, paeEnc, sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testLogEntry(withProof bool) models.LogEntry {
+	entry := models.LogEntryAnon{
+		Body:           []byte("{}"),
+		IntegratedTime: swag.Int64(1634000000),
+		LogID:          swag.String("c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d"),
+		LogIndex:       swag.Int64(42),
+		Verification:   &models.LogEntryAnonVerification{},
+	}
+	if withProof {
+		entry.Verification.InclusionProof = &models.InclusionProof{
+			Hashes:   []string{"a5e4b1c1e6b1a0b0f7c1d3e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1"},
+			LogIndex: swag.Int64(42),
+			RootHash: swag.String("8b4f3e2d1c0b9a8f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a291807"),
+			TreeSize: swag.Int64(43),
+		}
+	}
+	return models.LogEntry{testUUID: entry}
+}
+
+func TestUploadToRekor(t *testing.T) {
+	fake := &fakeRekor{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	signers := newTestIntotoSigners(t, 2)
+	env := signTestEnvelope(t, signers...)
+
+	// Rekor verifies every signature with the uploaded key, a signature of another key fails
+	multiEnvelope, _ := json.Marshal(env)
+	if _, err := UploadToRekor(server.URL, multiEnvelope, signers[0].pubKey); err == nil {
+		t.Fatal("UploadToRekor() of envelope with signature of another key succeeded")
+	}
+
+	singleEnv, err := SingleSignatureEnvelope(env, signers[0].pubKey)
+	if err != nil {
+		t.Fatalf("SingleSignatureEnvelope() error = %v", err)
+	}
+	envelope, _ := json.Marshal(singleEnv)
+
+	entry, err := UploadToRekor(server.URL, envelope, signers[0].pubKey)
+	if err != nil {
+		t.Fatalf("UploadToRekor() error = %v", err)
+	}
+	if entry.UUID != testUUID || entry.LogIndex != 42 || entry.IntegratedTime != 1634000000 {
+		t.Errorf("UploadToRekor() = %+v, want entry %s at index 42", entry, testUUID)
+	}
+	if entry.Body != "e30=" {
+		t.Errorf("UploadToRekor() body = %s, want the base64 encoded entry e30=", entry.Body)
+	}
+	if fake.uploadedEnvelope != string(envelope) {
+		t.Errorf("uploaded envelope = %s, want %s", fake.uploadedEnvelope, envelope)
+	}
+
+	// The creation response has no inclusion proof, it is read from the created entry
+	if entry.InclusionProof == nil || swag.Int64Value(entry.InclusionProof.TreeSize) != 43 {
+		t.Errorf("UploadToRekor() inclusion proof = %+v, want proof for tree size 43", entry.InclusionProof)
+	}
+
+	// Uploading the same envelope again returns the existing entry
+	existing, err := UploadToRekor(server.URL, envelope, signers[0].pubKey)
+	if err != nil {
+		t.Fatalf("UploadToRekor() of existing entry error = %v", err)
+	}
+	if existing.UUID != testUUID || existing.InclusionProof == nil {
+		t.Errorf("UploadToRekor() of existing entry = %+v, want entry %s with inclusion proof", existing, testUUID)
+	}
+}
+
+func TestUploadToRekorWithInclusionProof(t *testing.T) {
+	server := httptest.NewServer(&fakeRekor{proofOnCreate: true})
+	defer server.Close()
+
+	signers := newTestIntotoSigners(t, 1)
+	envelope, _ := json.Marshal(signTestEnvelope(t, signers...))
+
+	entry, err := UploadToRekor(server.URL, envelope, signers[0].pubKey)
+	if err != nil {
+		t.Fatalf("UploadToRekor() error = %v", err)
+	}
+	if entry.InclusionProof == nil || swag.StringValue(entry.InclusionProof.RootHash) == "" {
+		t.Errorf("UploadToRekor() inclusion proof = %+v, want proof of the creation response", entry.InclusionProof)
+	}
+}
+
+func TestUuidFromLocation(t *testing.T) {
+	for _, location := range []string{
+		"https://rekor.example.com/api/v1/log/entries/" + testUUID,
+		"https://rekor.example.com/api/v1/log/entries/" + testUUID + "/",
+	} {
+		if uuid := uuidFromLocation(location); uuid != testUUID {
+			t.Errorf("uuidFromLocation(%s) = %s, want %s", location, uuid, testUUID)
+		}
+	}
+}
+
+func TestVerifyInclusionProof(t *testing.T) {
+	// Tree of three leaves, the entry is the second one
+	leaves := [][]byte{}
+	for _, leaf := range []string{"entry-0", "entry-1", "entry-2"} {
+		leaves = append(leaves, hasher.DefaultHasher.HashLeaf([]byte(leaf)))
+	}
+	left := hasher.DefaultHasher.HashChildren(leaves[0], leaves[1])
+	root := hasher.DefaultHasher.HashChildren(left, leaves[2])
+
+	newEntry := func() *RekorEntry {
+		return &RekorEntry{
+			UUID:     hex.EncodeToString(leaves[1]),
+			LogIndex: 1,
+			InclusionProof: &models.InclusionProof{
+				Hashes:   []string{hex.EncodeToString(leaves[0]), hex.EncodeToString(leaves[2])},
+				LogIndex: swag.Int64(1),
+				RootHash: swag.String(hex.EncodeToString(root)),
+				TreeSize: swag.Int64(3),
+			},
+		}
+	}
+
+	if err := VerifyInclusionProof(newEntry()); err != nil {
+		t.Errorf("VerifyInclusionProof() error = %v", err)
+	}
+
+	sharded := newEntry()
+	sharded.UUID = "3904496407287907" + sharded.UUID
+	if err := VerifyInclusionProof(sharded); err != nil {
+		t.Errorf("VerifyInclusionProof() of sharded UUID error = %v", err)
+	}
+
+	otherLeaf := newEntry()
+	otherLeaf.UUID = hex.EncodeToString(leaves[2])
+	if err := VerifyInclusionProof(otherLeaf); err == nil {
+		t.Error("VerifyInclusionProof() of another leaf succeeded")
+	}
+
+	otherRoot := newEntry()
+	otherRoot.InclusionProof.RootHash = swag.String(hex.EncodeToString(left))
+	if err := VerifyInclusionProof(otherRoot); err == nil {
+		t.Error("VerifyInclusionProof() with another root hash succeeded")
+	}
+
+	noProof := newEntry()
+	noProof.InclusionProof = nil
+	if err := VerifyInclusionProof(noProof); err == nil {
+		t.Error("VerifyInclusionProof() without proof succeeded")
+	}
+}
+
+// newTestRekorEntry returns the entry that Rekor creates for the envelope uploaded with
+// pubKey, with the signed entry timestamp made by rekorKey
+func newTestRekorEntry(t *testing.T, envelope, pubKey []byte, rekorKey *ecdsa.PrivateKey) *RekorEntry {
+	t.Helper()
+
+	pkb := strfmt.Base64(pubKey)
+	h := sha256.Sum256(envelope)
+	canonicalEntry := &models.Intoto{
+		APIVersion: swag.String(intotoAPIVersion),
+		Spec: &models.IntotoV001Schema{
+			PublicKey: &pkb,
+			Content: &models.IntotoV001SchemaContent{
+				Hash: &models.IntotoV001SchemaContentHash{
+					Algorithm: swag.String(models.IntotoV001SchemaContentHashAlgorithmSha256),
+					Value:     swag.String(hex.EncodeToString(h[:])),
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(canonicalEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logID, err := KeyID(rekorKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := models.LogEntryAnon{
+		Body:           body,
+		IntegratedTime: swag.Int64(1634000000),
+		LogID:          swag.String(logID),
+		LogIndex:       swag.Int64(42),
+	}
+	payload, err := entry.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalized, err := jsoncanonicalizer.Transform(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(canonicalized)
+	set, err := ecdsa.SignASN1(rand.Reader, rekorKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &RekorEntry{
+		UUID:                 hex.EncodeToString(hasher.DefaultHasher.HashLeaf(body)),
+		Body:                 base64.StdEncoding.EncodeToString(body),
+		LogIndex:             42,
+		IntegratedTime:       1634000000,
+		LogID:                logID,
+		SignedEntryTimestamp: base64.StdEncoding.EncodeToString(set),
+	}
+}
+
+func newTestRekorKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestVerifySignedEntryTimestamp(t *testing.T) {
+	rekorKey, rekorPubKey := newTestRekorKey(t)
+	_, otherPubKey := newTestRekorKey(t)
+
+	signers := newTestIntotoSigners(t, 1)
+	envelope, _ := json.Marshal(signTestEnvelope(t, signers...))
+
+	tests := []struct {
+		name    string
+		modify  func(entry *RekorEntry)
+		pubKey  []byte
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			modify: func(entry *RekorEntry) {},
+			pubKey: rekorPubKey,
+		},
+		{
+			name:    "key of another log",
+			modify:  func(entry *RekorEntry) {},
+			pubKey:  otherPubKey,
+			wantErr: true,
+		},
+		{
+			name:    "forged integrated time",
+			modify:  func(entry *RekorEntry) { entry.IntegratedTime = 1700000000 },
+			pubKey:  rekorPubKey,
+			wantErr: true,
+		},
+		{
+			name:    "forged log index",
+			modify:  func(entry *RekorEntry) { entry.LogIndex = 7 },
+			pubKey:  rekorPubKey,
+			wantErr: true,
+		},
+		{
+			name: "forged body",
+			modify: func(entry *RekorEntry) {
+				entry.Body = base64.StdEncoding.EncodeToString([]byte("{}"))
+			},
+			pubKey:  rekorPubKey,
+			wantErr: true,
+		},
+		{
+			name:    "no signed entry timestamp",
+			modify:  func(entry *RekorEntry) { entry.SignedEntryTimestamp = "" },
+			pubKey:  rekorPubKey,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := newTestRekorEntry(t, envelope, signers[0].pubKey, rekorKey)
+			tt.modify(entry)
+			err := VerifySignedEntryTimestamp(entry, tt.pubKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifySignedEntryTimestamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyEntryBody(t *testing.T) {
+	rekorKey, _ := newTestRekorKey(t)
+
+	signers := newTestIntotoSigners(t, 2)
+	env := signTestEnvelope(t, signers...)
+	otherEnv := signTestEnvelope(t, signers[0])
+
+	singleEnvelope := func(env *dsse.Envelope, signer *IntotoSigner) []byte {
+		single, err := SingleSignatureEnvelope(env, signer.pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(single)
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		entry   *RekorEntry
+		env     *dsse.Envelope
+		wantErr bool
+	}{
+		{
+			name:  "signature of the first key",
+			entry: newTestRekorEntry(t, singleEnvelope(env, signers[0]), signers[0].pubKey, rekorKey),
+			env:   env,
+		},
+		{
+			name:  "signature of the second key",
+			entry: newTestRekorEntry(t, singleEnvelope(env, signers[1]), signers[1].pubKey, rekorKey),
+			env:   env,
+		},
+		{
+			name:    "entry of another attestation",
+			entry:   newTestRekorEntry(t, singleEnvelope(otherEnv, signers[0]), signers[0].pubKey, rekorKey),
+			env:     env,
+			wantErr: true,
+		},
+		{
+			name: "body of another UUID",
+			entry: func() *RekorEntry {
+				entry := newTestRekorEntry(t, singleEnvelope(env, signers[0]), signers[0].pubKey, rekorKey)
+				entry.UUID = testUUID
+				return entry
+			}(),
+			env:     env,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyEntryBody(tt.entry, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyEntryBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -19,12 +19,19 @@ package helm
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/images"
 	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/IBM/argocd-interlace/pkg/provenance/slsa"
 	"github.com/IBM/argocd-interlace/pkg/utils"
+	appv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	"github.com/in-toto/in-toto-golang/in_toto"
 	log "github.com/sirupsen/logrus"
 )
@@ -35,6 +42,9 @@ type Provenance struct {
 
 const (
 	ProvenanceAnnotation = "helm"
+
+	// helmSigstoreVerification is the method of the source verification of helm charts
+	helmSigstoreVerification = "helm-sigstore"
 )
 
 func NewProvenance(appData application.ApplicationData) (*Provenance, error) {
@@ -43,46 +53,92 @@ func NewProvenance(appData application.ApplicationData) (*Provenance, error) {
 	}, nil
 }
 
-func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time) error {
+func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
 	appName := p.appData.AppName
 	appSourceRevision := p.appData.AppSourceRevision
 	appDirPath := p.appData.AppDirPath
 	chart := p.appData.Chart
 
-	entryPoint := "helm install"
 	helmChart := fmt.Sprintf("%s-%s.tgz", chart, appSourceRevision)
-	recipe := in_toto.ProvenanceRecipe{
-		EntryPoint: entryPoint,
-		Arguments:  []string{chart + "  " + helmChart},
+	chartHash, _ := utils.ComputeHash(fmt.Sprintf("%s/%s", p.appData.AppPath, helmChart))
+
+	materials := p.generateMaterial(chartHash)
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return err
 	}
 
-	subjects := []in_toto.Subject{}
+	subjects, err := slsa.NewSubjects(target, targetDigest, interlaceConfig.ProvenanceResourceSubjects)
+	if err != nil {
+		log.Errorf("Error in generating provenance subjects:  %s", err.Error())
+		return err
+	}
 
-	targetDigest = strings.ReplaceAll(targetDigest, "sha256:", "")
-	subjects = append(subjects, in_toto.Subject{Name: target,
-		Digest: in_toto.DigestSet{
-			"sha256": targetDigest,
-		},
-	})
+	if interlaceConfig.ProvenanceImageMaterials {
+		imageMaterials, err := slsa.ImageMaterials(target)
+		if err != nil {
+			log.Errorf("Error in generating image materials:  %s", err.Error())
+			return err
+		}
+		materials = append(materials, imageMaterials...)
+	}
 
-	materials := p.generateMaterial()
+	imageDigests, err := images.ReadImageDigests(p.appData.AppDirPath)
+	if err != nil {
+		log.Errorf("Error in reading image digests:  %s", err.Error())
+		return err
+	}
 
-	it := in_toto.Statement{
-		StatementHeader: in_toto.StatementHeader{
-			Type:          in_toto.StatementInTotoV01,
-			PredicateType: in_toto.PredicateSLSAProvenanceV01,
-			Subject:       subjects,
-		},
-		Predicate: in_toto.ProvenancePredicate{
-			Metadata: &in_toto.ProvenanceMetadata{
-				Reproducible:    true,
-				BuildStartedOn:  &buildStartedOn,
-				BuildFinishedOn: &buildFinishedOn,
-			},
+	// The manifest is rebuilt with the helm binary of this controller, not with
+	// the one of Argo CD
+	rebuildVersion := ""
+	if reproducible {
+		rebuildVersion, err = helmVersion()
+		if err != nil {
+			log.Errorf("Error in reading helm version:  %s", err.Error())
+			return err
+		}
+	}
 
-			Materials: materials,
-			Recipe:    recipe,
+	builder, err := slsa.NewBuilderInfo(slsa.VersionHelm, rebuildVersion)
+	if err != nil {
+		log.Errorf("Error in identifying builder:  %s", err.Error())
+		return err
+	}
+
+	build := slsa.Build{
+		BuildType:  slsa.BuildTypeHelm,
+		EntryPoint: "helm install",
+		Arguments:  []string{chart + "  " + helmChart},
+		ConfigSource: slsa.ConfigSource{
+			URI: fmt.Sprintf("%s/%s", p.appData.AppSourceRepoUrl, helmChart),
+			Digest: in_toto.DigestSet{
+				"sha256": chartHash,
+			},
+			EntryPoint: chart,
+		},
+		Parameters: map[string]interface{}{
+			"repoURL":        p.appData.AppSourceRepoUrl,
+			"chart":          chart,
+			"targetRevision": appSourceRevision,
+			"releaseName":    p.appData.ReleaseName,
+			"valueFiles":     p.appData.ValueFiles,
+			"values":         p.appData.Values,
 		},
+		Materials:       materials,
+		ImageDigests:    imageDigests,
+		BuildStartedOn:  buildStartedOn,
+		BuildFinishedOn: buildFinishedOn,
+		Reproducible:    reproducible,
+		Builder:         builder,
+	}
+
+	it, err := slsa.NewStatement(interlaceConfig.ProvenancePredicateVersion, subjects, build)
+	if err != nil {
+		log.Errorf("Error in generating provenance statement:  %s", err.Error())
+		return err
 	}
 	b, err := json.Marshal(it)
 	if err != nil {
@@ -96,27 +152,27 @@ func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog b
 		return err
 	}
 
-	err = attestation.GenerateSignedAttestation(it, appName, appDirPath, uploadTLog)
+	rekorEntry, err := attestation.GenerateSignedAttestation(it, appName, appDirPath, uploadTLog)
 	if err != nil {
 		log.Errorf("Error in generating signed attestation:  %s", err.Error())
 		return err
 	}
 
+	if rekorEntry != nil {
+		log.Infof("[INFO][%s] Attestation uploaded to transparency log with UUID %s", appName, rekorEntry.UUID)
+	}
+
 	return nil
 }
 
-func (p Provenance) generateMaterial() []in_toto.ProvenanceMaterial {
+func (p Provenance) generateMaterial(chartHash string) []in_toto.ProvenanceMaterial {
 
-	appPath := p.appData.AppPath
 	appSourceRepoUrl := p.appData.AppSourceRepoUrl
 	appSourceRevision := p.appData.AppSourceRevision
 	chart := p.appData.Chart
 	values := p.appData.Values
 	materials := []in_toto.ProvenanceMaterial{}
 
-	helmChartPath := fmt.Sprintf("%s/%s-%s.tgz", appPath, chart, appSourceRevision)
-	chartHash, _ := utils.ComputeHash(helmChartPath)
-
 	materials = append(materials, in_toto.ProvenanceMaterial{
 		URI: appSourceRepoUrl + ".git",
 		Digest: in_toto.DigestSet{
@@ -136,13 +192,140 @@ func (p Provenance) generateMaterial() []in_toto.ProvenanceMaterial {
 	return materials
 }
 
-func (p Provenance) VerifySourceMaterial() (bool, error) {
+// RebuildManifest renders the manifest of the application again with helm template
+// from the chart downloaded by VerifySourceMaterial
+func (p Provenance) RebuildManifest() ([]byte, error) {
+
+	appName := p.appData.AppName
+	chart := p.appData.Chart
+	chartPath := fmt.Sprintf("%s/%s-%s.tgz", p.appData.AppPath, chart, p.appData.AppSourceRevision)
+
+	tmpDir, err := ioutil.TempDir("", "helm-")
+	if err != nil {
+		log.Errorf("Error in creating temporary directory: %s", err.Error())
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = utils.CmdExec("tar", tmpDir, "-xzf", chartPath)
+	if err != nil {
+		log.Errorf("Error in extracting Helm chart %s: %s", chartPath, err.Error())
+		return nil, err
+	}
+	chartDir := filepath.Join(tmpDir, chart)
+
+	// Argo CD uses the application name when no release name is given
+	releaseName := p.appData.ReleaseName
+	if releaseName == "" {
+		releaseName = appName
+	}
+
+	kubeVersion, apiVersions, err := p.destinationClusterVersions()
+	if err != nil {
+		log.Errorf("Error in reading versions of destination cluster %s: %s", p.appData.AppClusterUrl, err.Error())
+		return nil, err
+	}
+
+	// Like Argo CD, CRDs of the chart are part of the manifest and the capabilities
+	// of the destination cluster are given to the chart
+	args := []string{"template", releaseName, chartDir, "--include-crds", "--kube-version", kubeVersion}
+	if p.appData.AppDestinationNamespace != "" {
+		args = append(args, "--namespace", p.appData.AppDestinationNamespace)
+	}
+	for _, apiVersion := range apiVersions {
+		args = append(args, "--api-versions", apiVersion)
+	}
+	for _, valueFile := range p.appData.ValueFiles {
+		// Value files are relative to the chart unless they are URLs, and may not be
+		// read from outside of the chart
+		if !strings.Contains(valueFile, "://") {
+			valueFile, err = chartValueFilePath(chartDir, valueFile)
+			if err != nil {
+				log.Errorf("Error in value file of application %s: %s", appName, err.Error())
+				return nil, err
+			}
+		}
+		args = append(args, "--values", valueFile)
+	}
+	if p.appData.Values != "" {
+		valuesPath := filepath.Join(tmpDir, "values-override.yaml")
+		err = ioutil.WriteFile(valuesPath, []byte(p.appData.Values), 0600)
+		if err != nil {
+			log.Errorf("Error in writing Helm values: %s", err.Error())
+			return nil, err
+		}
+		args = append(args, "--values", valuesPath)
+	}
+
+	out, err := utils.CmdExec("helm", "", args...)
+	if err != nil {
+		log.Errorf("Error in executing helm template: %s", err.Error())
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// chartValueFilePath returns the path of a value file of the chart, it fails for
+// absolute paths and paths outside of the chart directory
+func chartValueFilePath(chartDir, valueFile string) (string, error) {
+	if filepath.IsAbs(valueFile) {
+		return "", fmt.Errorf("value file %s is not relative to the chart", valueFile)
+	}
+	valueFilePath := filepath.Join(chartDir, valueFile)
+	if !strings.HasPrefix(valueFilePath, filepath.Clean(chartDir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("value file %s is outside of the chart", valueFile)
+	}
+	return valueFilePath, nil
+}
+
+// destinationClusterVersions returns the Kubernetes version and API versions of the
+// destination cluster of the application, that Argo CD renders the chart for
+func (p Provenance) destinationClusterVersions() (string, []string, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return "", nil, err
+	}
+
+	clientset, inClusterConfig, err := utils.GetClient("")
+	if err != nil {
+		return "", nil, err
+	}
+
+	destination := appv1.ApplicationDestination{Server: p.appData.AppClusterUrl}
+	restConfig, err := utils.ClusterRestConfig(clientset, interlaceConfig.ArgocdNamespace, inClusterConfig, destination)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return utils.ClusterVersions(restConfig)
+}
+
+// Cleanup does nothing, the chart is kept in the application directory
+func (p Provenance) Cleanup() {
+}
+
+// helmVersion returns the version of the helm binary that RebuildManifest runs
+func helmVersion() (string, error) {
+	out, err := utils.CmdExec("helm", "", "version", "--short")
+	if err != nil {
+		return "", err
+	}
+	return "helm " + strings.TrimSpace(out), nil
+}
+
+// VerifySourceMaterial verifies the chart of the application with its provenance file
+// by helm-sigstore. The returned verification records the reason of a failure.
+func (p Provenance) VerifySourceMaterial() (application.SourceVerification, error) {
 
 	appPath := p.appData.AppPath
 	repoUrl := p.appData.AppSourceRepoUrl
 	chart := p.appData.Chart
 	targetRevision := p.appData.AppSourceRevision
 
+	result := application.SourceVerification{Method: helmSigstoreVerification}
+
 	mkDirCmd := "mkdir"
 	_, err := utils.CmdExec(mkDirCmd, "", appPath)
 	helmChartUrl := fmt.Sprintf("%s/%s-%s.tgz", repoUrl, chart, targetRevision)
@@ -152,7 +335,8 @@ func (p Provenance) VerifySourceMaterial() (bool, error) {
 	_, err = utils.CmdExec(curlCmd, appPath, helmChartUrl, "--output", chartPath)
 	if err != nil {
 		log.Infof("Retrive Helm Chart : %s ", err.Error())
-		return false, err
+		result.Error = err.Error()
+		return result, err
 	}
 
 	helmChartProvUrl := fmt.Sprintf("%s/%s-%s.tgz.prov", repoUrl, chart, targetRevision)
@@ -160,7 +344,8 @@ func (p Provenance) VerifySourceMaterial() (bool, error) {
 	_, err = utils.CmdExec(curlCmd, appPath, helmChartProvUrl, "--output", provPath)
 	if err != nil {
 		log.Infof("Retrive Helm Chart Prov : %s ", err.Error())
-		return false, err
+		result.Error = err.Error()
+		return result, err
 	}
 
 	helmCmd := "helm"
@@ -168,11 +353,13 @@ func (p Provenance) VerifySourceMaterial() (bool, error) {
 	_, err = utils.CmdExec(helmCmd, appPath, "sigstore", "verify", chartPath)
 	if err != nil {
 		log.Infof("Helm-sigstore verify : %s ", err.Error())
-		return false, err
+		result.Error = err.Error()
+		return result, err
 	}
 
 	log.Infof("[INFO]: Helm sigstore verify was successful for the  Helm chart: %s ", p.appData.Chart)
 
-	return true, nil
+	result.Verified = true
+	return result, nil
 
 }
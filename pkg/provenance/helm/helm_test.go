@@ -0,0 +1,58 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package helm
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestChartValueFilePath(t *testing.T) {
+
+	chartDir := filepath.Join("/tmp", "helm-123", "mychart")
+
+	tests := []struct {
+		valueFile string
+		expected  string
+		fails     bool
+	}{
+		{valueFile: "values.yaml", expected: filepath.Join(chartDir, "values.yaml")},
+		{valueFile: "envs/prod/values.yaml", expected: filepath.Join(chartDir, "envs", "prod", "values.yaml")},
+		{valueFile: "./envs/../values-prod.yaml", expected: filepath.Join(chartDir, "values-prod.yaml")},
+		{valueFile: "../values.yaml", fails: true},
+		{valueFile: "envs/../../other/values.yaml", fails: true},
+		{valueFile: "..", fails: true},
+		{valueFile: "/etc/passwd", fails: true},
+	}
+
+	for _, test := range tests {
+		valueFilePath, err := chartValueFilePath(chartDir, test.valueFile)
+		if test.fails {
+			if err == nil {
+				t.Errorf("value file %s: expected an error, got path %s", test.valueFile, valueFilePath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("value file %s: unexpected error: %s", test.valueFile, err.Error())
+			continue
+		}
+		if valueFilePath != test.expected {
+			t.Errorf("value file %s: expected path %s, got %s", test.valueFile, test.expected, valueFilePath)
+		}
+	}
+}
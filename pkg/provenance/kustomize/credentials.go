@@ -0,0 +1,402 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	ARGOCD_CONFIG_NAME            = "argocd-cm"
+	ARGOCD_SECRET_TYPE_LABEL      = "argocd.argoproj.io/secret-type"
+	ARGOCD_SECRET_TYPE_REPOSITORY = "repository"
+	ARGOCD_SECRET_TYPE_REPO_CREDS = "repo-creds"
+	GITHUB_API_URL                = "https://api.github.com"
+)
+
+// RepoCredentials are the credentials of a git repository configured in Argo CD
+type RepoCredentials struct {
+	Username                   string
+	Password                   string
+	SSHPrivateKey              string
+	TLSClientCertData          string
+	TLSClientCertKey           string
+	GithubAppID                int64
+	GithubAppInstallationID    int64
+	GithubAppPrivateKey        string
+	GithubAppEnterpriseBaseUrl string
+	Insecure                   bool
+}
+
+// repositoryConfig is a repository of the repositories key, or a credential template of the
+// repository.credentials key, of the Argo CD ConfigMap
+type repositoryConfig struct {
+	URL                        string                    `json:"url"`
+	UsernameSecret             *corev1.SecretKeySelector `json:"usernameSecret,omitempty"`
+	PasswordSecret             *corev1.SecretKeySelector `json:"passwordSecret,omitempty"`
+	SSHPrivateKeySecret        *corev1.SecretKeySelector `json:"sshPrivateKeySecret,omitempty"`
+	TLSClientCertDataSecret    *corev1.SecretKeySelector `json:"tlsClientCertDataSecret,omitempty"`
+	TLSClientCertKeySecret     *corev1.SecretKeySelector `json:"tlsClientCertKeySecret,omitempty"`
+	GithubAppPrivateKeySecret  *corev1.SecretKeySelector `json:"githubAppPrivateKeySecret,omitempty"`
+	GithubAppID                int64                     `json:"githubAppID,omitempty"`
+	GithubAppInstallationID    int64                     `json:"githubAppInstallationID,omitempty"`
+	GithubAppEnterpriseBaseUrl string                    `json:"githubAppEnterpriseBaseUrl,omitempty"`
+	InsecureIgnoreHostKey      bool                      `json:"insecureIgnoreHostKey,omitempty"`
+	Insecure                   bool                      `json:"insecure,omitempty"`
+}
+
+// GetRepoCredentials returns the credentials configured in Argo CD for the git repository,
+// empty when there are none. The credentials of a GitHub App are exchanged for an installation token.
+func GetRepoCredentials(repoUrl string) *RepoCredentials {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return &RepoCredentials{}
+	}
+
+	clientset, _, err := utils.GetClient("")
+	if err != nil {
+		log.Errorf("Error occured while reading incluster kubeconfig %s", err.Error())
+		return &RepoCredentials{}
+	}
+
+	creds, err := findRepoCredentials(clientset, interlaceConfig.ArgocdNamespace, repoUrl)
+	if err != nil {
+		log.Errorf("Error in finding credentials of git repo %s: %s", repoUrl, err.Error())
+		return &RepoCredentials{}
+	}
+
+	if creds.GithubAppPrivateKey != "" {
+		token, err := githubAppToken(creds)
+		if err != nil {
+			log.Errorf("Error in getting GitHub App installation token for git repo %s: %s", repoUrl, err.Error())
+			return &RepoCredentials{}
+		}
+		creds.Username = "x-access-token"
+		creds.Password = token
+	}
+
+	if creds.hasCredentials() {
+		log.Info("Found credentials for target git repo: ", repoUrl)
+	}
+	return creds
+}
+
+// findRepoCredentials returns the credentials of the git repository configured in Argo CD, as Argo CD does:
+// a repository Secret or an entry of the repositories of the Argo CD ConfigMap with the URL of the repository,
+// and when it has no credentials, the repo-creds Secret or entry of repository.credentials of the ConfigMap
+// with the longest URL prefix of the repository.
+func findRepoCredentials(clientset kubernetes.Interface, namespace, repoUrl string) (*RepoCredentials, error) {
+
+	repoSecrets, err := listArgocdSecrets(clientset, namespace, ARGOCD_SECRET_TYPE_REPOSITORY)
+	if err != nil {
+		return nil, err
+	}
+
+	argoConfigMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), ARGOCD_CONFIG_NAME, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	var repositories, templates []repositoryConfig
+	if argoConfigMap != nil {
+		err = yaml.Unmarshal([]byte(argoConfigMap.Data["repositories"]), &repositories)
+		if err != nil {
+			return nil, fmt.Errorf("error in parsing repositories of ConfigMap %s: %s", ARGOCD_CONFIG_NAME, err.Error())
+		}
+		err = yaml.Unmarshal([]byte(argoConfigMap.Data["repository.credentials"]), &templates)
+		if err != nil {
+			return nil, fmt.Errorf("error in parsing repository.credentials of ConfigMap %s: %s", ARGOCD_CONFIG_NAME, err.Error())
+		}
+	}
+
+	var creds *RepoCredentials
+	for _, secret := range repoSecrets {
+		if sameRepoUrl(string(secret.Data["url"]), repoUrl) {
+			creds = credsFromSecret(secret)
+			break
+		}
+	}
+	if creds == nil {
+		for _, repository := range repositories {
+			if sameRepoUrl(repository.URL, repoUrl) {
+				creds, err = credsFromRepositoryConfig(clientset, namespace, repository)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	if creds == nil {
+		creds = &RepoCredentials{}
+	}
+	if creds.hasCredentials() {
+		return creds, nil
+	}
+
+	// Credential templates apply to the repositories with their URL as prefix, the longest prefix first
+	credsSecrets, err := listArgocdSecrets(clientset, namespace, ARGOCD_SECRET_TYPE_REPO_CREDS)
+	if err != nil {
+		return nil, err
+	}
+
+	templateUrls := []string{}
+	templateSecrets := map[string]*corev1.Secret{}
+	templateConfigs := map[string]repositoryConfig{}
+	for _, secret := range credsSecrets {
+		url := string(secret.Data["url"])
+		if _, ok := templateSecrets[url]; !ok {
+			templateUrls = append(templateUrls, url)
+			templateSecrets[url] = secret
+		}
+	}
+	for _, template := range templates {
+		if _, ok := templateSecrets[template.URL]; ok {
+			continue
+		}
+		if _, ok := templateConfigs[template.URL]; !ok {
+			templateUrls = append(templateUrls, template.URL)
+			templateConfigs[template.URL] = template
+		}
+	}
+	sort.SliceStable(templateUrls, func(i, j int) bool {
+		return len(templateUrls[i]) > len(templateUrls[j])
+	})
+
+	for _, url := range templateUrls {
+		if url == "" || !strings.HasPrefix(normalizeRepoUrl(repoUrl), normalizeRepoUrl(url)) {
+			continue
+		}
+		var template *RepoCredentials
+		if secret, ok := templateSecrets[url]; ok {
+			template = credsFromSecret(secret)
+		} else {
+			template, err = credsFromRepositoryConfig(clientset, namespace, templateConfigs[url])
+			if err != nil {
+				return nil, err
+			}
+		}
+		creds.copyCredentials(template)
+		break
+	}
+	return creds, nil
+}
+
+func (c *RepoCredentials) hasCredentials() bool {
+	return c.Username != "" || c.Password != "" || c.SSHPrivateKey != "" ||
+		c.TLSClientCertData != "" || c.GithubAppPrivateKey != ""
+}
+
+// copyCredentials sets the credentials of the template, the insecure flag of the repository is kept
+func (c *RepoCredentials) copyCredentials(template *RepoCredentials) {
+	insecure := c.Insecure
+	*c = *template
+	c.Insecure = insecure || template.Insecure
+}
+
+func listArgocdSecrets(clientset kubernetes.Interface, namespace, secretType string) ([]*corev1.Secret, error) {
+
+	selector := fmt.Sprintf("%s=%s", ARGOCD_SECRET_TYPE_LABEL, secretType)
+	secretList, err := clientset.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []*corev1.Secret{}
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		// Helm repositories are not git repositories
+		if string(secret.Data["type"]) == "helm" {
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	// Sort by name for a stable choice when several Secrets have the same URL
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// credsFromSecret returns the credentials of a declarative repository or repo-creds Secret
+func credsFromSecret(secret *corev1.Secret) *RepoCredentials {
+
+	creds := &RepoCredentials{
+		Username:                   string(secret.Data["username"]),
+		Password:                   string(secret.Data["password"]),
+		SSHPrivateKey:              string(secret.Data["sshPrivateKey"]),
+		TLSClientCertData:          string(secret.Data["tlsClientCertData"]),
+		TLSClientCertKey:           string(secret.Data["tlsClientCertKey"]),
+		GithubAppPrivateKey:        string(secret.Data["githubAppPrivateKey"]),
+		GithubAppEnterpriseBaseUrl: string(secret.Data["githubAppEnterpriseBaseUrl"]),
+	}
+	creds.GithubAppID, _ = strconv.ParseInt(string(secret.Data["githubAppID"]), 10, 64)
+	creds.GithubAppInstallationID, _ = strconv.ParseInt(string(secret.Data["githubAppInstallationID"]), 10, 64)
+	creds.Insecure, _ = strconv.ParseBool(string(secret.Data["insecure"]))
+	return creds
+}
+
+// credsFromRepositoryConfig returns the credentials of an entry of the Argo CD ConfigMap, read from the Secrets it refers to
+func credsFromRepositoryConfig(clientset kubernetes.Interface, namespace string, repository repositoryConfig) (*RepoCredentials, error) {
+
+	creds := &RepoCredentials{
+		GithubAppID:                repository.GithubAppID,
+		GithubAppInstallationID:    repository.GithubAppInstallationID,
+		GithubAppEnterpriseBaseUrl: repository.GithubAppEnterpriseBaseUrl,
+		Insecure:                   repository.Insecure || repository.InsecureIgnoreHostKey,
+	}
+
+	for _, value := range []struct {
+		selector *corev1.SecretKeySelector
+		field    *string
+	}{
+		{repository.UsernameSecret, &creds.Username},
+		{repository.PasswordSecret, &creds.Password},
+		{repository.SSHPrivateKeySecret, &creds.SSHPrivateKey},
+		{repository.TLSClientCertDataSecret, &creds.TLSClientCertData},
+		{repository.TLSClientCertKeySecret, &creds.TLSClientCertKey},
+		{repository.GithubAppPrivateKeySecret, &creds.GithubAppPrivateKey},
+	} {
+		if value.selector == nil {
+			continue
+		}
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), value.selector.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		*value.field = string(secret.Data[value.selector.Key])
+	}
+	return creds, nil
+}
+
+// githubAppToken returns an installation token of the GitHub App, authenticated with a JWT signed by its private key
+func githubAppToken(creds *RepoCredentials) (string, error) {
+
+	key, err := parseRSAPrivateKey([]byte(creds.GithubAppPrivateKey))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		// issued in the past to allow for clock drift with GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": creds.GithubAppID,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	jwt := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	baseUrl := GITHUB_API_URL
+	if creds.GithubAppEnterpriseBaseUrl != "" {
+		baseUrl = strings.TrimSuffix(creds.GithubAppEnterpriseBaseUrl, "/")
+	}
+	tokenUrl := fmt.Sprintf("%s/app/installations/%d/access_tokens", baseUrl, creds.GithubAppInstallationID)
+
+	req, err := http.NewRequest(http.MethodPost, tokenUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	// The installation token grants access to the repositories, the server must be verified
+	resp, err := utils.NewHTTPClient(gitHostAPITimeout).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	response := string(body)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request of %s failed with status %d: %s", tokenUrl, resp.StatusCode, gjson.Get(response, "message").String())
+	}
+
+	token := gjson.Get(response, "token").String()
+	if token == "" {
+		return "", fmt.Errorf("no token in response of %s: %s", tokenUrl, gjson.Get(response, "message").String())
+	}
+	return token, nil
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// normalizeRepoUrl returns the repository URL in lower case without trailing slash and .git suffix
+func normalizeRepoUrl(url string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(url), "/"), gitSuffix)
+}
+
+// sameRepoUrl compares repository URLs regardless of case, trailing slash and .git suffix
+func sameRepoUrl(url1, url2 string) bool {
+	return normalizeRepoUrl(url1) == normalizeRepoUrl(url2)
+}
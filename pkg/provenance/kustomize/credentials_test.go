@@ -0,0 +1,249 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "argocd"
+
+func argocdSecret(name, secretType string, data map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Data:       map[string][]byte{},
+	}
+	if secretType != "" {
+		secret.ObjectMeta.Labels = map[string]string{ARGOCD_SECRET_TYPE_LABEL: secretType}
+	}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
+
+func argocdConfigMap(repositories, templates string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ARGOCD_CONFIG_NAME, Namespace: testNamespace},
+		Data: map[string]string{
+			"repositories":           repositories,
+			"repository.credentials": templates,
+		},
+	}
+}
+
+func TestFindRepoCredentials(t *testing.T) {
+
+	repoUrl := "https://github.com/example/app.git"
+
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		expected RepoCredentials
+	}{
+		{
+			name:     "no credentials",
+			objects:  []runtime.Object{},
+			expected: RepoCredentials{},
+		},
+		{
+			name: "repository Secret before ConfigMap and templates",
+			objects: []runtime.Object{
+				argocdSecret("repo", ARGOCD_SECRET_TYPE_REPOSITORY, map[string]string{
+					"url": "https://github.com/Example/app", "username": "secret-user", "password": "secret-pass"}),
+				argocdSecret("repo-user", "", map[string]string{"password": "cm-pass"}),
+				argocdConfigMap(`
+- url: https://github.com/example/app.git
+  passwordSecret:
+    name: repo-user
+    key: password
+`, ""),
+				argocdSecret("creds", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com/example", "password": "template-pass"}),
+			},
+			expected: RepoCredentials{Username: "secret-user", Password: "secret-pass"},
+		},
+		{
+			name: "helm repository Secret is ignored",
+			objects: []runtime.Object{
+				argocdSecret("helm", ARGOCD_SECRET_TYPE_REPOSITORY, map[string]string{
+					"url": "https://github.com/example/app.git", "type": "helm", "password": "helm-pass"}),
+			},
+			expected: RepoCredentials{},
+		},
+		{
+			name: "ConfigMap repository reads the Secrets it refers to",
+			objects: []runtime.Object{
+				argocdSecret("repo-ssh", "", map[string]string{"sshPrivateKey": "ssh-key"}),
+				argocdConfigMap(`
+- url: https://github.com/example/app
+  sshPrivateKeySecret:
+    name: repo-ssh
+    key: sshPrivateKey
+  insecureIgnoreHostKey: true
+`, ""),
+			},
+			expected: RepoCredentials{SSHPrivateKey: "ssh-key", Insecure: true},
+		},
+		{
+			name: "longest template prefix, repository insecure flag kept",
+			objects: []runtime.Object{
+				argocdSecret("repo", ARGOCD_SECRET_TYPE_REPOSITORY, map[string]string{
+					"url": repoUrl, "insecure": "true"}),
+				argocdSecret("creds-org", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com/example", "password": "org-pass"}),
+				argocdSecret("creds-host", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com", "password": "host-pass"}),
+			},
+			expected: RepoCredentials{Password: "org-pass", Insecure: true},
+		},
+		{
+			name: "ConfigMap template with a longer prefix than the Secret template",
+			objects: []runtime.Object{
+				argocdSecret("creds-host", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com", "password": "host-pass"}),
+				argocdSecret("org-user", "", map[string]string{"username": "org-user"}),
+				argocdConfigMap("", `
+- url: https://github.com/example
+  usernameSecret:
+    name: org-user
+    key: username
+`),
+			},
+			expected: RepoCredentials{Username: "org-user"},
+		},
+		{
+			name: "Secret template before ConfigMap template of the same URL",
+			objects: []runtime.Object{
+				argocdSecret("creds-org", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com/example", "password": "secret-pass"}),
+				argocdSecret("org-user", "", map[string]string{"username": "org-user"}),
+				argocdConfigMap("", `
+- url: https://github.com/example
+  usernameSecret:
+    name: org-user
+    key: username
+`),
+			},
+			expected: RepoCredentials{Password: "secret-pass"},
+		},
+		{
+			name: "template of another organization",
+			objects: []runtime.Object{
+				argocdSecret("creds-other", ARGOCD_SECRET_TYPE_REPO_CREDS, map[string]string{
+					"url": "https://github.com/other", "password": "other-pass"}),
+			},
+			expected: RepoCredentials{},
+		},
+	}
+
+	for _, test := range tests {
+		clientset := fake.NewSimpleClientset(test.objects...)
+		creds, err := findRepoCredentials(clientset, testNamespace, repoUrl)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if *creds != test.expected {
+			t.Errorf("%s: expected credentials %+v, got %+v", test.name, test.expected, *creds)
+		}
+	}
+}
+
+func TestFindRepoCredentialsMissingSecret(t *testing.T) {
+
+	clientset := fake.NewSimpleClientset(argocdConfigMap(`
+- url: https://github.com/example/app
+  passwordSecret:
+    name: missing
+    key: password
+`, ""))
+	_, err := findRepoCredentials(clientset, testNamespace, "https://github.com/example/app")
+	if err == nil {
+		t.Error("expected an error for a Secret the ConfigMap refers to that does not exist")
+	}
+}
+
+func TestGithubAppToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// The JWT is signed by the private key of the App
+		jwt := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(jwt) != 3 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(jwt[2])
+		digest := sha256.Sum256([]byte(jwt[0] + "." + jwt[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"A JSON web token could not be decoded"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token":"ghs_installation"}`)
+	}))
+	defer server.Close()
+
+	creds := &RepoCredentials{
+		GithubAppID:                1,
+		GithubAppInstallationID:    42,
+		GithubAppPrivateKey:        string(keyPEM),
+		GithubAppEnterpriseBaseUrl: server.URL,
+	}
+	token, err := githubAppToken(creds)
+	if err != nil {
+		t.Fatalf("githubAppToken() error = %v", err)
+	}
+	if token != "ghs_installation" {
+		t.Errorf("githubAppToken() = %s, want ghs_installation", token)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds.GithubAppPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)}))
+	if _, err := githubAppToken(creds); err == nil {
+		t.Error("githubAppToken() with the key of another App succeeded")
+	}
+}
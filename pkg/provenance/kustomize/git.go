@@ -0,0 +1,557 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// gitMutex serializes git operations, as go-git selects the https client of a fetch globally
+var gitMutex sync.Mutex
+
+// kustomizationFileNames are the file names kustomize recognizes as kustomization
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// fetchCommit fetches the commit commitSha of the git repository at url with the given credentials,
+// or the latest commit of the revision without commitSha. Only the latest commit of the revision
+// is fetched when it is the synced one, otherwise the revision history is fetched to find it.
+// The annotated tag of the revision is returned as well when it points to the commit.
+func fetchCommit(url, revision, commitSha string, creds *RepoCredentials) (*object.Commit, *object.Tag, error) {
+
+	auth, unlock, err := lockGitTransport(url, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		log.Errorf("Error in initializing git repository: %s", err.Error())
+		return nil, nil, err
+	}
+
+	remote, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+	if err != nil {
+		log.Errorf("Error in adding git remote: %s", err.Error())
+		return nil, nil, err
+	}
+
+	refs, err := listReferences(url, auth, creds.Insecure)
+	if err != nil {
+		log.Errorf("Error in listing references of %s: %s", url, err.Error())
+		return nil, nil, err
+	}
+
+	ref, err := findRevision(refs, revision)
+	if err != nil {
+		log.Errorf("Error in finding revision: %s", err.Error())
+		return nil, nil, err
+	}
+
+	depth := 1
+	if commitSha != "" && ref.Hash().String() != commitSha {
+		log.Warnf("Synced commit %s is not the latest commit %s of revision %s, fetching its history", commitSha, ref.Hash().String(), revision)
+		depth = 0
+	}
+
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("+%s:refs/remotes/origin/%s", ref.Name(), ref.Name().Short()))
+	err = remote.Fetch(&git.FetchOptions{
+		RefSpecs:        []gitconfig.RefSpec{refSpec},
+		Depth:           depth,
+		Auth:            auth,
+		Tags:            git.NoTags,
+		InsecureSkipTLS: creds.Insecure,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		log.Errorf("Error in fetching %s from %s: %s", ref.Name(), url, err.Error())
+		return nil, nil, err
+	}
+
+	hash := ref.Hash()
+	if commitSha != "" {
+		hash = plumbing.NewHash(commitSha)
+	}
+
+	commit, err := resolveCommit(repo, hash)
+	if err != nil {
+		err = fmt.Errorf("Synced commit %s not found in revision %s of %s: %s", commitSha, revision, url, err.Error())
+		log.Errorf("Error in checking out source: %s", err.Error())
+		return nil, nil, err
+	}
+
+	var tag *object.Tag
+	if ref.Name().IsTag() {
+		// The fetched reference keeps the hash of the annotated tag, the listed one is peeled to the commit
+		fetchedRef, err := repo.Reference(refSpec.Dst(ref.Name()), true)
+		if err == nil {
+			tag, err = repo.TagObject(fetchedRef.Hash())
+			if err != nil || tag.Target != commit.Hash {
+				tag = nil
+			}
+		}
+	}
+	return commit, tag, nil
+}
+
+// lsRemote returns the references of the git repository at url as git ls-remote,
+// with the commit annotated tags point to instead of the tag
+func lsRemote(url string, creds *RepoCredentials) ([]*plumbing.Reference, error) {
+
+	auth, unlock, err := lockGitTransport(url, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return listReferences(url, auth, creds.Insecure)
+}
+
+// lockGitTransport returns the auth method of the credentials and installs the https client with their
+// TLS settings, until the returned function is called
+func lockGitTransport(url string, creds *RepoCredentials) (transport.AuthMethod, func(), error) {
+
+	auth, err := newGitAuth(url, creds)
+	if err != nil {
+		log.Errorf("Error in loading git credentials: %s", err.Error())
+		return nil, nil, err
+	}
+
+	httpClient, err := newGitHTTPClient(creds)
+	if err != nil {
+		log.Errorf("Error in loading git TLS client certificate: %s", err.Error())
+		return nil, nil, err
+	}
+
+	gitMutex.Lock()
+	client.InstallProtocol("https", httpClient)
+
+	unlock := func() {
+		client.InstallProtocol("https", githttp.DefaultClient)
+		gitMutex.Unlock()
+	}
+	return auth, unlock, nil
+}
+
+// listReferences returns the references advertised by the git repository at url,
+// with annotated tags peeled to their commit
+func listReferences(url string, auth transport.AuthMethod, insecure bool) (refs []*plumbing.Reference, err error) {
+
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.InsecureSkipTLS = insecure
+
+	gitClient, err := client.NewClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := gitClient.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	advRefs, err := session.AdvertisedReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	allRefs, err := advRefs.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	for name, hash := range advRefs.Peeled {
+		allRefs[plumbing.ReferenceName(name)] = plumbing.NewHashReference(plumbing.ReferenceName(name), hash)
+	}
+
+	for _, ref := range allRefs {
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// findRevision returns the reference of the branch or tag revision, or of the default branch
+// when the revision is empty or HEAD
+func findRevision(refs []*plumbing.Reference, revision string) (*plumbing.Reference, error) {
+
+	refsByName := map[plumbing.ReferenceName]*plumbing.Reference{}
+	for _, ref := range refs {
+		refsByName[ref.Name()] = ref
+	}
+
+	candidates := []plumbing.ReferenceName{plumbing.ReferenceName(revision),
+		plumbing.NewBranchReferenceName(revision), plumbing.NewTagReferenceName(revision)}
+	if revision == "" || revision == "HEAD" {
+		candidates = []plumbing.ReferenceName{plumbing.HEAD}
+	}
+
+	for _, name := range candidates {
+		ref, ok := refsByName[name]
+		if !ok {
+			continue
+		}
+		if ref.Type() == plumbing.SymbolicReference {
+			target, ok := refsByName[ref.Target()]
+			if !ok {
+				continue
+			}
+			return target, nil
+		}
+		return ref, nil
+	}
+	return nil, fmt.Errorf("Revision %s not found", revision)
+}
+
+// resolveCommit returns the commit with the given hash, or the commit an annotated tag with the hash points to
+func resolveCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+
+	commit, err := repo.CommitObject(hash)
+	if err == nil {
+		return commit, nil
+	}
+	tag, tagErr := repo.TagObject(hash)
+	if tagErr != nil {
+		return nil, err
+	}
+	return tag.Commit()
+}
+
+func newGitAuth(url string, creds *RepoCredentials) (transport.AuthMethod, error) {
+
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		if creds.SSHPrivateKey == "" {
+			return nil, nil
+		}
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		auth, err := gitssh.NewPublicKeys(user, []byte(creds.SSHPrivateKey), "")
+		if err != nil {
+			return nil, err
+		}
+		if creds.Insecure {
+			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		}
+		return auth, nil
+	case "http", "https":
+		if creds.Username == "" && creds.Password == "" {
+			return nil, nil
+		}
+		// Git servers accept a token as password with any user name
+		username := creds.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		return &githttp.BasicAuth{Username: username, Password: creds.Password}, nil
+	}
+	return nil, nil
+}
+
+func newGitHTTPClient(creds *RepoCredentials) (transport.Transport, error) {
+
+	if creds.TLSClientCertData == "" && !creds.Insecure {
+		return githttp.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: creds.Insecure}
+	if creds.TLSClientCertData != "" {
+		cert, err := tls.X509KeyPair([]byte(creds.TLSClientCertData), []byte(creds.TLSClientCertKey))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return githttp.NewClient(&http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}), nil
+}
+
+// checkoutPaths writes the files of the commit under the given paths of the repository to dir.
+// The local bases, components and files referred to by the kustomizations written are checked out as well.
+func checkoutPaths(commit *object.Commit, dir string, paths ...string) error {
+
+	tree, err := commit.Tree()
+	if err != nil {
+		log.Errorf("Error in reading tree of commit %s: %s", commit.Hash.String(), err.Error())
+		return err
+	}
+
+	done := []string{}
+	queue := append([]string{}, paths...)
+	for len(queue) > 0 {
+		p := strings.TrimPrefix(path.Clean(queue[0]), "/")
+		queue = queue[1:]
+		if p == "." {
+			p = ""
+		}
+		if p == ".." || strings.HasPrefix(p, "../") {
+			log.Warnf("Path %s is outside of source repository", p)
+			continue
+		}
+		if isCheckedOut(done, p) {
+			continue
+		}
+		done = append(done, p)
+
+		files, err := treeFiles(tree, p)
+		if err != nil {
+			log.Errorf("Error in reading %s from commit %s: %s", p, commit.Hash.String(), err.Error())
+			return err
+		}
+
+		for _, f := range files {
+			err = writeTreeFile(dir, f)
+			if err != nil {
+				log.Errorf("Error in writing %s: %s", f.Name, err.Error())
+				return err
+			}
+			if !isKustomization(f.Name) {
+				continue
+			}
+			content, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			for _, ref := range kustomizationRefs([]byte(content)) {
+				queue = append(queue, path.Join(path.Dir(f.Name), ref))
+			}
+		}
+	}
+	return nil
+}
+
+func isCheckedOut(done []string, p string) bool {
+	for _, d := range done {
+		if d == "" || p == d || strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// treeFiles returns the files under the path p of the tree, or all the files for an empty path
+func treeFiles(tree *object.Tree, p string) ([]*object.File, error) {
+
+	if p != "" {
+		entry, err := tree.FindEntry(p)
+		if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+			log.Warnf("Path %s not found in source repository", p)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch entry.Mode {
+		case filemode.Dir:
+		case filemode.Submodule:
+			log.Warnf("Submodule %s is not checked out", p)
+			return nil, nil
+		default:
+			f, err := tree.File(p)
+			if err != nil {
+				return nil, err
+			}
+			return []*object.File{f}, nil
+		}
+
+		tree, err = tree.Tree(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := []*object.File{}
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if p != "" {
+			f.Name = path.Join(p, f.Name)
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+func writeTreeFile(dir string, f *object.File) error {
+
+	filePath := filepath.Join(dir, filepath.FromSlash(f.Name))
+	err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(filePath)
+		return os.Symlink(target, filePath)
+	}
+
+	perm := os.FileMode(0644)
+	if f.Mode == filemode.Executable {
+		perm = 0755
+	}
+
+	reader, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func isKustomization(name string) bool {
+	base := path.Base(name)
+	for _, kustomizationFileName := range kustomizationFileNames {
+		if base == kustomizationFileName {
+			return true
+		}
+	}
+	return false
+}
+
+// kustomizationRefs returns the local paths a kustomization refers to, relative to its directory
+func kustomizationRefs(content []byte) []string {
+
+	var kustomization map[string]interface{}
+	err := yaml.Unmarshal(content, &kustomization)
+	if err != nil {
+		log.Warnf("Error in parsing kustomization: %s", err.Error())
+		return nil
+	}
+
+	refs := []string{}
+	for _, key := range []string{"resources", "bases", "components", "crds", "configurations",
+		"patchesStrategicMerge", "generators", "transformers", "validators"} {
+		refs = append(refs, stringList(kustomization[key])...)
+	}
+
+	for _, key := range []string{"patches", "patchesJson6902", "replacements"} {
+		for _, item := range objectList(kustomization[key]) {
+			refs = append(refs, stringList(item["path"])...)
+		}
+	}
+
+	for _, key := range []string{"configMapGenerator", "secretGenerator"} {
+		for _, item := range objectList(kustomization[key]) {
+			for _, file := range stringList(item["files"]) {
+				// files may be given as key=path
+				refs = append(refs, file[strings.Index(file, "=")+1:])
+			}
+			refs = append(refs, stringList(item["envs"])...)
+			refs = append(refs, stringList(item["env"])...)
+		}
+	}
+
+	if openapi, ok := kustomization["openapi"].(map[string]interface{}); ok {
+		refs = append(refs, stringList(openapi["path"])...)
+	}
+
+	localRefs := []string{}
+	for _, ref := range refs {
+		if ref == "" || strings.Contains(ref, "\n") || isRemoteRef(ref) {
+			continue
+		}
+		localRefs = append(localRefs, ref)
+	}
+	return localRefs
+}
+
+// isRemoteRef tells if a kustomization refers to a remote resource, which kustomize fetches itself
+func isRemoteRef(ref string) bool {
+	if strings.Contains(ref, "://") || strings.Contains(ref, "?ref=") || strings.Contains(ref, "?version=") {
+		return true
+	}
+	for _, prefix := range []string{"git@", "git::", "gh:", "github.com/", "github.com:"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func objectList(value interface{}) []map[string]interface{} {
+	list := []map[string]interface{}{}
+	if items, ok := value.([]interface{}); ok {
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				list = append(list, m)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,317 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	GIT_SIGNATURE_FORMAT_GPG = "gpg"
+	GIT_SIGNATURE_FORMAT_SSH = "ssh"
+
+	beginPGPSignature     = "-----BEGIN PGP SIGNATURE-----"
+	beginSSHSignature     = "-----BEGIN SSH SIGNATURE-----"
+	beginX509Signature    = "-----BEGIN SIGNED MESSAGE-----"
+	sshSignatureMagic     = "SSHSIG"
+	sshSignatureNamespace = "git"
+)
+
+// GitSigner is the verified signer of a git commit or annotated tag
+type GitSigner struct {
+	// Identity is the user id of the GPG key or the principals of the SSH key
+	Identity string
+	// Key is the fingerprint of the GPG or SSH key
+	Key string
+	// Format is "gpg" or "ssh"
+	Format string
+	// Object is the signed object, "commit" or "tag"
+	Object string
+}
+
+// UntrustedSignatureError tells that a git commit or tag is not signed by a trusted key:
+// it is not signed, its signature is invalid or in an unsupported format, or its key is
+// not trusted. Other errors of VerifySignature are errors in reading the trusted keys.
+type UntrustedSignatureError struct {
+	Reason string
+}
+
+func (e *UntrustedSignatureError) Error() string {
+	return e.Reason
+}
+
+func untrustedSignature(format string, args ...interface{}) error {
+	return &UntrustedSignatureError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// sshSignature is the blob of an armored SSH signature after the magic preamble
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is the data signed by an SSH signature after the magic preamble
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// VerifySignature verifies the signature of the annotated tag of the revision when it is signed,
+// otherwise the one of the checked out commit. GPG signatures are verified with the keyring at
+// keyPath and SSH signatures with the allowed signers file at allowedSignersPath. An
+// UntrustedSignatureError is returned when the signature is not made by a trusted key.
+func (r *GitRepoResult) VerifySignature(keyPath, allowedSignersPath string) (*GitSigner, error) {
+	payload, signature, signedObject, err := signedPayload(r.commit, r.tag)
+	if err != nil {
+		log.Errorf("Error in reading signature of %s: %s", r.CommitID, err.Error())
+		return nil, err
+	}
+	if signature == "" {
+		return nil, untrustedSignature("The %s %s of %s is not signed", signedObject, r.CommitID, r.URL)
+	}
+
+	var signer *GitSigner
+	switch {
+	case strings.HasPrefix(signature, beginPGPSignature):
+		signer, err = verifyGPGSignature(keyPath, payload, signature)
+	case strings.HasPrefix(signature, beginSSHSignature):
+		signer, err = verifySSHSignature(allowedSignersPath, payload, signature)
+	case strings.HasPrefix(signature, beginX509Signature):
+		err = untrustedSignature("x509 signatures, e.g. by gitsign, are not supported")
+	default:
+		err = untrustedSignature("Unknown signature format")
+	}
+	if err != nil {
+		log.Errorf("Error in verifying signature of the %s %s of %s: %s", signedObject, r.CommitID, r.URL, err.Error())
+		return nil, err
+	}
+	signer.Object = signedObject
+	return signer, nil
+}
+
+// signedPayload returns the payload and signature of the tag when it is signed, otherwise of the commit
+func signedPayload(commit *object.Commit, tag *object.Tag) ([]byte, string, string, error) {
+	encoded := &plumbing.MemoryObject{}
+	if tag != nil {
+		unsigned := *tag
+		if unsigned.PGPSignature == "" {
+			// Only PGP signatures are split from the message of tags
+			unsigned.Message, unsigned.PGPSignature = splitTagSignature(tag.Message)
+		}
+		if unsigned.PGPSignature != "" {
+			err := unsigned.EncodeWithoutSignature(encoded)
+			if err != nil {
+				return nil, "", "", err
+			}
+			payload, err := readObject(encoded)
+			return payload, unsigned.PGPSignature, "tag", err
+		}
+	}
+
+	if commit == nil {
+		return nil, "", "commit", fmt.Errorf("No commit checked out")
+	}
+	err := commit.EncodeWithoutSignature(encoded)
+	if err != nil {
+		return nil, "", "", err
+	}
+	payload, err := readObject(encoded)
+	return payload, commit.PGPSignature, "commit", err
+}
+
+// splitTagSignature splits the SSH or x509 signature appended to the message of a tag
+func splitTagSignature(message string) (string, string) {
+	for _, begin := range []string{beginSSHSignature, beginX509Signature} {
+		i := strings.Index(message, begin)
+		if i == 0 || (i > 0 && message[i-1] == '\n') {
+			return message[:i], message[i:]
+		}
+	}
+	return message, ""
+}
+
+func readObject(o plumbing.EncodedObject) ([]byte, error) {
+	reader, err := o.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// verifyGPGSignature verifies an armored GPG signature of the payload with the keyring at keyPath
+func verifyGPGSignature(keyPath string, payload []byte, signature string) (*GitSigner, error) {
+	keyRing, err := LoadKeyRing(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(payload), strings.NewReader(signature))
+	if err != nil {
+		return nil, untrustedSignature("Invalid GPG signature or key not in the keyring: %s", err.Error())
+	}
+	if signer == nil {
+		return nil, untrustedSignature("Signed by a key not in the keyring")
+	}
+
+	gitSigner := &GitSigner{Format: GIT_SIGNATURE_FORMAT_GPG}
+	if idt := GetFirstIdentity(signer); idt != nil {
+		gitSigner.Identity = idt.Name
+	}
+	if signer.PrimaryKey != nil {
+		gitSigner.Key = fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	}
+	return gitSigner, nil
+}
+
+// verifySSHSignature verifies an armored SSH signature of the payload, as made by ssh-keygen -Y sign,
+// and looks up its key in the allowed signers file at allowedSignersPath
+func verifySSHSignature(allowedSignersPath string, payload []byte, signature string) (*GitSigner, error) {
+	block, _ := pem.Decode([]byte(signature))
+	if block == nil || !bytes.HasPrefix(block.Bytes, []byte(sshSignatureMagic)) {
+		return nil, untrustedSignature("Invalid SSH signature")
+	}
+	var sig sshSignature
+	err := ssh.Unmarshal(block.Bytes[len(sshSignatureMagic):], &sig)
+	if err != nil {
+		return nil, untrustedSignature("Invalid SSH signature: %s", err.Error())
+	}
+	if sig.Version != 1 {
+		return nil, untrustedSignature("Unsupported SSH signature version %d", sig.Version)
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return nil, untrustedSignature("SSH signature namespace is %s, not %s", sig.Namespace, sshSignatureNamespace)
+	}
+
+	var hash []byte
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h := sha256.Sum256(payload)
+		hash = h[:]
+	case "sha512":
+		h := sha512.Sum512(payload)
+		hash = h[:]
+	default:
+		return nil, untrustedSignature("Unsupported SSH signature hash algorithm %s", sig.HashAlgorithm)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, untrustedSignature("Invalid SSH signature: %s", err.Error())
+	}
+	var sshSig ssh.Signature
+	err = ssh.Unmarshal(sig.Signature, &sshSig)
+	if err != nil {
+		return nil, untrustedSignature("Invalid SSH signature: %s", err.Error())
+	}
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          hash,
+	})...)
+	err = publicKey.Verify(signedData, &sshSig)
+	if err != nil {
+		return nil, untrustedSignature("Invalid SSH signature: %s", err.Error())
+	}
+
+	principals, err := allowedSigner(allowedSignersPath, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &GitSigner{
+		Identity: principals,
+		Key:      ssh.FingerprintSHA256(publicKey),
+		Format:   GIT_SIGNATURE_FORMAT_SSH,
+	}, nil
+}
+
+// allowedSigner returns the principals of the public key in the allowed signers file,
+// which has the format of ssh-keygen: principals, options and the public key on each line
+func allowedSigner(allowedSignersPath string, publicKey ssh.PublicKey) (string, error) {
+	if allowedSignersPath == "" {
+		return "", fmt.Errorf("No allowed signers file for SSH signatures, please specify GIT_SSH_ALLOWED_SIGNERS")
+	}
+	allowedSigners, err := ioutil.ReadFile(allowedSignersPath)
+	if err != nil {
+		log.Errorf("Error in reading allowed signers file: %s", err.Error())
+		return "", err
+	}
+
+	keyBytes := publicKey.Marshal()
+	scanner := bufio.NewScanner(bytes.NewReader(allowedSigners))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line[i+1:]))
+		if err != nil || !bytes.Equal(key.Marshal(), keyBytes) || !allowedSignerOptions(options) {
+			continue
+		}
+		return line[:i], nil
+	}
+	return "", untrustedSignature("SSH key %s is not an allowed signer", ssh.FingerprintSHA256(publicKey))
+}
+
+// allowedSignerOptions tells whether a key with the options of an allowed signer may sign git objects,
+// certificate authorities are not supported
+func allowedSignerOptions(options []string) bool {
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], strings.Trim(option[i+1:], "\"")
+		}
+		switch strings.ToLower(name) {
+		case "cert-authority":
+			return false
+		case "namespaces":
+			allowed := false
+			for _, namespace := range strings.Split(value, ",") {
+				if namespace == sshSignatureNamespace {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
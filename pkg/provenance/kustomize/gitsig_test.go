@@ -0,0 +1,151 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/openpgp"
+)
+
+// signedCommit returns the checkout of a commit signed with the given key, unsigned without key
+func signedCommit(t *testing.T, key *openpgp.Entity) *GitRepoResult {
+
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("init repository: %s", err.Error())
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("open worktree: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("resources: []\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Add("kustomization.yaml")
+	if err != nil {
+		t.Fatalf("add file: %s", err.Error())
+	}
+	hash, err := worktree.Commit("commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1600000000, 0)},
+	})
+	if err != nil {
+		t.Fatalf("commit: %s", err.Error())
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatalf("read commit: %s", err.Error())
+	}
+
+	// Signed as git commit -S does, only the commit read by VerifySignature is signed
+	if key != nil {
+		payload, _, _, err := signedPayload(commit, nil)
+		if err != nil {
+			t.Fatalf("read commit payload: %s", err.Error())
+		}
+		var signature bytes.Buffer
+		err = openpgp.ArmoredDetachSign(&signature, key, bytes.NewReader(payload), nil)
+		if err != nil {
+			t.Fatalf("sign commit: %s", err.Error())
+		}
+		commit.PGPSignature = signature.String()
+	}
+	return &GitRepoResult{URL: dir, CommitID: hash.String(), commit: commit}
+}
+
+func newGPGKey(t *testing.T, name string) *openpgp.Entity {
+	key, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("generate GPG key: %s", err.Error())
+	}
+	return key
+}
+
+// writeKeyring writes the public keys to a keyring file
+func writeKeyring(t *testing.T, keys ...*openpgp.Entity) string {
+	keyPath := filepath.Join(t.TempDir(), "pubring.gpg")
+	f, err := os.Create(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, key := range keys {
+		err = key.Serialize(f)
+		if err != nil {
+			t.Fatalf("write keyring: %s", err.Error())
+		}
+	}
+	return keyPath
+}
+
+func TestVerifySignature(t *testing.T) {
+
+	trusted := newGPGKey(t, "trusted")
+	other := newGPGKey(t, "other")
+	keyPath := writeKeyring(t, trusted)
+
+	signer, err := signedCommit(t, trusted).VerifySignature(keyPath, "")
+	if err != nil {
+		t.Fatalf("unexpected error for a commit signed by a trusted key: %s", err.Error())
+	}
+	if signer.Format != GIT_SIGNATURE_FORMAT_GPG || signer.Object != "commit" || signer.Identity != GetFirstIdentity(trusted).Name {
+		t.Errorf("unexpected signer %+v", *signer)
+	}
+
+	untrusted := []struct {
+		name string
+		repo *GitRepoResult
+	}{
+		{name: "unsigned commit", repo: signedCommit(t, nil)},
+		{name: "commit signed by another key", repo: signedCommit(t, other)},
+	}
+	for _, test := range untrusted {
+		_, err := test.repo.VerifySignature(keyPath, "")
+		if _, ok := err.(*UntrustedSignatureError); !ok {
+			t.Errorf("%s: expected an untrusted signature error, got %v", test.name, err)
+		}
+	}
+
+	// A keyring that can not be read is not an untrusted signature
+	_, err = signedCommit(t, trusted).VerifySignature(filepath.Join(t.TempDir(), "missing.gpg"), "")
+	if err == nil {
+		t.Fatal("expected an error for a missing keyring")
+	}
+	if _, ok := err.(*UntrustedSignatureError); ok {
+		t.Errorf("expected a configuration error for a missing keyring, got %s", err.Error())
+	}
+}
+
+func TestVerifySignatureX509(t *testing.T) {
+
+	r := signedCommit(t, nil)
+	r.commit.PGPSignature = beginX509Signature + "\nMIAGCSqGSIb3DQEHAqCAMIACAQExDTALBglghkgBZQMEAgEwCwYJKoZIhvcNAQcB\n-----END SIGNED MESSAGE-----\n"
+
+	_, err := r.VerifySignature(writeKeyring(t, newGPGKey(t, "trusted")), "")
+	if _, ok := err.(*UntrustedSignatureError); !ok {
+		t.Errorf("expected x509 signatures to be untrusted, got %v", err)
+	}
+}
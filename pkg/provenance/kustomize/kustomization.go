@@ -0,0 +1,273 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// kustomizeImageTag matches an image with a tag, as "kustomize edit set image" does
+var kustomizeImageTag = regexp.MustCompile(`^(.*):([a-zA-Z0-9._-]*|\*)$`)
+
+// kustomizationFs is the file system of the source with the kustomization of
+// the application replaced by the one edited with the kustomize options
+type kustomizationFs struct {
+	filesys.FileSystem
+	kustomizationPath string
+	kustomization     []byte
+}
+
+func (fs kustomizationFs) ReadFile(path string) ([]byte, error) {
+	if filepath.Clean(path) == fs.kustomizationPath {
+		return fs.kustomization, nil
+	}
+	return fs.FileSystem.ReadFile(path)
+}
+
+// kustomizeBuild builds the kustomization in baseDir after applying the kustomize options of
+// the application to it, like Argo CD runs "kustomize edit" before "kustomize build". The
+// kustomization is edited in memory, the source on disk is left unchanged.
+func kustomizeBuild(baseDir string, options application.KustomizeOptions, env map[string]string) ([]byte, error) {
+
+	fSys := filesys.MakeFsOnDisk()
+
+	if hasKustomizeOptions(options) {
+		dir, _, err := fSys.CleanedAbs(baseDir)
+		if err != nil {
+			return nil, err
+		}
+		kustomizationPath := ""
+		for _, fileName := range konfig.RecognizedKustomizationFileNames() {
+			if fSys.Exists(dir.Join(fileName)) {
+				kustomizationPath = dir.Join(fileName)
+				break
+			}
+		}
+		if kustomizationPath == "" {
+			return nil, fmt.Errorf("no kustomization file in %s", baseDir)
+		}
+
+		kustomization, err := fSys.ReadFile(kustomizationPath)
+		if err != nil {
+			log.Errorf("Error in reading kustomization: %s", err.Error())
+			return nil, err
+		}
+		kustomization, err = editKustomization(kustomization, options, env)
+		if err != nil {
+			log.Errorf("Error in applying kustomize options: %s", err.Error())
+			return nil, err
+		}
+		fSys = kustomizationFs{FileSystem: fSys, kustomizationPath: kustomizationPath, kustomization: kustomization}
+	}
+
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resMap, err := kustomizer.Run(fSys, baseDir)
+	if err != nil {
+		log.Errorf("Error in kustomize build:  %s", err.Error())
+		return nil, err
+	}
+
+	return resMap.AsYaml()
+}
+
+func hasKustomizeOptions(options application.KustomizeOptions) bool {
+	return options.NamePrefix != "" || options.NameSuffix != "" || len(options.Images) > 0 ||
+		len(options.CommonLabels) > 0 || len(options.CommonAnnotations) > 0
+}
+
+// editKustomization applies the kustomize options to the kustomization as the "kustomize edit"
+// commands of Argo CD do: set nameprefix, set namesuffix, set image, add label and add annotation.
+// Values of images, labels and annotations may refer to the build environment of Argo CD.
+func editKustomization(kustomization []byte, options application.KustomizeOptions, env map[string]string) ([]byte, error) {
+
+	k := map[string]interface{}{}
+	err := yaml.Unmarshal(kustomization, &k)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		k = map[string]interface{}{}
+	}
+
+	if options.NamePrefix != "" {
+		k["namePrefix"] = options.NamePrefix
+	}
+	if options.NameSuffix != "" {
+		k["nameSuffix"] = options.NameSuffix
+	}
+
+	if len(options.Images) > 0 {
+		images, err := setKustomizeImages(k["images"], options.Images, env)
+		if err != nil {
+			return nil, err
+		}
+		k["images"] = images
+	}
+
+	if len(options.CommonLabels) > 0 {
+		labels, err := addKustomizePairs(k["commonLabels"], options.CommonLabels, options.ForceCommonLabels, env, "label")
+		if err != nil {
+			return nil, err
+		}
+		k["commonLabels"] = labels
+	}
+
+	if len(options.CommonAnnotations) > 0 {
+		annotations, err := addKustomizePairs(k["commonAnnotations"], options.CommonAnnotations, options.ForceCommonAnnotations, env, "annotation")
+		if err != nil {
+			return nil, err
+		}
+		k["commonAnnotations"] = annotations
+	}
+
+	return yaml.Marshal(k)
+}
+
+// setKustomizeImages sets the image overrides in the images of the kustomization, an override
+// of an image already in the kustomization replaces its new name and its tag or digest
+func setKustomizeImages(current interface{}, overrides []string, env map[string]string) ([]interface{}, error) {
+
+	currentImages, _ := current.([]interface{})
+
+	overrideByName := map[string]map[string]interface{}{}
+	for _, override := range overrides {
+		image, err := parseKustomizeImage(envsubst(override, env))
+		if err != nil {
+			return nil, err
+		}
+		overrideByName[image["name"].(string)] = image
+	}
+
+	images := []interface{}{}
+	for _, item := range currentImages {
+		image, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid image %v in kustomization", item)
+		}
+		name, _ := image["name"].(string)
+		if override, ok := overrideByName[name]; ok {
+			if newName, ok := override["newName"]; ok {
+				image["newName"] = newName
+			}
+			if newTag, ok := override["newTag"]; ok {
+				image["newTag"] = newTag
+				delete(image, "digest")
+			}
+			if digest, ok := override["digest"]; ok {
+				image["digest"] = digest
+				delete(image, "newTag")
+			}
+			delete(overrideByName, name)
+		}
+		images = append(images, image)
+	}
+	for _, override := range overrideByName {
+		images = append(images, override)
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		nameI, _ := images[i].(map[string]interface{})["name"].(string)
+		nameJ, _ := images[j].(map[string]interface{})["name"].(string)
+		return nameI < nameJ
+	})
+	return images, nil
+}
+
+// parseKustomizeImage parses an image override of Argo CD, one of <image>=<new-image>,
+// <image>=<new-image>:<new-tag>, <image>=<new-image>@<digest>, <image>:<new-tag> or <image>@<digest>
+func parseKustomizeImage(override string) (map[string]interface{}, error) {
+
+	image := map[string]interface{}{}
+	newImage := override
+	replacesName := false
+	if s := strings.Split(override, "="); len(s) == 2 {
+		image["name"] = s[0]
+		newImage = s[1]
+		replacesName = true
+	}
+
+	name := ""
+	if d := strings.Split(newImage, "@"); len(d) > 1 {
+		name = d[0]
+		image["digest"] = d[1]
+	} else if t := kustomizeImageTag.FindStringSubmatch(newImage); len(t) == 3 {
+		name = t[1]
+		image["newTag"] = t[2]
+	} else if newImage != "" && replacesName {
+		name = newImage
+	} else {
+		return nil, fmt.Errorf("invalid image override %s", override)
+	}
+
+	if replacesName {
+		image["newName"] = name
+	} else {
+		image["name"] = name
+	}
+	return image, nil
+}
+
+// addKustomizePairs adds the labels or annotations to those of the kustomization, those
+// already in the kustomization are only replaced when forced
+func addKustomizePairs(current interface{}, pairs map[string]string, force bool, env map[string]string, kind string) (map[string]interface{}, error) {
+
+	result, _ := current.(map[string]interface{})
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	for key, value := range pairs {
+		if _, ok := result[key]; ok && !force {
+			return nil, fmt.Errorf("%s %s already in kustomization file", kind, key)
+		}
+		result[key] = envsubst(value, env)
+	}
+	return result, nil
+}
+
+// envsubst replaces the variables of the build environment in s, $$ escapes a $
+func envsubst(s string, env map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return env[name]
+	})
+}
+
+// argocdBuildEnv is the environment Argo CD builds the kustomization of the application in
+func argocdBuildEnv(appData application.ApplicationData) map[string]string {
+	return map[string]string{
+		"ARGOCD_APP_NAME":                   appData.AppName,
+		"ARGOCD_APP_NAMESPACE":              appData.AppDestinationNamespace,
+		"ARGOCD_APP_REVISION":               appData.AppSourceCommitSha,
+		"ARGOCD_APP_SOURCE_REPO_URL":        appData.AppSourceRepoUrl,
+		"ARGOCD_APP_SOURCE_PATH":            appData.AppPath,
+		"ARGOCD_APP_SOURCE_TARGET_REVISION": appData.AppSourceRevision,
+	}
+}
@@ -0,0 +1,229 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/ghodss/yaml"
+)
+
+const testKustomization = `resources:
+- deployment.yaml
+images:
+- name: nginx
+  newTag: "1.20"
+commonLabels:
+  app: guestbook
+`
+
+const testDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: nginx:1.19
+      - name: sidecar
+        image: busybox:1.33
+`
+
+var testBuildEnv = map[string]string{
+	"ARGOCD_APP_NAME":     "guestbook",
+	"ARGOCD_APP_REVISION": "9c3b4e5",
+}
+
+func TestEditKustomization(t *testing.T) {
+	tests := []struct {
+		name    string
+		options application.KustomizeOptions
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "name prefix and suffix",
+			options: application.KustomizeOptions{NamePrefix: "dev-", NameSuffix: "-v1"},
+			want: testKustomization + `namePrefix: dev-
+nameSuffix: -v1
+`,
+		},
+		{
+			name:    "image tag overrides the tag of the kustomization",
+			options: application.KustomizeOptions{Images: []string{"nginx:1.21"}},
+			want: `resources:
+- deployment.yaml
+images:
+- name: nginx
+  newTag: "1.21"
+commonLabels:
+  app: guestbook
+`,
+		},
+		{
+			name:    "image digest replaces the tag of the kustomization",
+			options: application.KustomizeOptions{Images: []string{"nginx@sha256:4e2b7b"}},
+			want: `resources:
+- deployment.yaml
+images:
+- name: nginx
+  digest: sha256:4e2b7b
+commonLabels:
+  app: guestbook
+`,
+		},
+		{
+			name:    "new image name and tag from the build environment",
+			options: application.KustomizeOptions{Images: []string{"busybox=quay.io/busybox:${ARGOCD_APP_REVISION}"}},
+			want: `resources:
+- deployment.yaml
+images:
+- name: busybox
+  newName: quay.io/busybox
+  newTag: 9c3b4e5
+- name: nginx
+  newTag: "1.20"
+commonLabels:
+  app: guestbook
+`,
+		},
+		{
+			name:    "invalid image",
+			options: application.KustomizeOptions{Images: []string{"nginx"}},
+			wantErr: true,
+		},
+		{
+			name: "common labels and annotations",
+			options: application.KustomizeOptions{
+				CommonLabels:      map[string]string{"team": "$ARGOCD_APP_NAME"},
+				CommonAnnotations: map[string]string{"cost": "$$5"},
+			},
+			want: `resources:
+- deployment.yaml
+images:
+- name: nginx
+  newTag: "1.20"
+commonLabels:
+  app: guestbook
+  team: guestbook
+commonAnnotations:
+  cost: $5
+`,
+		},
+		{
+			name:    "label already in the kustomization",
+			options: application.KustomizeOptions{CommonLabels: map[string]string{"app": "other"}},
+			wantErr: true,
+		},
+		{
+			name:    "label already in the kustomization is forced",
+			options: application.KustomizeOptions{CommonLabels: map[string]string{"app": "other"}, ForceCommonLabels: true},
+			want: `resources:
+- deployment.yaml
+images:
+- name: nginx
+  newTag: "1.20"
+commonLabels:
+  app: other
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editKustomization([]byte(testKustomization), tt.options, testBuildEnv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("editKustomization() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var gotObj, wantObj map[string]interface{}
+			if err := yaml.Unmarshal(got, &gotObj); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &wantObj); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotObj, wantObj) {
+				t.Errorf("editKustomization() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKustomizeBuild(t *testing.T) {
+	baseDir := t.TempDir()
+	kustomizationPath := filepath.Join(baseDir, "kustomization.yaml")
+	if err := ioutil.WriteFile(kustomizationPath, []byte(testKustomization), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "deployment.yaml"), []byte(testDeployment), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		options  application.KustomizeOptions
+		contains []string
+	}{
+		{
+			name:     "without options",
+			contains: []string{"name: guestbook-ui\n", "image: nginx:1.20", "image: busybox:1.33", "app: guestbook"},
+		},
+		{
+			name: "with options",
+			options: application.KustomizeOptions{
+				NamePrefix:   "dev-",
+				NameSuffix:   "-v1",
+				Images:       []string{"busybox=quay.io/busybox:1.34"},
+				CommonLabels: map[string]string{"team": "$ARGOCD_APP_NAME"},
+			},
+			contains: []string{"name: dev-guestbook-ui-v1", "image: nginx:1.20", "image: quay.io/busybox:1.34", "team: guestbook"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := kustomizeBuild(baseDir, tt.options, testBuildEnv)
+			if err != nil {
+				t.Fatalf("kustomizeBuild() error = %v", err)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(string(manifest), s) {
+					t.Errorf("kustomizeBuild() = %s, does not contain %s", manifest, s)
+				}
+			}
+		})
+	}
+
+	// The kustomization of the source is left unchanged
+	kustomization, err := ioutil.ReadFile(kustomizationPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kustomization) != testKustomization {
+		t.Errorf("kustomization on disk = %s, want %s", kustomization, testKustomization)
+	}
+}
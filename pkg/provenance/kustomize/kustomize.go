@@ -23,12 +23,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
 	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/images"
 	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/IBM/argocd-interlace/pkg/provenance/slsa"
 	"github.com/IBM/argocd-interlace/pkg/utils"
 	"github.com/in-toto/in-toto-golang/in_toto"
 	kustbuildutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util/manifestbuild/kustomize"
@@ -38,12 +41,19 @@ import (
 	"golang.org/x/crypto/openpgp/packet"
 )
 
+// Provenance is the provenance of a kustomize application. The source of the
+// application is checked out, and the credentials of its repository resolved,
+// once for all the steps of a sync; Cleanup removes the checkout.
 type Provenance struct {
 	appData application.ApplicationData
+	creds   *RepoCredentials
+	repo    *GitRepoResult
 }
 
 const (
 	ProvenanceAnnotation = "kustomize"
+
+	kustomizeAPIModule = "sigs.k8s.io/kustomize/api"
 )
 
 func NewProvenance(appData application.ApplicationData) (*Provenance, error) {
@@ -52,7 +62,50 @@ func NewProvenance(appData application.ApplicationData) (*Provenance, error) {
 	}, nil
 }
 
-func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time) error {
+// NewProvenanceWithCredentials returns the provenance of an application whose
+// repository credentials are already resolved
+func NewProvenanceWithCredentials(appData application.ApplicationData, creds *RepoCredentials) (*Provenance, error) {
+	return &Provenance{
+		appData: appData,
+		creds:   creds,
+	}, nil
+}
+
+// gitRepo returns the checkout of the source of the application, the repository
+// is only fetched the first time
+func (p *Provenance) gitRepo() (*GitRepoResult, error) {
+	if p.repo != nil {
+		return p.repo, nil
+	}
+
+	host, orgRepo, path, gitRef, gitSuff := ParseGitUrl(p.appData.AppSourceRepoUrl)
+	log.Info("host:", host, " orgRepo:", orgRepo, " path:", path, " gitRef:", gitRef, " gitSuff:", gitSuff)
+
+	url := host + orgRepo + gitSuff
+	log.Info("url:", url)
+
+	if p.creds == nil {
+		p.creds = GetRepoCredentials(url)
+	}
+
+	r, err := GetTopGitRepo(url, p.appData.AppSourceRevision, p.appData.AppSourceCommitSha, p.appData.AppPath, p.creds)
+	if err != nil {
+		log.Errorf("Error git clone:  %s", err.Error())
+		return nil, err
+	}
+	p.repo = r
+	return r, nil
+}
+
+// Cleanup removes the checkout of the source of the application
+func (p *Provenance) Cleanup() {
+	if p.repo != nil {
+		os.RemoveAll(p.repo.RootDir)
+		p.repo = nil
+	}
+}
+
+func (p *Provenance) GenerateProvanance(target, targetDigest string, uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
 	appName := p.appData.AppName
 	appPath := p.appData.AppPath
 	appSourceRepoUrl := p.appData.AppSourceRepoUrl
@@ -64,19 +117,31 @@ func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog b
 	manifestFile := filepath.Join(appDirPath, utils.MANIFEST_FILE_NAME)
 	recipeCmds := []string{"", ""}
 
-	host, orgRepo, path, gitRef, gitSuff := ParseGitUrl(appSourceRepoUrl)
-	log.Info("host:", host, " orgRepo:", orgRepo, " path:", path, " gitRef:", gitRef, " gitSuff:", gitSuff)
-
-	url := host + orgRepo + gitSuff
-	log.Info("url:", url)
+	r, err := p.gitRepo()
+	if err != nil {
+		return err
+	}
 
-	r, err := GetTopGitRepo(url)
+	// Record the commit the provenance is generated from, the latest one of the revision
+	// when the synced commit is not known
+	appSourceCommitSha = r.CommitID
 
+	interlaceConfig, err := config.GetInterlaceConfig()
 	if err != nil {
-		log.Errorf("Error git clone:  %s", err.Error())
+		log.Errorf("Error in loading config: %s", err.Error())
 		return err
 	}
 
+	// Record the signer of the commit or tag when source materials are verified with it
+	var signer *GitSigner
+	verification := interlaceConfig.SourceMaterialVerification
+	if verification == "git-signature" || verification == "all" {
+		signer, err = r.VerifySignature(utils.KEYRING_PUB_KEY_PATH, interlaceConfig.GitSSHAllowedSigners)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Info("r.RootDir ", r.RootDir, "appPath ", appPath)
 
 	baseDir := filepath.Join(r.RootDir, appPath)
@@ -89,40 +154,71 @@ func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog b
 
 	provBytes, err := json.Marshal(prov)
 
-	subjects := []in_toto.Subject{}
+	materials := generateMaterial(appName, appPath, appSourceRepoUrl, appSourceRevision,
+		appSourceCommitSha, signer, string(provBytes))
 
-	targetDigest = strings.ReplaceAll(targetDigest, "sha256:", "")
-	subjects = append(subjects, in_toto.Subject{Name: target,
-		Digest: in_toto.DigestSet{
-			"sha256": targetDigest,
-		},
-	})
+	subjects, err := slsa.NewSubjects(target, targetDigest, interlaceConfig.ProvenanceResourceSubjects)
+	if err != nil {
+		log.Errorf("Error in generating provenance subjects:  %s", err.Error())
+		return err
+	}
 
-	materials := generateMaterial(appName, appPath, appSourceRepoUrl, appSourceRevision,
-		appSourceCommitSha, string(provBytes))
+	if interlaceConfig.ProvenanceImageMaterials {
+		imageMaterials, err := slsa.ImageMaterials(target)
+		if err != nil {
+			log.Errorf("Error in generating image materials:  %s", err.Error())
+			return err
+		}
+		materials = append(materials, imageMaterials...)
+	}
 
-	entryPoint := "kustomize build"
-	recipe := in_toto.ProvenanceRecipe{
-		EntryPoint: entryPoint,
-		Arguments:  []string{appPath},
+	imageDigests, err := images.ReadImageDigests(p.appData.AppDirPath)
+	if err != nil {
+		log.Errorf("Error in reading image digests:  %s", err.Error())
+		return err
 	}
 
-	it := in_toto.Statement{
-		StatementHeader: in_toto.StatementHeader{
-			Type:          in_toto.StatementInTotoV01,
-			PredicateType: in_toto.PredicateSLSAProvenanceV01,
-			Subject:       subjects,
-		},
-		Predicate: in_toto.ProvenancePredicate{
-			Metadata: &in_toto.ProvenanceMetadata{
-				Reproducible:    true,
-				BuildStartedOn:  &buildStartedOn,
-				BuildFinishedOn: &buildFinishedOn,
-			},
+	// The manifest is rebuilt in-process with the kustomize API, not with the
+	// kustomize binary of Argo CD
+	rebuildVersion := ""
+	if reproducible {
+		rebuildVersion = kustomizeAPIVersion()
+	}
+
+	builder, err := slsa.NewBuilderInfo(slsa.VersionKustomize, rebuildVersion)
+	if err != nil {
+		log.Errorf("Error in identifying builder:  %s", err.Error())
+		return err
+	}
 
-			Materials: materials,
-			Recipe:    recipe,
+	build := slsa.Build{
+		BuildType:  slsa.BuildTypeKustomize,
+		EntryPoint: "kustomize build",
+		Arguments:  []string{appPath},
+		ConfigSource: slsa.ConfigSource{
+			URI: appSourceRepoUrl + ".git",
+			Digest: in_toto.DigestSet{
+				"sha1": appSourceCommitSha,
+			},
+			EntryPoint: appPath,
 		},
+		Parameters: map[string]interface{}{
+			"repoURL":        appSourceRepoUrl,
+			"path":           appPath,
+			"targetRevision": appSourceRevision,
+		},
+		Materials:       materials,
+		ImageDigests:    imageDigests,
+		BuildStartedOn:  buildStartedOn,
+		BuildFinishedOn: buildFinishedOn,
+		Reproducible:    reproducible,
+		Builder:         builder,
+	}
+
+	it, err := slsa.NewStatement(interlaceConfig.ProvenancePredicateVersion, subjects, build)
+	if err != nil {
+		log.Errorf("Error in generating provenance statement:  %s", err.Error())
+		return err
 	}
 	b, err := json.Marshal(it)
 	if err != nil {
@@ -136,58 +232,131 @@ func (p Provenance) GenerateProvanance(target, targetDigest string, uploadTLog b
 		return err
 	}
 
-	err = attestation.GenerateSignedAttestation(it, appName, appDirPath, uploadTLog)
+	rekorEntry, err := attestation.GenerateSignedAttestation(it, appName, appDirPath, uploadTLog)
 	if err != nil {
 		log.Errorf("Error in generating signed attestation:  %s", err.Error())
 		return err
 	}
 
+	if rekorEntry != nil {
+		log.Infof("[INFO][%s] Attestation uploaded to transparency log with UUID %s", appName, rekorEntry.UUID)
+	}
+
 	return nil
 }
 
-func (p Provenance) VerifySourceMaterial() (bool, error) {
+// RebuildManifest builds the manifest of the application again with kustomize
+// from the source repository, with the kustomize options of the application
+func (p *Provenance) RebuildManifest() ([]byte, error) {
 	appPath := p.appData.AppPath
-	appSourceRepoUrl := p.appData.AppSourceRepoUrl
 
-	interlaceConfig, err := config.GetInterlaceConfig()
+	r, err := p.gitRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	baseDir := filepath.Join(r.RootDir, appPath)
 
-	host, orgRepo, path, gitRef, gitSuff := ParseGitUrl(appSourceRepoUrl)
+	return kustomizeBuild(baseDir, p.appData.Kustomize, argocdBuildEnv(p.appData))
+}
 
-	log.Info("appSourceRepoUrl ", appSourceRepoUrl)
+// kustomizeAPIVersion returns the version of the kustomize API module that
+// RebuildManifest builds with
+func kustomizeAPIVersion() string {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == kustomizeAPIModule {
+				version = dep.Version
+				if dep.Replace != nil && dep.Replace.Version != "" {
+					version = dep.Replace.Version
+				}
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%s %s", kustomizeAPIModule, version)
+}
 
-	log.Info("host:", host, " orgRepo:", orgRepo, " path:", path, " gitRef:", gitRef, " gitSuff:", gitSuff)
+// VerifySourceMaterial verifies the signature of the source materials with the configured
+// method. The returned verification records the signer, or the reason why the source
+// materials are not verified; the error is an error in reading them or the trusted keys.
+func (p *Provenance) VerifySourceMaterial() (application.SourceVerification, error) {
+	appPath := p.appData.AppPath
 
-	url := host + orgRepo + gitSuff
+	interlaceConfig, err := config.GetInterlaceConfig()
 
-	log.Info("url:", url)
+	log.Info("appSourceRepoUrl ", p.appData.AppSourceRepoUrl)
 
-	r, err := GetTopGitRepo(url)
+	verification := interlaceConfig.SourceMaterialVerification
+	result := application.SourceVerification{Method: verification}
+
+	r, err := p.gitRepo()
 	if err != nil {
-		log.Errorf("Error git clone:  %s", err.Error())
-		return false, err
+		result.Error = err.Error()
+		return result, err
 	}
 
 	baseDir := filepath.Join(r.RootDir, appPath)
 
 	keyPath := utils.KEYRING_PUB_KEY_PATH
 
+	if verification == "git-signature" || verification == "all" {
+		signer, err := r.VerifySignature(keyPath, interlaceConfig.GitSSHAllowedSigners)
+		if err != nil {
+			result.Error = err.Error()
+			// Source materials that are not signed by a trusted key are not verified,
+			// the keys that could not be read are an error
+			if _, ok := err.(*UntrustedSignatureError); ok {
+				return result, nil
+			}
+			return result, err
+		}
+		log.Infof("The %s %s is signed by %s with %s key %s", signer.Object, r.CommitID, signer.Identity, signer.Format, signer.Key)
+		result.Signer = fmt.Sprintf("%s (%s key %s)", signer.Identity, signer.Format, signer.Key)
+		if verification == "git-signature" {
+			result.Verified = true
+			return result, nil
+		}
+	}
+
 	srcMatPath := filepath.Join(baseDir, interlaceConfig.SourceMaterialHashList)
 	srcMatSigPath := filepath.Join(baseDir, interlaceConfig.SourceMaterialSignature)
 
 	verification_target, err := os.Open(srcMatPath)
 	signature, err := os.Open(srcMatSigPath)
-	flag, _, _, _, _ := verifySignature(keyPath, verification_target, signature)
+	flag, reason, signer, fingerprint, _ := verifySignature(keyPath, verification_target, signature)
+	if !flag {
+		result.Error = reason
+		return result, nil
+	}
 
-	hashCompareSuccess := false
-	if flag {
-		hashCompareSuccess, err = compareHash(srcMatPath, baseDir)
-		if err != nil {
-			return hashCompareSuccess, err
-		}
-		return hashCompareSuccess, nil
+	hashListSigner := fmt.Sprintf("%s (gpg key %s)", signer.Name, fingerprint)
+	if signer.Email != "" {
+		hashListSigner = fmt.Sprintf("%s <%s> (gpg key %s)", signer.Name, signer.Email, fingerprint)
 	}
+	if result.Signer != "" {
+		result.Signer += ", "
+	}
+	result.Signer += hashListSigner
 
-	return flag, nil
+	// files listed in the source material may be outside of the checked out path
+	err = r.CheckoutPaths(sourceMaterialPaths(srcMatPath, appPath)...)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	hashCompareSuccess, err := compareHash(srcMatPath, baseDir)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	if !hashCompareSuccess {
+		result.Error = fmt.Sprintf("The source materials do not match the hashes of %s", interlaceConfig.SourceMaterialHashList)
+		return result, nil
+	}
+	result.Verified = true
+	return result, nil
 }
 
 func verifySignature(keyPath string, msg, sig *os.File) (bool, string, *Signer, []byte, error) {
@@ -299,18 +468,43 @@ func compareHash(sourceMaterialPath string, baseDir string) (bool, error) {
 	return true, nil
 }
 
-func generateMaterial(appName, appPath, appSourceRepoUrl, appSourceRevision, appSourceCommitSha string, provTrace string) []in_toto.ProvenanceMaterial {
+// sourceMaterialPaths returns the paths in the repository of the files listed in the source material
+func sourceMaterialPaths(sourceMaterialPath string, appPath string) []string {
+	sourceMaterial, err := ioutil.ReadFile(sourceMaterialPath)
+	if err != nil {
+		return nil
+	}
+
+	paths := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(sourceMaterial)))
+	for scanner.Scan() {
+		data := strings.Split(scanner.Text(), " ")
+		if len(data) > 2 {
+			paths = append(paths, filepath.ToSlash(filepath.Join(appPath, data[2])))
+		}
+	}
+	return paths
+}
+
+func generateMaterial(appName, appPath, appSourceRepoUrl, appSourceRevision, appSourceCommitSha string, signer *GitSigner, provTrace string) []in_toto.ProvenanceMaterial {
 
 	materials := []in_toto.ProvenanceMaterial{}
 
-	materials = append(materials, in_toto.ProvenanceMaterial{
+	sourceMaterial := in_toto.ProvenanceMaterial{
 		URI: appSourceRepoUrl + ".git",
 		Digest: in_toto.DigestSet{
 			"commit":   string(appSourceCommitSha),
 			"revision": appSourceRevision,
 			"path":     appPath,
 		},
-	})
+	}
+	if signer != nil {
+		sourceMaterial.Digest["signer"] = signer.Identity
+		sourceMaterial.Digest["signerKey"] = signer.Key
+		sourceMaterial.Digest["signatureFormat"] = signer.Format
+		sourceMaterial.Digest["signedObject"] = signer.Object
+	}
+	materials = append(materials, sourceMaterial)
 
 	appSourceRepoUrlFul := appSourceRepoUrl + ".git"
 	materialsStr := gjson.Get(provTrace, "predicate.materials")
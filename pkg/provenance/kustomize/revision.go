@@ -0,0 +1,243 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	RevisionProviderGit    = "git"
+	RevisionProviderGithub = "github"
+	RevisionProviderGitlab = "gitlab"
+	RevisionProviderGitea  = "gitea"
+
+	gitHostAPITimeout = 30 * time.Second
+)
+
+// RevisionProvider resolves the commit a branch, tag or HEAD of a git repository points to
+type RevisionProvider interface {
+	LatestCommitSha(repoUrl, revision string, creds *RepoCredentials) (string, error)
+}
+
+// NewRevisionProvider returns the revision provider with the given name: git, which works with any git
+// server like git ls-remote, or github, gitlab and gitea, which query the API of the git host
+func NewRevisionProvider(name string) (RevisionProvider, error) {
+	switch name {
+	case RevisionProviderGit:
+		return &gitRevisionProvider{}, nil
+	case RevisionProviderGithub:
+		return &githubRevisionProvider{httpClient: utils.NewHTTPClient(gitHostAPITimeout)}, nil
+	case RevisionProviderGitlab:
+		return &gitlabRevisionProvider{httpClient: utils.NewHTTPClient(gitHostAPITimeout)}, nil
+	case RevisionProviderGitea:
+		return &giteaRevisionProvider{httpClient: utils.NewHTTPClient(gitHostAPITimeout)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported revision provider %s", name)
+}
+
+// GitLatestCommitSha returns the latest commit of the revision of the git repository,
+// with the revision provider and the credentials of the repository
+func GitLatestCommitSha(repoUrl string, revision string, creds *RepoCredentials) (string, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return "", err
+	}
+
+	provider, err := NewRevisionProvider(interlaceConfig.GitRevisionProvider)
+	if err != nil {
+		log.Errorf("Error in creating revision provider: %s", err.Error())
+		return "", err
+	}
+
+	sha, err := provider.LatestCommitSha(repoUrl, revision, creds)
+	if err != nil {
+		log.Errorf("Error in resolving revision %s of %s: %s", revision, repoUrl, err.Error())
+		return "", err
+	}
+
+	log.Info("Latest revision ", sha)
+	return sha, nil
+}
+
+type gitRevisionProvider struct{}
+
+func (p *gitRevisionProvider) LatestCommitSha(repoUrl, revision string, creds *RepoCredentials) (string, error) {
+
+	refs, err := lsRemote(repoUrl, creds)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := findRevision(refs, revision)
+	if err != nil {
+		return "", err
+	}
+	return ref.Hash().String(), nil
+}
+
+type githubRevisionProvider struct {
+	httpClient *http.Client
+}
+
+func (p *githubRevisionProvider) LatestCommitSha(repoUrl, revision string, creds *RepoCredentials) (string, error) {
+
+	baseUrl, repoPath, err := parseRepoUrl(repoUrl)
+	if err != nil {
+		return "", err
+	}
+
+	apiUrl := GITHUB_API_URL
+	if baseUrl != "https://github.com" {
+		// GitHub Enterprise Server
+		apiUrl = fmt.Sprintf("%s/api/v3", baseUrl)
+	}
+
+	header := http.Header{}
+	if creds.Password != "" {
+		header.Set("Authorization", "token "+creds.Password)
+	}
+
+	commitUrl := fmt.Sprintf("%s/repos/%s/commits/%s", apiUrl, repoPath, url.PathEscape(apiRevision(revision)))
+	return queryCommitSha(p.httpClient, commitUrl, header, "sha")
+}
+
+type gitlabRevisionProvider struct {
+	httpClient *http.Client
+}
+
+func (p *gitlabRevisionProvider) LatestCommitSha(repoUrl, revision string, creds *RepoCredentials) (string, error) {
+
+	baseUrl, repoPath, err := parseRepoUrl(repoUrl)
+	if err != nil {
+		return "", err
+	}
+
+	// Personal, project and group access tokens are sent as private tokens
+	header := http.Header{}
+	if creds.Password != "" {
+		header.Set("PRIVATE-TOKEN", creds.Password)
+	}
+
+	// Projects are identified by their URL encoded path, which may include subgroups
+	commitUrl := fmt.Sprintf("%s/api/v4/projects/%s/repository/commits/%s",
+		baseUrl, url.PathEscape(repoPath), url.PathEscape(apiRevision(revision)))
+	return queryCommitSha(p.httpClient, commitUrl, header, "id")
+}
+
+type giteaRevisionProvider struct {
+	httpClient *http.Client
+}
+
+func (p *giteaRevisionProvider) LatestCommitSha(repoUrl, revision string, creds *RepoCredentials) (string, error) {
+
+	baseUrl, repoPath, err := parseRepoUrl(repoUrl)
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	if creds.Password != "" {
+		header.Set("Authorization", "token "+creds.Password)
+	}
+
+	// The commits of the default branch are listed without sha
+	commitsUrl := fmt.Sprintf("%s/api/v1/repos/%s/commits?limit=1", baseUrl, repoPath)
+	if revision != "" && revision != "HEAD" {
+		commitsUrl = fmt.Sprintf("%s&sha=%s", commitsUrl, url.QueryEscape(revision))
+	}
+	return queryCommitSha(p.httpClient, commitsUrl, header, "0.sha")
+}
+
+func apiRevision(revision string) string {
+	if revision == "" {
+		return "HEAD"
+	}
+	return revision
+}
+
+// queryCommitSha returns the commit SHA at the path of the JSON response of the git host API.
+// The client must verify TLS certificates, the header carries the token of the repository.
+func queryCommitSha(httpClient *http.Client, apiUrl string, header http.Header, shaPath string) (string, error) {
+
+	req, err := http.NewRequest(http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	response := string(body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Query of %s failed with status %d: %s", apiUrl, resp.StatusCode, gjson.Get(response, "message").String())
+	}
+
+	sha := gjson.Get(response, shaPath).String()
+	if sha == "" {
+		return "", fmt.Errorf("No commit in response of %s: %s", apiUrl, gjson.Get(response, "message").String())
+	}
+	return sha, nil
+}
+
+// parseRepoUrl returns the base URL of the git host and the path without .git suffix of a repository URL,
+// e.g. https://github.com and org/repo for https://github.com/org/repo.git or git@github.com:org/repo.git
+func parseRepoUrl(repoUrl string) (string, string, error) {
+
+	endpoint, err := transport.NewEndpoint(repoUrl)
+	if err != nil {
+		return "", "", err
+	}
+
+	repoPath := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), gitSuffix)
+	if endpoint.Host == "" || !strings.Contains(repoPath, "/") {
+		return "", "", fmt.Errorf("Repository URL %s has no owner and name", repoUrl)
+	}
+
+	// The API of hosts cloned over SSH is expected on the default HTTPS port
+	baseUrl := fmt.Sprintf("https://%s", endpoint.Host)
+	if endpoint.Protocol == "http" || endpoint.Protocol == "https" {
+		baseUrl = fmt.Sprintf("%s://%s", endpoint.Protocol, endpoint.Host)
+		if endpoint.Port != 0 {
+			baseUrl = fmt.Sprintf("%s:%d", baseUrl, endpoint.Port)
+		}
+	}
+	return baseUrl, repoPath, nil
+}
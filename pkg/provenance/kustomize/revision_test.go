@@ -0,0 +1,191 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+)
+
+const (
+	testCommitSha = "2bbf7fd5fa48e3db1a2d0c8a4a68d6b8f1f3d5a1"
+	testAPIToken  = "secret-token"
+)
+
+// fakeGitHost answers the commit query of a git host API when the request has the
+// expected URI and authentication header
+func fakeGitHost(t *testing.T, requestURI, authHeader, authValue, response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI != requestURI {
+			t.Errorf("request URI = %s, want %s", r.RequestURI, requestURI)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get(authHeader) != authValue {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"Bad credentials"}`)
+			return
+		}
+		fmt.Fprint(w, response)
+	}))
+}
+
+func TestRevisionProviders(t *testing.T) {
+	tests := []struct {
+		name       string
+		provider   string
+		requestURI string
+		authHeader string
+		authValue  string
+		response   string
+	}{
+		{
+			name:       "github",
+			provider:   RevisionProviderGithub,
+			requestURI: "/api/v3/repos/org/repo/commits/main",
+			authHeader: "Authorization",
+			authValue:  "token " + testAPIToken,
+			response:   `{"sha":"` + testCommitSha + `"}`,
+		},
+		{
+			name:       "gitlab",
+			provider:   RevisionProviderGitlab,
+			requestURI: "/api/v4/projects/org%2Frepo/repository/commits/main",
+			authHeader: "PRIVATE-TOKEN",
+			authValue:  testAPIToken,
+			response:   `{"id":"` + testCommitSha + `"}`,
+		},
+		{
+			name:       "gitea",
+			provider:   RevisionProviderGitea,
+			requestURI: "/api/v1/repos/org/repo/commits?limit=1&sha=main",
+			authHeader: "Authorization",
+			authValue:  "token " + testAPIToken,
+			response:   `[{"sha":"` + testCommitSha + `"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeGitHost(t, tt.requestURI, tt.authHeader, tt.authValue, tt.response)
+			defer server.Close()
+
+			provider, err := NewRevisionProvider(tt.provider)
+			if err != nil {
+				t.Fatalf("NewRevisionProvider() error = %v", err)
+			}
+			repoUrl := server.URL + "/org/repo.git"
+
+			sha, err := provider.LatestCommitSha(repoUrl, "main", &RepoCredentials{Password: testAPIToken})
+			if err != nil {
+				t.Fatalf("LatestCommitSha() error = %v", err)
+			}
+			if sha != testCommitSha {
+				t.Errorf("LatestCommitSha() = %s, want %s", sha, testCommitSha)
+			}
+
+			if _, err := provider.LatestCommitSha(repoUrl, "main", &RepoCredentials{Password: "wrong-token"}); err == nil {
+				t.Error("LatestCommitSha() with a rejected token succeeded")
+			}
+			if _, err := provider.LatestCommitSha(repoUrl, "main", &RepoCredentials{}); err == nil {
+				t.Error("LatestCommitSha() without credentials of a private repository succeeded")
+			}
+		})
+	}
+}
+
+func TestRevisionProvidersVerifyTLS(t *testing.T) {
+	tokenSent := false
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenSent = tokenSent || r.Header.Get("Authorization") != "" || r.Header.Get("PRIVATE-TOKEN") != ""
+		fmt.Fprint(w, `{"sha":"`+testCommitSha+`"}`)
+	}))
+	defer server.Close()
+
+	// Querying the Argo CD API disables verification on the default transport
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	defaultTLSConfig := defaultTransport.TLSClientConfig
+	_, _ = utils.QueryAPI(server.URL, http.MethodGet, "", nil)
+	defer func() { defaultTransport.TLSClientConfig = defaultTLSConfig }()
+
+	for _, name := range []string{RevisionProviderGithub, RevisionProviderGitlab, RevisionProviderGitea} {
+		provider, err := NewRevisionProvider(name)
+		if err != nil {
+			t.Fatalf("NewRevisionProvider(%s) error = %v", name, err)
+		}
+		if _, err := provider.LatestCommitSha(server.URL+"/org/repo.git", "main", &RepoCredentials{Password: testAPIToken}); err == nil {
+			t.Errorf("%s LatestCommitSha() succeeded against a server with an untrusted certificate", name)
+		}
+	}
+	if tokenSent {
+		t.Error("the token was sent to a server with an untrusted certificate")
+	}
+}
+
+func TestGitRevisionProvider(t *testing.T) {
+	repoUrl, hashes := newBareRepo(t, "first", "second")
+
+	provider, err := NewRevisionProvider(RevisionProviderGit)
+	if err != nil {
+		t.Fatalf("NewRevisionProvider() error = %v", err)
+	}
+	for _, revision := range []string{"", "HEAD", "master", "refs/heads/master"} {
+		sha, err := provider.LatestCommitSha(repoUrl, revision, &RepoCredentials{})
+		if err != nil {
+			t.Fatalf("LatestCommitSha(%q) error = %v", revision, err)
+		}
+		if sha != hashes[1] {
+			t.Errorf("LatestCommitSha(%q) = %s, want %s", revision, sha, hashes[1])
+		}
+	}
+	if _, err := provider.LatestCommitSha(repoUrl, "unknown", &RepoCredentials{}); err == nil {
+		t.Error("LatestCommitSha() of an unknown revision succeeded")
+	}
+}
+
+func TestParseRepoUrl(t *testing.T) {
+	tests := []struct {
+		repoUrl      string
+		wantBaseUrl  string
+		wantRepoPath string
+		wantErr      bool
+	}{
+		{"https://github.com/org/repo.git", "https://github.com", "org/repo", false},
+		{"https://github.com/org/repo", "https://github.com", "org/repo", false},
+		{"https://github.com/org/repo/", "https://github.com", "org/repo", false},
+		{"git@github.com:org/repo.git", "https://github.com", "org/repo", false},
+		{"ssh://git@gitlab.example.com:2222/group/subgroup/repo.git", "https://gitlab.example.com", "group/subgroup/repo", false},
+		{"http://gitea.example.com:3000/org/repo.git", "http://gitea.example.com:3000", "org/repo", false},
+		{"https://github.com/repo.git", "", "", true},
+		{"file:///tmp/org/repo.git", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repoUrl, func(t *testing.T) {
+			baseUrl, repoPath, err := parseRepoUrl(tt.repoUrl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRepoUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if baseUrl != tt.wantBaseUrl || repoPath != tt.wantRepoPath {
+				t.Errorf("parseRepoUrl() = %s, %s, want %s, %s", baseUrl, repoPath, tt.wantBaseUrl, tt.wantRepoPath)
+			}
+		})
+	}
+}
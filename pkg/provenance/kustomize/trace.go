@@ -16,164 +16,31 @@
 package kustomize
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 
-	"github.com/IBM/argocd-interlace/pkg/config"
-	"github.com/IBM/argocd-interlace/pkg/utils"
-	k8sutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util/kubeutil"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	log "github.com/sirupsen/logrus"
-	"github.com/tidwall/gjson"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
-const (
-	ARGOCD_CONFIG_NAME    = "argocd-cm"
-	ARGOCD_CONFIG_KIND    = "ConfigMap"
-	ARGOCD_CONFIG_API_VER = "v1"
-	ARGOCD_SECRET_KIND    = "Secret"
-)
-
-func GitLatestCommitSha(repoUrl string, branch string) string {
-
-	gitToken := GetRepoCredentials(repoUrl)
-
-	orgName, repoName := getRepoInfo(repoUrl)
-
-	desiredUrl := fmt.Sprintf("https://api.github.com/repos/%s/%s/commits/%s",
-		orgName, repoName, branch)
-
-	response, err := utils.QueryAPI(desiredUrl, "GET", gitToken, nil)
-
-	if err != nil {
-		log.Errorf("Error occured while query github %s ", err.Error())
-		return ""
-	}
-
-	sha := gjson.Get(response, "sha")
-	log.Info("Latest revision ", sha)
-	return sha.String()
-}
-
-func getRepoInfo(repoUrl string) (string, string) {
-	tokens := strings.Split(strings.TrimSuffix(repoUrl, "/"), "/")
-	orgName := ""
-	repoName := ""
-	if len(tokens) == 5 {
-		orgName = tokens[3]
-		repoName = tokens[4]
-	} else if len(tokens) == 4 {
-		orgName = tokens[2]
-		repoName = tokens[3]
-	}
-
-	log.Info(orgName)
-	log.Info(repoName)
-	return orgName, repoName
-}
-
-func GetRepoCredentials(repoUrl string) string {
-
-	interlaceConfig, err := config.GetInterlaceConfig()
-
-	_, cfg, err := utils.GetClient("")
-
-	if err != nil {
-		log.Errorf("Error occured while reading incluster kubeconfig %s", err.Error())
-		return ""
-	}
-
-	k8sutil.SetKubeConfig(cfg)
-
-	apiVersion := ARGOCD_CONFIG_API_VER
-	kind := ARGOCD_CONFIG_KIND
-	name := ARGOCD_CONFIG_NAME
-	namespace := interlaceConfig.ArgocdNamespace
-
-	argoConfigMapObj, err := k8sutil.GetResource(apiVersion, kind, namespace, name)
-
-	if err != nil {
-		log.Errorf("Error occured while retriving ConfigMap from cluster %s", err.Error())
-		return ""
-	}
-
-	argoConfigMap, err := getConfiMapFromObj(argoConfigMapObj)
-	if err != nil {
-		log.Errorf("Error occured while retriving ConfigMap %s", err.Error())
-		return ""
-	}
-
-	repositories := argoConfigMap.Data["repositories"]
-	found := false
-	secretName := ""
-	for _, line := range strings.Split(strings.TrimSuffix(repositories, "\n"), "\n") {
-
-		data := strings.Split(strings.TrimSuffix(strings.TrimSpace(line), ":"), ":")
-		if data[0] == "url" {
-			url := strings.TrimSpace(data[1] + ":" + data[2])
-			if url == repoUrl {
-				found = true
-			}
-		}
-		if data[0] == "name" {
-			secretName = strings.TrimSpace(data[1])
-		}
-	}
-
-	if found {
-
-		kind = ARGOCD_SECRET_KIND
-
-		argoSecretObj, err := k8sutil.GetResource(apiVersion, kind, namespace, secretName)
-		if err != nil {
-			log.Errorf("Error in getting  resource secret object: %s", err.Error())
-			return ""
-		}
-
-		argoSecret, err := getConfiMapFromObj(argoSecretObj)
-		if err != nil {
-			log.Errorf("Error in getting  secret object: %s", err.Error())
-			return ""
-		}
-
-		gitToken, err := base64.StdEncoding.DecodeString(string(argoSecret.Data["password"]))
-		if err != nil {
-			log.Errorf("Error in decoding password from secret object: %s", err.Error())
-			return ""
-		}
-		log.Info("Found credentials for target git repo: ", repoUrl)
-		return string(gitToken)
-	}
-	return ""
-}
-
-func getConfiMapFromObj(obj *unstructured.Unstructured) (*corev1.ConfigMap, error) {
-
-	var cm corev1.ConfigMap
-	objBytes, _ := json.Marshal(obj.Object)
-	err := json.Unmarshal(objBytes, &cm)
-	if err != nil {
-		return nil, fmt.Errorf("error in converting object to ConfigMap; %s", err.Error())
-	}
-
-	return &cm, nil
-}
-
-const gitCmd = "git"
-
 type GitRepoResult struct {
 	RootDir  string
 	URL      string
 	Revision string
 	CommitID string
 	Path     string
+	commit   *object.Commit
+	tag      *object.Tag
 }
+
+// CheckoutPaths writes the files under the given paths of the repository to RootDir
+func (r *GitRepoResult) CheckoutPaths(paths ...string) error {
+	return checkoutPaths(r.commit, r.RootDir, paths...)
+}
+
 type ConfirmedDir string
 
 func (d ConfirmedDir) HasPrefix(path ConfirmedDir) bool {
@@ -208,50 +75,47 @@ func NewTmpConfirmedDir() (ConfirmedDir, error) {
 	return ConfirmedDir(deLinked), err
 }
 
-func GetTopGitRepo(url string) (*GitRepoResult, error) {
+// GetTopGitRepo checks out the path of the commit commitSha of the git repository at url into a temporary directory,
+// with the given credentials of the repository. The commit is searched in the revision branch or tag,
+// and an error is returned when it is not found. Without commitSha, the latest commit of the revision is checked out.
+// Only the files under the path, and the local files its kustomizations refer to, are written.
+// The caller removes RootDir when it is done with the checkout.
+func GetTopGitRepo(url, revision, commitSha, path string, creds *RepoCredentials) (*GitRepoResult, error) {
 
-	log.Infof("GetTopGitRepo url : %s ", url)
+	log.Infof("GetTopGitRepo url : %s revision : %s commit : %s path : %s ", url, revision, commitSha, path)
 
 	r := &GitRepoResult{}
 	r.URL = url
+	r.Path = path
 
-	cDir, err := NewTmpConfirmedDir()
-	if err != nil {
-		log.Errorf("Error in creating temporary directory: %s", err.Error())
-		return nil, err
+	r.Revision = revision
+	if r.Revision == "" {
+		r.Revision = "HEAD"
 	}
 
-	r.RootDir = cDir.String()
-
-	_, err = utils.CmdExec(gitCmd, r.RootDir, "init")
-	if err != nil {
-		log.Errorf("Error in executing git init: %s", err.Error())
-		return nil, err
-	}
-	_, err = utils.CmdExec(gitCmd, r.RootDir, "remote", "add", "origin", r.URL)
+	commit, tag, err := fetchCommit(r.URL, r.Revision, commitSha, creds)
 	if err != nil {
-		log.Errorf("Error in executing git remote add: %s", err.Error())
+		log.Errorf("Error in fetching git repository %s: %s", url, err.Error())
 		return nil, err
 	}
-	rev := "HEAD"
+	r.commit = commit
+	r.tag = tag
+	r.CommitID = commit.Hash.String()
 
-	_, err = utils.CmdExec(gitCmd, r.RootDir, "fetch", "--depth=1", "origin", rev)
-	if err != nil {
-		log.Errorf("Error in executing git fetch: %s", err.Error())
-		return nil, err
-	}
-	_, err = utils.CmdExec(gitCmd, r.RootDir, "checkout", "FETCH_HEAD")
+	cDir, err := NewTmpConfirmedDir()
 	if err != nil {
-		log.Errorf("Error in executing git checkout: %s", err.Error())
+		log.Errorf("Error in creating temporary directory: %s", err.Error())
 		return nil, err
 	}
 
-	commitGetOut, err := utils.CmdExec(gitCmd, r.RootDir, "rev-parse", "FETCH_HEAD")
+	r.RootDir = cDir.String()
+
+	err = r.CheckoutPaths(path)
 	if err != nil {
-		log.Errorf("Error in executing git rev-parse: %s", err.Error())
+		log.Errorf("Error in checking out %s: %s", path, err.Error())
+		os.RemoveAll(r.RootDir)
 		return nil, err
 	}
-	r.CommitID = strings.TrimSuffix(commitGetOut, "\n")
 	return r, nil
 }
 
@@ -0,0 +1,156 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kustomize
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newBareRepo creates a bare git repository with a commit of each of the given
+// contents of app/configmap.yaml, and returns its file URL and the commit hashes
+func newBareRepo(t *testing.T, contents ...string) (string, []string) {
+
+	workDir := t.TempDir()
+	repo, err := git.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatalf("init repository: %s", err.Error())
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("open worktree: %s", err.Error())
+	}
+
+	appDir := filepath.Join(workDir, "app")
+	err = os.MkdirAll(appDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(appDir, "kustomization.yaml"), []byte("resources:\n- configmap.yaml\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := []string{}
+	for i, content := range contents {
+		err = ioutil.WriteFile(filepath.Join(appDir, "configmap.yaml"), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = worktree.Add("app")
+		if err != nil {
+			t.Fatalf("add files: %s", err.Error())
+		}
+		hash, err := worktree.Commit("commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(1600000000+i), 0)},
+		})
+		if err != nil {
+			t.Fatalf("commit: %s", err.Error())
+		}
+		hashes = append(hashes, hash.String())
+	}
+
+	bareDir := filepath.Join(t.TempDir(), "repo.git")
+	_, err = git.PlainClone(bareDir, true, &git.CloneOptions{URL: workDir})
+	if err != nil {
+		t.Fatalf("clone bare repository: %s", err.Error())
+	}
+	return "file://" + bareDir, hashes
+}
+
+func TestGetTopGitRepo(t *testing.T) {
+
+	url, hashes := newBareRepo(t, "v1", "v2", "v3")
+
+	tests := []struct {
+		name      string
+		commitSha string
+		expected  string
+		content   string
+	}{
+		{name: "latest commit of the revision", commitSha: "", expected: hashes[2], content: "v3"},
+		{name: "synced latest commit", commitSha: hashes[2], expected: hashes[2], content: "v3"},
+		{name: "synced older commit", commitSha: hashes[0], expected: hashes[0], content: "v1"},
+	}
+
+	for _, test := range tests {
+		r, err := GetTopGitRepo(url, "master", test.commitSha, "app", &RepoCredentials{})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		defer os.RemoveAll(r.RootDir)
+
+		if r.CommitID != test.expected {
+			t.Errorf("%s: expected commit %s, got %s", test.name, test.expected, r.CommitID)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(r.RootDir, "app", "configmap.yaml"))
+		if err != nil {
+			t.Errorf("%s: checked out file not found: %s", test.name, err.Error())
+			continue
+		}
+		if string(content) != test.content {
+			t.Errorf("%s: expected content %s, got %s", test.name, test.content, string(content))
+		}
+	}
+}
+
+func TestGetTopGitRepoUnknownCommit(t *testing.T) {
+
+	url, _ := newBareRepo(t, "v1")
+
+	_, err := GetTopGitRepo(url, "master", "0123456789012345678901234567890123456789", "app", &RepoCredentials{})
+	if err == nil {
+		t.Error("expected an error for a commit that is not in the revision")
+	}
+
+	_, err = GetTopGitRepo(url, "unknown", "", "app", &RepoCredentials{})
+	if err == nil {
+		t.Error("expected an error for an unknown revision")
+	}
+}
+
+func TestProvenanceCleanup(t *testing.T) {
+
+	url, hashes := newBareRepo(t, "v1")
+
+	r, err := GetTopGitRepo(url, "master", hashes[0], "app", &RepoCredentials{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// The checkout of a sync is reused until it is cleaned up
+	p := &Provenance{repo: r}
+	repo, err := p.gitRepo()
+	if err != nil || repo != r {
+		t.Fatalf("expected the checkout of the sync to be reused")
+	}
+
+	p.Cleanup()
+	if _, err := os.Stat(r.RootDir); !os.IsNotExist(err) {
+		t.Errorf("expected checkout %s to be removed", r.RootDir)
+	}
+	if p.repo != nil {
+		t.Error("expected the checkout to be forgotten")
+	}
+}
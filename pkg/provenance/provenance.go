@@ -17,13 +17,48 @@
 package provenance
 
 import (
+	"path/filepath"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
+	helmprov "github.com/IBM/argocd-interlace/pkg/provenance/helm"
+	kustprov "github.com/IBM/argocd-interlace/pkg/provenance/kustomize"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	log "github.com/sirupsen/logrus"
 )
 
+// Provenance is created once per sync of an application, Cleanup removes what
+// its steps downloaded when the sync is done
 type Provenance interface {
-	GenerateProvanance(appData application.ApplicationData, target, targatDigest string,
-		uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time) error
-	VerifySourceMaterial(appData application.ApplicationData) (bool, error)
+	GenerateProvanance(target, targetDigest string, uploadTLog bool, buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error
+	VerifySourceMaterial() (application.SourceVerification, error)
+	RebuildManifest() ([]byte, error)
+	Cleanup()
+}
+
+// NewProvenance returns the provenance of a helm or kustomize application
+func NewProvenance(appData application.ApplicationData) (Provenance, error) {
+	if appData.IsHelm {
+		return helmprov.NewProvenance(appData)
+	}
+	return kustprov.NewProvenance(appData)
+}
+
+// GenerateProvenance generates the provenance of the manifest of the application in its
+// directory and uploads the signed attestation to the transparency log
+func GenerateProvenance(prov Provenance, appData application.ApplicationData, buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
+
+	manifestPath := filepath.Join(appData.AppDirPath, utils.MANIFEST_FILE_NAME)
+	computedFileHash, err := utils.ComputeHash(manifestPath)
+	if err != nil {
+		log.Errorf("Error in computing manifest digest: %s", err.Error())
+		return err
+	}
+
+	err = prov.GenerateProvanance(manifestPath, computedFileHash, true, buildStartedOn, buildFinishedOn, reproducible)
+	if err != nil {
+		log.Errorf("Error in storing provenance: %s", err.Error())
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,105 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/IBM/argocd-interlace/pkg/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Names of the components in the builder version
+	VersionInterlace = "argocd-interlace"
+	VersionArgocd    = "argocd"
+	VersionKustomize = "kustomize"
+	VersionHelm      = "helm"
+	// Version of the tool that built the manifest again from source
+	VersionRebuild = "rebuild"
+)
+
+// BuilderInfo identifies the controller that generated the provenance and the
+// versions of the components that built the manifest
+type BuilderInfo struct {
+	ID          string
+	Version     map[string]string
+	Environment BuilderEnvironment
+}
+
+type BuilderEnvironment struct {
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	ClusterName  string `json:"clusterName,omitempty"`
+}
+
+// NewBuilderInfo returns the builder of a manifest built with the given tool,
+// VersionKustomize or VersionHelm. The versions of Argo CD and of the tool are
+// reported by the Argo CD server and left out when it can not be queried.
+// rebuildVersion is the version of the tool that built the manifest again
+// from source, empty when it was not rebuilt.
+func NewBuilderInfo(tool, rebuildVersion string) (BuilderInfo, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return BuilderInfo{}, err
+	}
+
+	argocdVersion, err := utils.RetrieveArgocdVersion()
+	if err != nil {
+		log.Warnf("Argo CD version is not recorded in the provenance: %s", err.Error())
+		argocdVersion = nil
+	}
+	return newBuilderInfo(interlaceConfig, argocdVersion, tool, rebuildVersion), nil
+}
+
+// newBuilderInfo returns the builder of the controller configured by interlaceConfig,
+// argocdVersion is nil when the Argo CD server could not be queried
+func newBuilderInfo(interlaceConfig *config.InterlaceConfig, argocdVersion *utils.ArgocdVersion, tool, rebuildVersion string) BuilderInfo {
+
+	builder := BuilderInfo{
+		ID: interlaceConfig.BuilderID,
+		Version: map[string]string{
+			VersionInterlace: version.Version,
+		},
+		Environment: BuilderEnvironment{
+			PodName:      interlaceConfig.PodName,
+			PodNamespace: interlaceConfig.PodNamespace,
+			ClusterName:  interlaceConfig.ClusterName,
+		},
+	}
+	if rebuildVersion != "" {
+		builder.Version[VersionRebuild] = rebuildVersion
+	}
+
+	if argocdVersion == nil {
+		return builder
+	}
+	builder.Version[VersionArgocd] = argocdVersion.Version
+	switch tool {
+	case VersionKustomize:
+		if argocdVersion.KustomizeVersion != "" {
+			builder.Version[VersionKustomize] = argocdVersion.KustomizeVersion
+		}
+	case VersionHelm:
+		if argocdVersion.HelmVersion != "" {
+			builder.Version[VersionHelm] = argocdVersion.HelmVersion
+		}
+	}
+	return builder
+}
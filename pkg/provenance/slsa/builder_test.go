@@ -0,0 +1,91 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/IBM/argocd-interlace/pkg/version"
+)
+
+func TestNewBuilderInfo(t *testing.T) {
+	interlaceConfig := &config.InterlaceConfig{
+		BuilderID:    "https://github.com/IBM/argocd-interlace",
+		PodName:      "argocd-interlace-0",
+		PodNamespace: "argocd-interlace",
+		ClusterName:  "prod",
+	}
+	argocdVersion := &utils.ArgocdVersion{
+		Version:          "v2.2.0",
+		KustomizeVersion: "v4.2.0",
+		HelmVersion:      "v3.7.1",
+	}
+
+	tests := []struct {
+		name           string
+		argocdVersion  *utils.ArgocdVersion
+		tool           string
+		rebuildVersion string
+		wantVersion    map[string]string
+	}{
+		{
+			name:          "kustomize",
+			argocdVersion: argocdVersion,
+			tool:          VersionKustomize,
+			wantVersion:   map[string]string{VersionInterlace: version.Version, VersionArgocd: "v2.2.0", VersionKustomize: "v4.2.0"},
+		},
+		{
+			name:           "helm rebuilt",
+			argocdVersion:  argocdVersion,
+			tool:           VersionHelm,
+			rebuildVersion: "helm v3.7.1+g1d11fcb",
+			wantVersion: map[string]string{VersionInterlace: version.Version, VersionArgocd: "v2.2.0", VersionHelm: "v3.7.1",
+				VersionRebuild: "helm v3.7.1+g1d11fcb"},
+		},
+		{
+			name:          "tool version not reported",
+			argocdVersion: &utils.ArgocdVersion{Version: "v2.2.0"},
+			tool:          VersionHelm,
+			wantVersion:   map[string]string{VersionInterlace: version.Version, VersionArgocd: "v2.2.0"},
+		},
+		{
+			name:        "Argo CD server not reachable",
+			tool:        VersionKustomize,
+			wantVersion: map[string]string{VersionInterlace: version.Version},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := newBuilderInfo(interlaceConfig, tt.argocdVersion, tt.tool, tt.rebuildVersion)
+
+			if builder.ID != interlaceConfig.BuilderID {
+				t.Errorf("builder id = %s, want %s", builder.ID, interlaceConfig.BuilderID)
+			}
+			if !reflect.DeepEqual(builder.Version, tt.wantVersion) {
+				t.Errorf("builder version = %v, want %v", builder.Version, tt.wantVersion)
+			}
+			wantEnvironment := BuilderEnvironment{PodName: "argocd-interlace-0", PodNamespace: "argocd-interlace", ClusterName: "prod"}
+			if builder.Environment != wantEnvironment {
+				t.Errorf("builder environment = %+v, want %+v", builder.Environment, wantEnvironment)
+			}
+		})
+	}
+}
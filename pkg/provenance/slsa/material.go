@@ -0,0 +1,67 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/IBM/argocd-interlace/pkg/images"
+	"github.com/in-toto/in-toto-golang/in_toto"
+	log "github.com/sirupsen/logrus"
+)
+
+// ImageMaterials returns the container images referenced by the manifest as
+// materials, with the digest they are resolved to in the registry
+func ImageMaterials(manifestPath string) ([]in_toto.ProvenanceMaterial, error) {
+
+	manifest, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		log.Errorf("Error in reading manifest: %s", err.Error())
+		return nil, err
+	}
+
+	resolvedImages, err := images.ResolveImages(manifest)
+	if err != nil {
+		log.Errorf("Error in resolving images: %s", err.Error())
+		return nil, err
+	}
+
+	materials := []in_toto.ProvenanceMaterial{}
+	for _, image := range resolvedImages {
+		material := in_toto.ProvenanceMaterial{
+			URI: image.Reference,
+		}
+		if algorithm, digest, ok := splitDigest(image.Digest); ok {
+			material.Digest = in_toto.DigestSet{
+				algorithm: digest,
+			}
+		}
+		materials = append(materials, material)
+	}
+	return materials, nil
+}
+
+// splitDigest splits a digest like sha256:abc into its algorithm and value
+func splitDigest(digest string) (string, string, bool) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,294 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+)
+
+const (
+	// Predicate versions selected by PROVENANCE_PREDICATE_VERSION
+	PredicateVersionV01 = "v0.1"
+	PredicateVersionV02 = "v0.2"
+	PredicateVersionV1  = "v1.0"
+
+	PredicateSLSAProvenanceV02 = "https://slsa.dev/provenance/v0.2"
+	PredicateSLSAProvenanceV1  = "https://slsa.dev/provenance/v1"
+
+	// Build types of the manifests built by Argo CD, their parameters are
+	// described in docs/provenance.md
+	BuildTypeKustomize = "https://github.com/IBM/argocd-interlace/buildtypes/kustomize@v1"
+	BuildTypeHelm      = "https://github.com/IBM/argocd-interlace/buildtypes/helm@v1"
+)
+
+// Build describes a manifest build from which the provenance predicate is generated
+type Build struct {
+	BuildType string
+	// Command that builds the manifest from the config source, e.g. "kustomize build"
+	EntryPoint string
+	Arguments  []string
+	// Repository and path of the application source
+	ConfigSource ConfigSource
+	// Application source parameters as given in the Argo CD Application
+	Parameters map[string]interface{}
+	Materials  []in_toto.ProvenanceMaterial
+	// Digests the image tags of the manifest were pinned to, by tag
+	ImageDigests    map[string]string
+	BuildStartedOn  time.Time
+	BuildFinishedOn time.Time
+	// Whether the manifest was built again and found identical
+	Reproducible bool
+	Builder      BuilderInfo
+}
+
+type ProvenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type ConfigSource struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     in_toto.DigestSet `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+type BuildConfig struct {
+	EntryPoint   string            `json:"entryPoint"`
+	Arguments    []string          `json:"arguments,omitempty"`
+	ImageDigests map[string]string `json:"imageDigests,omitempty"`
+}
+
+// ProvenancePredicateV02 is the SLSA v0.2 provenance predicate
+type ProvenancePredicateV02 struct {
+	Builder     ProvenanceBuilder            `json:"builder"`
+	BuildType   string                       `json:"buildType"`
+	Invocation  ProvenanceInvocation         `json:"invocation"`
+	BuildConfig BuildConfig                  `json:"buildConfig"`
+	Metadata    *ProvenanceMetadataV02       `json:"metadata,omitempty"`
+	Materials   []in_toto.ProvenanceMaterial `json:"materials,omitempty"`
+}
+
+type ProvenanceInvocation struct {
+	ConfigSource ConfigSource           `json:"configSource"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Environment  InvocationEnvironment  `json:"environment"`
+}
+
+type InvocationEnvironment struct {
+	BuilderEnvironment
+	Versions map[string]string `json:"versions,omitempty"`
+}
+
+type ProvenanceMetadataV02 struct {
+	BuildStartedOn  *time.Time         `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn *time.Time         `json:"buildFinishedOn,omitempty"`
+	Completeness    ProvenanceComplete `json:"completeness"`
+	Reproducible    bool               `json:"reproducible"`
+}
+
+type ProvenanceComplete struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+// ProvenancePredicateV1 is the SLSA v1.0 provenance predicate
+type ProvenancePredicateV1 struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   interface{}            `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies,omitempty"`
+}
+
+type InternalParameters struct {
+	BuildConfig
+	Environment BuilderEnvironment `json:"environment"`
+}
+
+type ResourceDescriptor struct {
+	URI         string                 `json:"uri,omitempty"`
+	Digest      in_toto.DigestSet      `json:"digest,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  ProvenanceBuilder `json:"builder"`
+	Metadata BuildMetadata     `json:"metadata"`
+}
+
+type BuildMetadata struct {
+	StartedOn  *time.Time `json:"startedOn,omitempty"`
+	FinishedOn *time.Time `json:"finishedOn,omitempty"`
+}
+
+// NewStatement returns the in-toto statement of the build with the predicate of the given version
+func NewStatement(predicateVersion string, subjects []in_toto.Subject, build Build) (in_toto.Statement, error) {
+
+	header := in_toto.StatementHeader{
+		Type:    in_toto.StatementInTotoV01,
+		Subject: subjects,
+	}
+
+	switch predicateVersion {
+	case PredicateVersionV01, "":
+		header.PredicateType = in_toto.PredicateSLSAProvenanceV01
+		var environment interface{}
+		if len(build.ImageDigests) > 0 {
+			environment = map[string]interface{}{
+				"imageDigests": build.ImageDigests,
+			}
+		}
+		return in_toto.Statement{
+			StatementHeader: header,
+			Predicate: in_toto.ProvenancePredicate{
+				Builder: in_toto.ProvenanceBuilder{ID: build.Builder.ID},
+				Metadata: &in_toto.ProvenanceMetadata{
+					Reproducible:    build.Reproducible,
+					BuildStartedOn:  &build.BuildStartedOn,
+					BuildFinishedOn: &build.BuildFinishedOn,
+				},
+				Materials: build.Materials,
+				Recipe: in_toto.ProvenanceRecipe{
+					EntryPoint:  build.EntryPoint,
+					Arguments:   build.Arguments,
+					Environment: environment,
+				},
+			},
+		}, nil
+
+	case PredicateVersionV02:
+		header.PredicateType = PredicateSLSAProvenanceV02
+		return in_toto.Statement{
+			StatementHeader: header,
+			Predicate: ProvenancePredicateV02{
+				Builder:   ProvenanceBuilder{ID: build.Builder.ID},
+				BuildType: build.BuildType,
+				Invocation: ProvenanceInvocation{
+					ConfigSource: build.ConfigSource,
+					Parameters:   build.Parameters,
+					Environment: InvocationEnvironment{
+						BuilderEnvironment: build.Builder.Environment,
+						Versions:           build.Builder.Version,
+					},
+				},
+				BuildConfig: BuildConfig{
+					EntryPoint:   build.EntryPoint,
+					Arguments:    build.Arguments,
+					ImageDigests: build.ImageDigests,
+				},
+				Metadata: &ProvenanceMetadataV02{
+					BuildStartedOn:  &build.BuildStartedOn,
+					BuildFinishedOn: &build.BuildFinishedOn,
+					Completeness: ProvenanceComplete{
+						Parameters: true,
+					},
+					Reproducible: build.Reproducible,
+				},
+				Materials: build.Materials,
+			},
+		}, nil
+
+	case PredicateVersionV1:
+		header.PredicateType = PredicateSLSAProvenanceV1
+		externalParameters := map[string]interface{}{
+			"source": build.ConfigSource,
+		}
+		for name, value := range build.Parameters {
+			externalParameters[name] = value
+		}
+		dependencies := []ResourceDescriptor{}
+		for _, material := range build.Materials {
+			dependencies = append(dependencies, newResourceDescriptor(material))
+		}
+		return in_toto.Statement{
+			StatementHeader: header,
+			Predicate: ProvenancePredicateV1{
+				BuildDefinition: BuildDefinition{
+					BuildType:          build.BuildType,
+					ExternalParameters: externalParameters,
+					InternalParameters: InternalParameters{
+						BuildConfig: BuildConfig{
+							EntryPoint:   build.EntryPoint,
+							Arguments:    build.Arguments,
+							ImageDigests: build.ImageDigests,
+						},
+						Environment: build.Builder.Environment,
+					},
+					ResolvedDependencies: dependencies,
+				},
+				RunDetails: RunDetails{
+					Builder: ProvenanceBuilder{
+						ID:      build.Builder.ID,
+						Version: build.Builder.Version,
+					},
+					Metadata: BuildMetadata{
+						StartedOn:  &build.BuildStartedOn,
+						FinishedOn: &build.BuildFinishedOn,
+					},
+				},
+			},
+		}, nil
+	}
+
+	return in_toto.Statement{}, fmt.Errorf("Unsupported provenance predicate version %s", predicateVersion)
+}
+
+// newResourceDescriptor converts a material to a resolved dependency. Only digests
+// are kept in the digest set, with the names of the SLSA digest algorithms; the
+// other entries, like the revision and the path of a git material, become annotations.
+func newResourceDescriptor(material in_toto.ProvenanceMaterial) ResourceDescriptor {
+
+	descriptor := ResourceDescriptor{
+		URI: material.URI,
+	}
+	for name, value := range material.Digest {
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "commit":
+			name = "gitCommit"
+		case "sha256hash":
+			name = "sha256"
+		}
+		switch name {
+		case "gitCommit", "sha1", "sha256", "sha384", "sha512":
+			if descriptor.Digest == nil {
+				descriptor.Digest = in_toto.DigestSet{}
+			}
+			descriptor.Digest[name] = strings.ToLower(value)
+		case "name":
+			descriptor.Name = value
+		default:
+			if descriptor.Annotations == nil {
+				descriptor.Annotations = map[string]interface{}{}
+			}
+			descriptor.Annotations[name] = value
+		}
+	}
+	return descriptor
+}
@@ -0,0 +1,241 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+)
+
+// testBuild is the build of a kustomize application with a pinned image
+func testBuild() Build {
+	startedOn := time.Date(2021, 10, 12, 1, 0, 0, 0, time.UTC)
+	return Build{
+		BuildType:  BuildTypeKustomize,
+		EntryPoint: "kustomize build",
+		Arguments:  []string{"guestbook"},
+		ConfigSource: ConfigSource{
+			URI:        "git+https://github.com/example/apps.git",
+			Digest:     in_toto.DigestSet{"sha1": "9c3b4e5bb4ee5ed1ec9df2ee8e51e4b7cd9c66b1"},
+			EntryPoint: "guestbook",
+		},
+		Parameters: map[string]interface{}{"targetRevision": "main"},
+		Materials: []in_toto.ProvenanceMaterial{{
+			URI:    "git+https://github.com/example/apps.git",
+			Digest: in_toto.DigestSet{"commit": "9C3B4E5BB4EE5ED1EC9DF2EE8E51E4B7CD9C66B1", "revision": "main"},
+		}},
+		ImageDigests:    map[string]string{"nginx:1.21": "sha256:4cf0a4d8"},
+		BuildStartedOn:  startedOn,
+		BuildFinishedOn: startedOn.Add(time.Minute),
+		Reproducible:    true,
+		Builder: BuilderInfo{
+			ID:          "https://github.com/IBM/argocd-interlace",
+			Version:     map[string]string{VersionInterlace: "v0.1.0", VersionArgocd: "v2.2.0"},
+			Environment: BuilderEnvironment{PodName: "argocd-interlace-0", PodNamespace: "argocd-interlace"},
+		},
+	}
+}
+
+// predicateJSON returns the predicate of the statement as generic JSON
+func predicateJSON(t *testing.T, statement in_toto.Statement) map[string]interface{} {
+	b, err := json.Marshal(statement.Predicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	predicate := map[string]interface{}{}
+	if err := json.Unmarshal(b, &predicate); err != nil {
+		t.Fatal(err)
+	}
+	return predicate
+}
+
+// field returns the value of the predicate at the path of keys
+func field(predicate map[string]interface{}, keys ...string) interface{} {
+	var value interface{} = predicate
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func TestNewStatement(t *testing.T) {
+	subjects := []in_toto.Subject{{Name: "manifest.yaml", Digest: in_toto.DigestSet{"sha256": "e3b0c442"}}}
+
+	tests := []struct {
+		name              string
+		predicateVersion  string
+		wantPredicateType string
+		// wantFields are the expected values of the predicate by path
+		wantFields map[string]interface{}
+	}{
+		{
+			name:              "default is v0.1",
+			predicateVersion:  "",
+			wantPredicateType: in_toto.PredicateSLSAProvenanceV01,
+			wantFields: map[string]interface{}{
+				"builder.id":                      "https://github.com/IBM/argocd-interlace",
+				"recipe.entryPoint":               "kustomize build",
+				"recipe.environment.imageDigests": map[string]interface{}{"nginx:1.21": "sha256:4cf0a4d8"},
+				"metadata.reproducible":           true,
+			},
+		},
+		{
+			name:              "v0.2",
+			predicateVersion:  PredicateVersionV02,
+			wantPredicateType: PredicateSLSAProvenanceV02,
+			wantFields: map[string]interface{}{
+				"builder.id":                             "https://github.com/IBM/argocd-interlace",
+				"buildType":                              BuildTypeKustomize,
+				"invocation.configSource.uri":            "git+https://github.com/example/apps.git",
+				"invocation.configSource.entryPoint":     "guestbook",
+				"invocation.parameters.targetRevision":   "main",
+				"invocation.environment.podName":         "argocd-interlace-0",
+				"invocation.environment.versions.argocd": "v2.2.0",
+				"buildConfig.entryPoint":                 "kustomize build",
+				"buildConfig.arguments":                  []interface{}{"guestbook"},
+				"buildConfig.imageDigests":               map[string]interface{}{"nginx:1.21": "sha256:4cf0a4d8"},
+				"metadata.buildStartedOn":                "2021-10-12T01:00:00Z",
+				"metadata.buildFinishedOn":               "2021-10-12T01:01:00Z",
+				"metadata.reproducible":                  true,
+				"metadata.completeness.parameters":       true,
+				"metadata.completeness.materials":        false,
+			},
+		},
+		{
+			name:              "v1.0",
+			predicateVersion:  PredicateVersionV1,
+			wantPredicateType: PredicateSLSAProvenanceV1,
+			wantFields: map[string]interface{}{
+				"buildDefinition.buildType":                              BuildTypeKustomize,
+				"buildDefinition.externalParameters.source.uri":          "git+https://github.com/example/apps.git",
+				"buildDefinition.externalParameters.targetRevision":      "main",
+				"buildDefinition.internalParameters.entryPoint":          "kustomize build",
+				"buildDefinition.internalParameters.imageDigests":        map[string]interface{}{"nginx:1.21": "sha256:4cf0a4d8"},
+				"buildDefinition.internalParameters.environment.podName": "argocd-interlace-0",
+				"runDetails.builder.id":                                  "https://github.com/IBM/argocd-interlace",
+				"runDetails.builder.version.argocd-interlace":            "v0.1.0",
+				"runDetails.metadata.startedOn":                          "2021-10-12T01:00:00Z",
+				"runDetails.metadata.finishedOn":                         "2021-10-12T01:01:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, err := NewStatement(tt.predicateVersion, subjects, testBuild())
+			if err != nil {
+				t.Fatalf("NewStatement() error = %v", err)
+			}
+			if statement.Type != in_toto.StatementInTotoV01 || statement.PredicateType != tt.wantPredicateType {
+				t.Errorf("NewStatement() type = %s, predicate type = %s, want %s", statement.Type, statement.PredicateType, tt.wantPredicateType)
+			}
+			if !reflect.DeepEqual(statement.Subject, subjects) {
+				t.Errorf("NewStatement() subjects = %v, want %v", statement.Subject, subjects)
+			}
+
+			predicate := predicateJSON(t, statement)
+			for path, want := range tt.wantFields {
+				if got := field(predicate, strings.Split(path, ".")...); !reflect.DeepEqual(got, want) {
+					t.Errorf("predicate %s = %v, want %v", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewStatementV1ResolvedDependencies(t *testing.T) {
+	statement, err := NewStatement(PredicateVersionV1, nil, testBuild())
+	if err != nil {
+		t.Fatalf("NewStatement() error = %v", err)
+	}
+	predicate, ok := statement.Predicate.(ProvenancePredicateV1)
+	if !ok {
+		t.Fatalf("NewStatement() predicate = %T, want ProvenancePredicateV1", statement.Predicate)
+	}
+	want := []ResourceDescriptor{{
+		URI:         "git+https://github.com/example/apps.git",
+		Digest:      in_toto.DigestSet{"gitCommit": "9c3b4e5bb4ee5ed1ec9df2ee8e51e4b7cd9c66b1"},
+		Annotations: map[string]interface{}{"revision": "main"},
+	}}
+	if !reflect.DeepEqual(predicate.BuildDefinition.ResolvedDependencies, want) {
+		t.Errorf("resolved dependencies = %+v, want %+v", predicate.BuildDefinition.ResolvedDependencies, want)
+	}
+}
+
+func TestNewStatementUnsupportedVersion(t *testing.T) {
+	if _, err := NewStatement("v0.3", nil, testBuild()); err == nil {
+		t.Error("NewStatement() of unsupported predicate version succeeded")
+	}
+}
+
+func TestNewResourceDescriptor(t *testing.T) {
+	tests := []struct {
+		name     string
+		material in_toto.ProvenanceMaterial
+		want     ResourceDescriptor
+	}{
+		{
+			name: "git material",
+			material: in_toto.ProvenanceMaterial{
+				URI:    "git+https://github.com/example/apps.git",
+				Digest: in_toto.DigestSet{"commit": "ABCDEF", "revision": "main", "path": "guestbook"},
+			},
+			want: ResourceDescriptor{
+				URI:         "git+https://github.com/example/apps.git",
+				Digest:      in_toto.DigestSet{"gitCommit": "abcdef"},
+				Annotations: map[string]interface{}{"revision": "main", "path": "guestbook"},
+			},
+		},
+		{
+			name: "helm chart material",
+			material: in_toto.ProvenanceMaterial{
+				URI:    "https://charts.example.com/guestbook-0.1.0.tgz",
+				Digest: in_toto.DigestSet{"sha256hash": "E3B0C442", "name": "guestbook"},
+			},
+			want: ResourceDescriptor{
+				URI:    "https://charts.example.com/guestbook-0.1.0.tgz",
+				Digest: in_toto.DigestSet{"sha256": "e3b0c442"},
+				Name:   "guestbook",
+			},
+		},
+		{
+			name: "image material without digest",
+			material: in_toto.ProvenanceMaterial{
+				URI:    "nginx:1.21",
+				Digest: in_toto.DigestSet{"sha256": ""},
+			},
+			want: ResourceDescriptor{URI: "nginx:1.21"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newResourceDescriptor(tt.material); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newResourceDescriptor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
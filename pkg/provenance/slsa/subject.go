@@ -0,0 +1,118 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/in-toto/in-toto-golang/in_toto"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// NewSubjects returns the subject of the manifest bundle in target and, when
+// resourceSubjects is set, one subject per resource of the manifest
+func NewSubjects(target, targetDigest string, resourceSubjects bool) ([]in_toto.Subject, error) {
+
+	subjects := []in_toto.Subject{{
+		Name: target,
+		Digest: in_toto.DigestSet{
+			"sha256": strings.ReplaceAll(targetDigest, "sha256:", ""),
+		},
+	}}
+	if !resourceSubjects {
+		return subjects, nil
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Clean(target))
+	if err != nil {
+		log.Errorf("Error in reading manifest: %s", err.Error())
+		return nil, err
+	}
+
+	objs, err := SplitResources(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		digest, err := ResourceDigest(obj)
+		if err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, in_toto.Subject{
+			Name: ResourceSubjectName(obj),
+			Digest: in_toto.DigestSet{
+				"sha256": digest,
+			},
+		})
+	}
+	return subjects, nil
+}
+
+// SplitResources returns the resources of a manifest with several YAML documents
+func SplitResources(manifest []byte) ([]*unstructured.Unstructured, error) {
+
+	objs := []*unstructured.Unstructured{}
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifest) {
+		obj := &unstructured.Unstructured{}
+		err := yaml.Unmarshal(item, &obj.Object)
+		if err != nil {
+			log.Errorf("Error in unmarshaling manifest: %s", err.Error())
+			return nil, err
+		}
+		if obj.GetKind() == "" {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// ResourceSubjectName returns the subject name of a resource, apiVersion, kind,
+// namespace and name separated by slashes, e.g. apps/v1/Deployment/default/nginx.
+// The namespace is left out for cluster scoped resources.
+func ResourceSubjectName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s/%s/%s", obj.GetAPIVersion(), obj.GetKind(), obj.GetName())
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// ResourceDigest returns the SHA-256 digest of the resource in compact JSON with
+// sorted keys and without HTML escaping, e.g. the output of `jq -cjS .`
+func ResourceDigest(obj *unstructured.Unstructured) (string, error) {
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(obj.Object)
+	if err != nil {
+		log.Errorf("Error in marshaling resource: %s", err.Error())
+		return "", err
+	}
+
+	sum := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return fmt.Sprintf("%x", sum), nil
+}
@@ -0,0 +1,125 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package slsa
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: guestbook
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  namespace: guestbook
+spec:
+  replicas: 1
+`
+
+func TestNewSubjects(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := ioutil.WriteFile(target, []byte(testManifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaceDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"guestbook"}}`)))
+	deploymentDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(
+		`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"guestbook-ui","namespace":"guestbook"},"spec":{"replicas":1}}`)))
+	bundle := in_toto.Subject{Name: target, Digest: in_toto.DigestSet{"sha256": "e3b0c442"}}
+
+	tests := []struct {
+		name             string
+		resourceSubjects bool
+		want             []in_toto.Subject
+	}{
+		{
+			name: "bundle only",
+			want: []in_toto.Subject{bundle},
+		},
+		{
+			name:             "bundle and resources",
+			resourceSubjects: true,
+			want: []in_toto.Subject{
+				bundle,
+				{Name: "v1/Namespace/guestbook", Digest: in_toto.DigestSet{"sha256": namespaceDigest}},
+				{Name: "apps/v1/Deployment/guestbook/guestbook-ui", Digest: in_toto.DigestSet{"sha256": deploymentDigest}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subjects, err := NewSubjects(target, "sha256:e3b0c442", tt.resourceSubjects)
+			if err != nil {
+				t.Fatalf("NewSubjects() error = %v", err)
+			}
+			if !reflect.DeepEqual(subjects, tt.want) {
+				t.Errorf("NewSubjects() = %v, want %v", subjects, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSubjectsWithoutManifest(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "manifest.yaml")
+	if _, err := NewSubjects(target, "sha256:e3b0c442", true); err == nil {
+		t.Error("NewSubjects() of missing manifest succeeded")
+	}
+}
+
+func TestResourceDigest(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  map[string]interface{}
+		want string
+	}{
+		{
+			name: "keys are sorted",
+			obj:  map[string]interface{}{"kind": "ConfigMap", "apiVersion": "v1", "data": map[string]interface{}{"b": "2", "a": "1"}},
+			want: `{"apiVersion":"v1","data":{"a":"1","b":"2"},"kind":"ConfigMap"}`,
+		},
+		{
+			name: "HTML is not escaped",
+			obj:  map[string]interface{}{"kind": "ConfigMap", "data": map[string]interface{}{"html": "<a>&</a>"}},
+			want: `{"data":{"html":"<a>&</a>"},"kind":"ConfigMap"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			digest, err := ResourceDigest(&unstructured.Unstructured{Object: tt.obj})
+			if err != nil {
+				t.Fatalf("ResourceDigest() error = %v", err)
+			}
+			if want := fmt.Sprintf("%x", sha256.Sum256([]byte(tt.want))); digest != want {
+				t.Errorf("ResourceDigest() = %s, want the digest of %s", digest, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sign
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	KeylessKeyRef = "keyless"
+	// A new certificate is requested when the current one expires within this margin,
+	// so that the manifest and the attestation of a sync are signed by the same certificate
+	certRefreshMargin = 5 * time.Minute
+)
+
+// KeylessSigner signs with an ephemeral key certified by a Fulcio-compatible CA
+// for the identity of the service account token of the controller
+type KeylessSigner struct {
+	fulcioURL  string
+	tokenPath  string
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	priv      *ecdsa.PrivateKey
+	certChain []byte
+	notAfter  time.Time
+}
+
+type fulcioCertificateRequest struct {
+	PublicKey struct {
+		Content   string `json:"content"`
+		Algorithm string `json:"algorithm"`
+	} `json:"publicKey"`
+	SignedEmailAddress string `json:"signedEmailAddress"`
+}
+
+// NewKeylessSigner returns a signer whose first certificate is requested from FULCIO_URL
+// with the OIDC token in OIDC_TOKEN_PATH
+func NewKeylessSigner() (*KeylessSigner, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &KeylessSigner{
+		fulcioURL:  interlaceConfig.FulcioURL,
+		tokenPath:  interlaceConfig.OIDCTokenPath,
+		httpClient: utils.NewHTTPClient(30 * time.Second),
+	}
+
+	err = s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *KeylessSigner) Sign(payload []byte) ([]byte, error) {
+	sig, _, err := s.SignWithCertificate(payload)
+	return sig, err
+}
+
+// SignWithCertificate returns the signature and the certificate chain of the ephemeral
+// key that made it, so that a concurrent refresh cannot pair it with another certificate
+func (s *KeylessSigner) SignWithCertificate(payload []byte) ([]byte, []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if time.Now().Add(certRefreshMargin).After(s.notAfter) {
+		err := s.refresh()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.priv, h[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, s.certChain, nil
+}
+
+func (s *KeylessSigner) PublicKey() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return cryptoutils.MarshalPublicKeyToPEM(&s.priv.PublicKey)
+}
+
+// refresh generates a new ephemeral key and requests a certificate for it
+func (s *KeylessSigner) refresh() error {
+
+	token, err := ioutil.ReadFile(filepath.Clean(s.tokenPath))
+	if err != nil {
+		return fmt.Errorf("failed to read OIDC token: %s", err.Error())
+	}
+	rawToken := strings.TrimSpace(string(token))
+
+	subject, err := tokenSubject(rawToken)
+	if err != nil {
+		return err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	certChain, err := s.requestCertificate(priv, rawToken, subject)
+	if err != nil {
+		return err
+	}
+
+	certBlock, _ := pem.Decode(certChain)
+	if certBlock == nil {
+		return fmt.Errorf("no certificate in response from %s", s.fulcioURL)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	if !priv.PublicKey.Equal(cert.PublicKey) {
+		return fmt.Errorf("certificate from %s does not certify the ephemeral key", s.fulcioURL)
+	}
+
+	log.Infof("Obtained signing certificate for %s valid until %s", subject, cert.NotAfter)
+
+	s.priv = priv
+	s.certChain = certChain
+	s.notAfter = cert.NotAfter
+	return nil
+}
+
+// requestCertificate sends the public key and the proof of its possession, the signature
+// of the token subject, to the signingCert endpoint and returns the PEM certificate chain
+func (s *KeylessSigner) requestCertificate(priv *ecdsa.PrivateKey, rawToken, subject string) ([]byte, error) {
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256([]byte(subject))
+	proof, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var certReq fulcioCertificateRequest
+	certReq.PublicKey.Content = base64.StdEncoding.EncodeToString(pubBytes)
+	certReq.PublicKey.Algorithm = "ecdsa"
+	certReq.SignedEmailAddress = base64.StdEncoding.EncodeToString(proof)
+
+	reqBody, err := json.Marshal(certReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.fulcioURL+"/api/v1/signingCert", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/pem-certificate-chain")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fulcio returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// tokenSubject returns the identity Fulcio certifies for the token: the email claim
+// when present, otherwise the subject, e.g. system:serviceaccount:<namespace>:<name>
+func tokenSubject(rawToken string) (string, error) {
+
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("OIDC token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode OIDC token: %s", err.Error())
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse OIDC token claims: %s", err.Error())
+	}
+
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("OIDC token has no subject")
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,259 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+)
+
+const testTokenSubject = "system:serviceaccount:argocd-interlace:argocd-interlace-controller"
+
+// fakeFulcio is a CA stand-in that certifies the public key of a signingCert request
+// for the email of the bearer token, once the proof of possession is verified
+type fakeFulcio struct {
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	token    string
+	validity time.Duration
+	issued   int32
+}
+
+func newFakeFulcio(t *testing.T, token string, validity time.Duration) *fakeFulcio {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake-fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeFulcio{caKey: caKey, caCert: caCert, token: token, validity: validity}
+}
+
+func (f *fakeFulcio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/signingCert" || r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req fulcioCertificateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	pubBytes, _ := base64.StdEncoding.DecodeString(req.PublicKey.Content)
+	pub, err := x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	proof, _ := base64.StdEncoding.DecodeString(req.SignedEmailAddress)
+	h := sha256.Sum256([]byte(testTokenSubject))
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], proof) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	serial := atomic.AddInt32(&f.issued, 1) + 1
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(int64(serial)),
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(f.validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{testTokenSubject},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, pub, f.caKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusCreated)
+	_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+}
+
+// writeTestToken writes an unsigned JWT of the service account to dir, the fake CA
+// only compares it with the token it expects
+func writeTestToken(t *testing.T, dir string) (string, string) {
+	claims, _ := json.Marshal(map[string]string{"sub": testTokenSubject, "iss": "https://kubernetes.default.svc"})
+	token := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)),
+		base64.RawURLEncoding.EncodeToString(claims),
+		"signature",
+	}, ".")
+	tokenPath := filepath.Join(dir, "token")
+	err := ioutil.WriteFile(tokenPath, []byte(token+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, tokenPath
+}
+
+func leafCertificate(t *testing.T, certChain []byte) *x509.Certificate {
+	block, _ := pem.Decode(certChain)
+	if block == nil {
+		t.Fatal("no certificate in certificate chain")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKeylessSigner(t *testing.T) {
+	token, tokenPath := writeTestToken(t, t.TempDir())
+	fulcio := newFakeFulcio(t, token, 20*time.Minute)
+	server := httptest.NewServer(fulcio)
+	defer server.Close()
+
+	signer := &KeylessSigner{fulcioURL: server.URL, tokenPath: tokenPath, httpClient: http.DefaultClient}
+
+	payload := []byte("manifest")
+	sig, certChain, err := signer.SignWithCertificate(payload)
+	if err != nil {
+		t.Fatalf("SignWithCertificate() error = %v", err)
+	}
+
+	cert := leafCertificate(t, certChain)
+	roots := x509.NewCertPool()
+	roots.AddCert(fulcio.caCert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}})
+	if err != nil {
+		t.Errorf("certificate is not issued by the CA: %v", err)
+	}
+	if len(cert.EmailAddresses) != 1 || cert.EmailAddresses[0] != testTokenSubject {
+		t.Errorf("certificate identity = %v, want %s", cert.EmailAddresses, testTokenSubject)
+	}
+
+	h := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), h[:], sig) {
+		t.Error("signature does not verify with the key of the certificate")
+	}
+
+	// The certificate is reused while it is valid beyond the refresh margin
+	_, sameChain, err := signer.SignWithCertificate(payload)
+	if err != nil {
+		t.Fatalf("SignWithCertificate() error = %v", err)
+	}
+	if string(sameChain) != string(certChain) || atomic.LoadInt32(&fulcio.issued) != 1 {
+		t.Errorf("a new certificate was requested for a valid one, %d issued", fulcio.issued)
+	}
+}
+
+func TestKeylessSignerRefresh(t *testing.T) {
+	token, tokenPath := writeTestToken(t, t.TempDir())
+	// Certificates expire within the refresh margin, every signature needs a new one
+	fulcio := newFakeFulcio(t, token, certRefreshMargin/2)
+	server := httptest.NewServer(fulcio)
+	defer server.Close()
+
+	signer := &KeylessSigner{fulcioURL: server.URL, tokenPath: tokenPath, httpClient: http.DefaultClient}
+
+	payload := []byte("attestation")
+	for i := 0; i < 2; i++ {
+		sig, certChain, err := signer.SignWithCertificate(payload)
+		if err != nil {
+			t.Fatalf("SignWithCertificate() error = %v", err)
+		}
+		// The signature is returned with the certificate of the key that made it
+		cert := leafCertificate(t, certChain)
+		h := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), h[:], sig) {
+			t.Errorf("signature %d does not verify with the returned certificate", i)
+		}
+	}
+	if issued := atomic.LoadInt32(&fulcio.issued); issued != 2 {
+		t.Errorf("%d certificates issued, want 2", issued)
+	}
+}
+
+func TestKeylessSignerRejectedToken(t *testing.T) {
+	_, tokenPath := writeTestToken(t, t.TempDir())
+	server := httptest.NewServer(newFakeFulcio(t, "another-token", 20*time.Minute))
+	defer server.Close()
+
+	signer := &KeylessSigner{fulcioURL: server.URL, tokenPath: tokenPath, httpClient: http.DefaultClient}
+	if _, err := signer.Sign([]byte("manifest")); err == nil {
+		t.Error("Sign() succeeded with a token rejected by the CA")
+	}
+}
+
+func TestKeylessSignerVerifiesTLS(t *testing.T) {
+	token, tokenPath := writeTestToken(t, t.TempDir())
+	fulcio := newFakeFulcio(t, token, 20*time.Minute)
+	server := httptest.NewTLSServer(fulcio)
+	defer server.Close()
+
+	// Querying the Argo CD API disables verification on the default transport
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	defaultTLSConfig := defaultTransport.TLSClientConfig
+	_, _ = utils.QueryAPI(server.URL, http.MethodGet, "", nil)
+	defer func() { defaultTransport.TLSClientConfig = defaultTLSConfig }()
+
+	signer := &KeylessSigner{fulcioURL: server.URL, tokenPath: tokenPath, httpClient: utils.NewHTTPClient(30 * time.Second)}
+	if _, err := signer.Sign([]byte("manifest")); err == nil {
+		t.Error("Sign() succeeded with a CA server of an untrusted certificate")
+	}
+	if issued := atomic.LoadInt32(&fulcio.issued); issued != 0 {
+		t.Errorf("%d certificates issued to a client that does not trust the server", issued)
+	}
+
+	// The certificate of the server is verified, not skipped
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	signer.httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	if _, err := signer.Sign([]byte("manifest")); err != nil {
+		t.Errorf("Sign() error = %v with a trusted CA server", err)
+	}
+}
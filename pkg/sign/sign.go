@@ -17,24 +17,99 @@
 package sign
 
 import (
-	"github.com/sigstore/k8s-manifest-sigstore/pkg/k8smanifest"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	"github.com/sigstore/k8s-manifest-sigstore/pkg/util/mapnode"
 	log "github.com/sirupsen/logrus"
 )
 
-func SignManifest(keyPath, manifestPath, signedManifestPath string) ([]byte, error) {
+// SignManifest signs the manifest with the configured signer in the k8s-manifest-sigstore
+// format: every resource is annotated with the message, the base64 encoded gzip of the
+// tar.gz of the manifest, and the signature of that tar.gz. In keyless mode the
+// certificate chain of the ephemeral key is embedded as well. The signed manifest is
+// written to signedManifestPath and returned.
+func SignManifest(manifestPath, signedManifestPath string) ([]byte, error) {
 
-	so := &k8smanifest.SignOption{
-		ImageRef:         "",
-		KeyPath:          keyPath,
-		Output:           signedManifestPath,
-		UpdateAnnotation: true,
-		ImageAnnotations: nil,
+	signer, err := GetSigner()
+	if err != nil {
+		log.Errorf("Error in getting signer: %s", err.Error())
+		return nil, err
 	}
 
-	signedBytes, err := k8smanifest.Sign(manifestPath, so)
+	var inputDataBuffer bytes.Buffer
+	err = k8smnfutil.TarGzCompress(manifestPath, &inputDataBuffer, nil)
+	if err != nil {
+		log.Errorf("Error in compressing manifest: %s", err.Error())
+		return nil, err
+	}
+	blob := inputDataBuffer.Bytes()
+
+	sig, certChain, err := SignWithCertificate(signer, blob)
 	if err != nil {
 		log.Errorf("Error in signing artifact: %s", err.Error())
 		return nil, err
 	}
+
+	annotations := map[string]interface{}{
+		utils.MSG_ANNOTATION_NAME: base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress(blob)),
+		utils.SIG_ANNOTATION_NAME: base64.StdEncoding.EncodeToString(sig),
+	}
+
+	// Same encoding as the message, as expected by k8s-manifest-sigstore
+	if certChain != nil {
+		annotations[utils.CERT_ANNOTATION_NAME] = base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress(certChain))
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		log.Errorf("Error in reading manifest: %s", err.Error())
+		return nil, err
+	}
+
+	signedYAMLs := [][]byte{}
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifestBytes) {
+		signedYAML, err := embedAnnotations(item, annotations)
+		if err != nil {
+			log.Errorf("Error in embedding signature: %s", err.Error())
+			return nil, err
+		}
+		signedYAMLs = append(signedYAMLs, signedYAML)
+	}
+	if len(signedYAMLs) == 0 {
+		return nil, fmt.Errorf("no resource found in manifest %s", manifestPath)
+	}
+
+	signedBytes := k8smnfutil.ConcatenateYAMLs(signedYAMLs)
+	err = ioutil.WriteFile(signedManifestPath, signedBytes, 0644)
+	if err != nil {
+		log.Errorf("Error in writing signed manifest: %s", err.Error())
+		return nil, err
+	}
 	return signedBytes, nil
 }
+
+func embedAnnotations(yamlBytes []byte, annotations map[string]interface{}) ([]byte, error) {
+	orgNode, err := mapnode.NewFromYamlBytes(yamlBytes)
+	if err != nil {
+		return nil, err
+	}
+	annotationNode, err := mapnode.NewFromMap(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	embedNode, err := orgNode.Merge(annotationNode)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(embedNode.ToYaml()), nil
+}
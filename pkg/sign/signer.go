@@ -0,0 +1,251 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/kms"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signer signs the manifests and attestations with a key that may be held
+// outside of the controller, e.g. by a KMS
+type Signer interface {
+	// Sign returns the signature of the SHA-256 digest of payload, or of payload
+	// itself for Ed25519 keys
+	Sign(payload []byte) ([]byte, error)
+	// PublicKey returns the PEM encoded public key of the signing key
+	PublicKey() ([]byte, error)
+}
+
+// CertificateSigner is a Signer whose key is certified by a CA, so that signatures
+// are verified with the certificate chain instead of a public key distributed beforehand
+type CertificateSigner interface {
+	Signer
+	// SignWithCertificate returns the signature of payload and the PEM encoded certificate
+	// of the key that made it followed by its chain
+	SignWithCertificate(payload []byte) ([]byte, []byte, error)
+}
+
+var (
+	signerInstance     Signer
+	attestationSigners []Signer
+	signerMutex        sync.Mutex
+)
+
+// GetSigner returns the signer of the key configured by SIGNING_KEY_REF
+func GetSigner() (Signer, error) {
+	signerMutex.Lock()
+	defer signerMutex.Unlock()
+
+	if signerInstance == nil {
+		interlaceConfig, err := config.GetInterlaceConfig()
+		if err != nil {
+			log.Errorf("Error in loading config: %s", err.Error())
+			return nil, err
+		}
+
+		signer, err := NewSigner(interlaceConfig.SigningKeyRef)
+		if err != nil {
+			log.Errorf("Error in loading signing key %s: %s", interlaceConfig.SigningKeyRef, err.Error())
+			return nil, err
+		}
+
+		// Key files are checked at config load, keys held by Vault or a KMS once loaded
+		err = checkECDSASigner(signer)
+		if err != nil {
+			log.Errorf("Signing key %s cannot sign manifests: %s", interlaceConfig.SigningKeyRef, err.Error())
+			return nil, err
+		}
+		signerInstance = signer
+	}
+	return signerInstance, nil
+}
+
+// GetAttestationSigners returns the signers of the keys configured by ATTESTATION_KEY_REFS,
+// each of which adds a signature to the DSSE envelope of the attestation
+func GetAttestationSigners() ([]Signer, error) {
+
+	signer, err := GetSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	signerMutex.Lock()
+	defer signerMutex.Unlock()
+
+	if attestationSigners == nil {
+		interlaceConfig, err := config.GetInterlaceConfig()
+		if err != nil {
+			log.Errorf("Error in loading config: %s", err.Error())
+			return nil, err
+		}
+
+		signers := []Signer{}
+		for _, keyRef := range interlaceConfig.AttestationKeyRefs {
+			// Share the signer of SIGNING_KEY_REF, e.g. the ephemeral key in keyless mode
+			if keyRef == interlaceConfig.SigningKeyRef {
+				signers = append(signers, signer)
+				continue
+			}
+
+			attestationSigner, err := NewSigner(keyRef)
+			if err != nil {
+				log.Errorf("Error in loading attestation signing key %s: %s", keyRef, err.Error())
+				return nil, err
+			}
+			signers = append(signers, attestationSigner)
+		}
+		attestationSigners = signers
+	}
+	return attestationSigners, nil
+}
+
+// NewSigner returns the signer for keyRef, which is one of
+//
+//	keyless    ephemeral key certified by Fulcio for the OIDC token in OIDC_TOKEN_PATH
+//	vault-transit://[<mount>/]<key>    key in a Vault transit secrets engine
+//	awskms://, gcpkms://, azurekms://, hashivault://    KMS URI supported by sigstore
+//	<path>    encrypted cosign private key file, decrypted with COSIGN_PASSWORD
+func NewSigner(keyRef string) (Signer, error) {
+
+	if keyRef == KeylessKeyRef {
+		return NewKeylessSigner()
+	}
+
+	if strings.HasPrefix(keyRef, VaultTransitKeyRefPrefix) {
+		return NewVaultTransitSigner(keyRef)
+	}
+
+	for prefix := range kms.ProvidersMux().Providers() {
+		if strings.HasPrefix(keyRef, prefix) {
+			signerVerifier, err := kms.Get(context.Background(), keyRef, crypto.SHA256)
+			if err != nil {
+				return nil, err
+			}
+			return &sigstoreSigner{signerVerifier: signerVerifier}, nil
+		}
+	}
+
+	return NewKeyFileSigner(keyRef)
+}
+
+// checkECDSASigner returns an error when the key of the signer is not an ECDSA key,
+// the only one supported by the cosign format of signed manifests
+func checkECDSASigner(signer Signer) error {
+
+	pubKey, err := signer.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := pub.(*ecdsa.PublicKey); !ok {
+		return fmt.Errorf("only ECDSA keys are supported, got %T", pub)
+	}
+	return nil
+}
+
+// SignWithCertificate signs payload and returns the signature with the certificate
+// chain of the signing key, which is nil when signatures are verified with a public key
+func SignWithCertificate(signer Signer, payload []byte) ([]byte, []byte, error) {
+	if certSigner, ok := signer.(CertificateSigner); ok {
+		return certSigner.SignWithCertificate(payload)
+	}
+	sig, err := signer.Sign(payload)
+	return sig, nil, err
+}
+
+// NewKeyFileSigner returns the signer of a private key file: an encrypted cosign key,
+// decrypted with COSIGN_PASSWORD, or an unencrypted PKCS#8 key. ECDSA, RSA and
+// Ed25519 keys are supported, RSA keys sign with RSA_SIGNATURE_SCHEME.
+func NewKeyFileSigner(keyPath string) (Signer, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := ioutil.ReadFile(filepath.Clean(keyPath))
+	if err != nil {
+		return nil, err
+	}
+
+	passFunc := func(bool) ([]byte, error) {
+		return []byte(interlaceConfig.CosignPassword), nil
+	}
+
+	priv, err := cryptoutils.UnmarshalPEMToPrivateKey(keyBytes, passFunc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key, check COSIGN_PASSWORD for an encrypted key: %s", err.Error())
+	}
+
+	var signerVerifier signature.SignerVerifier
+	switch key := priv.(type) {
+	case *ecdsa.PrivateKey:
+		signerVerifier, err = signature.LoadECDSASignerVerifier(key, crypto.SHA256)
+	case *rsa.PrivateKey:
+		if interlaceConfig.RSASignatureScheme == "pkcs1v15" {
+			signerVerifier, err = signature.LoadRSAPKCS1v15SignerVerifier(key, crypto.SHA256)
+		} else {
+			signerVerifier, err = signature.LoadRSAPSSSignerVerifier(key, crypto.SHA256, nil)
+		}
+	case ed25519.PrivateKey:
+		signerVerifier, err = signature.LoadED25519SignerVerifier(key)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T in %s", priv, keyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sigstoreSigner{signerVerifier: signerVerifier}, nil
+}
+
+// sigstoreSigner signs with a sigstore signer, backed by a key file or a KMS
+type sigstoreSigner struct {
+	signerVerifier signature.SignerVerifier
+}
+
+func (s *sigstoreSigner) Sign(payload []byte) ([]byte, error) {
+	return s.signerVerifier.SignMessage(bytes.NewReader(payload))
+}
+
+func (s *sigstoreSigner) PublicKey() ([]byte, error) {
+	pub, err := s.signerVerifier.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return cryptoutils.MarshalPublicKeyToPEM(pub)
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+)
+
+const (
+	VaultTransitKeyRefPrefix = "vault-transit://"
+	defaultVaultTransitMount = "transit"
+	vaultSignaturePrefix     = "vault:v"
+)
+
+// VaultTransitSigner signs with a key that never leaves a Vault transit secrets engine
+type VaultTransitSigner struct {
+	addr       string
+	token      string
+	mount      string
+	keyName    string
+	httpClient *http.Client
+}
+
+type vaultSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+type vaultKeyResponse struct {
+	Data struct {
+		LatestVersion int `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultTransitSigner returns the signer for a reference like vault-transit://[<mount>/]<key>.
+// The Vault server and token are read from VAULT_ADDR and VAULT_TOKEN.
+func NewVaultTransitSigner(keyRef string) (*VaultTransitSigner, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPath := strings.Trim(strings.TrimPrefix(keyRef, VaultTransitKeyRefPrefix), "/")
+	if keyPath == "" {
+		return nil, fmt.Errorf("key name is missing in %s", keyRef)
+	}
+
+	mount := defaultVaultTransitMount
+	keyName := keyPath
+	if i := strings.LastIndex(keyPath, "/"); i >= 0 {
+		mount = keyPath[:i]
+		keyName = keyPath[i+1:]
+	}
+
+	return &VaultTransitSigner{
+		addr:       interlaceConfig.VaultAddr,
+		token:      interlaceConfig.VaultToken,
+		mount:      mount,
+		keyName:    keyName,
+		httpClient: utils.NewHTTPClient(30 * time.Second),
+	}, nil
+}
+
+func (s *VaultTransitSigner) Sign(payload []byte) ([]byte, error) {
+
+	body := map[string]interface{}{
+		"input":          base64.StdEncoding.EncodeToString(payload),
+		"hash_algorithm": "sha2-256",
+	}
+
+	var resp vaultSignResponse
+	err := s.request(http.MethodPost, fmt.Sprintf("%s/sign/%s", s.mount, s.keyName), body, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is formatted as vault:v<key version>:<base64 signature>
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(resp.Data.Signature, vaultSignaturePrefix) {
+		return nil, fmt.Errorf("unexpected signature format from vault transit key %s", s.keyName)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+func (s *VaultTransitSigner) PublicKey() ([]byte, error) {
+
+	var resp vaultKeyResponse
+	err := s.request(http.MethodGet, fmt.Sprintf("%s/keys/%s", s.mount, s.keyName), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := resp.Data.Keys[strconv.Itoa(resp.Data.LatestVersion)]
+	if !ok || key.PublicKey == "" {
+		return nil, fmt.Errorf("public key of vault transit key %s not found", s.keyName)
+	}
+	return []byte(key.PublicKey), nil
+}
+
+func (s *VaultTransitSigner) request(method, path string, body interface{}, out interface{}) error {
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", s.addr, path), bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned %s for %s: %s", resp.Status, path, strings.TrimSpace(string(respBody)))
+	}
+
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,185 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+const testVaultToken = "s.test-token"
+
+// fakeVaultTransit serves the sign and keys endpoints of a transit engine for one ECDSA key
+func fakeVaultTransit(t *testing.T, mount, keyName string, priv *ecdsa.PrivateKey) *httptest.Server {
+
+	pubPEM, err := cryptoutils.MarshalPublicKeyToPEM(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/v1/%s/sign/%s", mount, keyName), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Input         string `json:"input"`
+			HashAlgorithm string `json:"hash_algorithm"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.HashAlgorithm != "sha2-256" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		input, err := base64.StdEncoding.DecodeString(req.Input)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h := sha256.Sum256(input)
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"signature":"vault:v1:%s"}}`, base64.StdEncoding.EncodeToString(sig))
+	})
+	mux.HandleFunc(fmt.Sprintf("/v1/%s/keys/%s", mount, keyName), func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]interface{}{
+			"data": map[string]interface{}{
+				"latest_version": 1,
+				"keys": map[string]interface{}{
+					"1": map[string]string{"public_key": string(pubPEM)},
+				},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+func newTestVaultTransitSigner(addr, token, mount, keyName string) *VaultTransitSigner {
+	return &VaultTransitSigner{
+		addr:       addr,
+		token:      token,
+		mount:      mount,
+		keyName:    keyName,
+		httpClient: http.DefaultClient,
+	}
+}
+
+func TestVaultTransitSigner(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakeVaultTransit(t, "transit", "interlace", priv)
+	defer server.Close()
+
+	signer := newTestVaultTransitSigner(server.URL, testVaultToken, "transit", "interlace")
+
+	payload := []byte("manifest")
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	h := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(&priv.PublicKey, h[:], sig) {
+		t.Error("Sign() returned a signature that does not verify with the transit key")
+	}
+
+	pubKey, err := signer.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() error = %v", err)
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(pubKey)
+	if err != nil {
+		t.Fatalf("PublicKey() returned invalid PEM: %v", err)
+	}
+	if !priv.PublicKey.Equal(pub) {
+		t.Error("PublicKey() does not return the public key of the transit key")
+	}
+
+	if err := checkECDSASigner(signer); err != nil {
+		t.Errorf("checkECDSASigner() error = %v", err)
+	}
+}
+
+func TestVaultTransitSignerErrors(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakeVaultTransit(t, "secrets/transit", "interlace", priv)
+	defer server.Close()
+
+	denied := newTestVaultTransitSigner(server.URL, "s.other-token", "secrets/transit", "interlace")
+	if _, err := denied.Sign([]byte("manifest")); err == nil {
+		t.Error("Sign() with a denied token succeeded")
+	}
+
+	unknownKey := newTestVaultTransitSigner(server.URL, testVaultToken, "secrets/transit", "other")
+	if _, err := unknownKey.PublicKey(); err == nil {
+		t.Error("PublicKey() of an unknown key succeeded")
+	}
+}
+
+func TestVaultTransitSignerVerifiesTLS(t *testing.T) {
+	tokenSent := false
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenSent = tokenSent || r.Header.Get("X-Vault-Token") != ""
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	// Querying the Argo CD API disables verification on the default transport
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	defaultTLSConfig := defaultTransport.TLSClientConfig
+	_, _ = utils.QueryAPI(server.URL, http.MethodGet, "", nil)
+	defer func() { defaultTransport.TLSClientConfig = defaultTLSConfig }()
+
+	signer := newTestVaultTransitSigner(server.URL, testVaultToken, "transit", "interlace")
+	signer.httpClient = utils.NewHTTPClient(30 * time.Second)
+
+	if _, err := signer.Sign([]byte("manifest")); err == nil {
+		t.Error("Sign() succeeded against a server with an untrusted certificate")
+	}
+	if tokenSent {
+		t.Error("Sign() sent the token to a server with an untrusted certificate")
+	}
+}
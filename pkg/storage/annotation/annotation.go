@@ -17,20 +17,21 @@
 package annotation
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
 	"github.com/IBM/argocd-interlace/pkg/config"
-	helmprov "github.com/IBM/argocd-interlace/pkg/provenance/helm"
-	kustprov "github.com/IBM/argocd-interlace/pkg/provenance/kustomize"
-	"github.com/IBM/argocd-interlace/pkg/sign"
 	"github.com/IBM/argocd-interlace/pkg/utils"
 	"github.com/ghodss/yaml"
 	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
@@ -48,20 +49,108 @@ func NewStorageBackend(appData application.ApplicationData) (*StorageBackend, er
 	}, nil
 }
 
+// GetLatestManifestContent reconstructs the last signed manifest from the message
+// attached to the signature resource in the cluster. It returns nil when the
+// signature resource has not been signed yet.
 func (s StorageBackend) GetLatestManifestContent() ([]byte, error) {
-	return nil, nil
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	// Retrive the live state of managed resources via argocd API call
+	managedResources, err := utils.RetriveDesiredManifest(s.appData.AppName)
+	if err != nil {
+		log.Errorf("Error in retriving managed resources : %s", err.Error())
+		return nil, err
+	}
+
+	return signedManifestInResources(s.appData.AppName, managedResources, interlaceConfig.SignatureResourceLabel)
+}
+
+// signedManifestInResources returns the manifest packed into the message of the resource
+// labelled with signatureResourceLabel among the managed resources returned by the Argo CD
+// API, or nil when the signature resource has not been signed yet.
+func signedManifestInResources(appName, managedResources, signatureResourceLabel string) ([]byte, error) {
+
+	items := gjson.Get(managedResources, "items")
+
+	for _, item := range items.Array() {
+
+		liveState := gjson.Get(item.String(), "liveState").String()
+		if liveState == "" || liveState == "null" {
+			continue
+		}
+
+		var obj unstructured.Unstructured
+		err := json.Unmarshal([]byte(liveState), &obj.Object)
+		if err != nil {
+			log.Errorf("Error unmarshling live state: %s", err.Error())
+			continue
+		}
+
+		isSignatureresource := false
+		if rscLabel, ok := obj.GetLabels()[signatureResourceLabel]; ok {
+			isSignatureresource, _ = strconv.ParseBool(rscLabel)
+		}
+		if !isSignatureresource {
+			continue
+		}
+
+		message := ""
+		if obj.GetKind() == "ConfigMap" {
+			message, _, _ = unstructured.NestedString(obj.Object, "data", "message")
+		} else {
+			message = obj.GetAnnotations()[utils.MSG_ANNOTATION_NAME]
+		}
+
+		if message == "" || message == "null" {
+			log.Infof("[INFO][%s] Signature resource %s has no signed message yet", appName, obj.GetName())
+			return nil, nil
+		}
+
+		manifestBytes, err := decodeMessage(message)
+		if err != nil {
+			log.Errorf("Error in decoding message of signature resource %s: %s", obj.GetName(), err.Error())
+			return nil, err
+		}
+
+		log.Infof("[INFO][%s] Interlace retrieved previous manifest from signature resource %s", appName, obj.GetName())
+
+		return manifestBytes, nil
+	}
+
+	return nil, fmt.Errorf("Could not find signature resource with label %s in application %s", signatureResourceLabel, appName)
+}
+
+// decodeMessage returns the manifest packed into a message annotation,
+// which is a base64 encoded gzip of the tar.gz archive of manifest.yaml
+func decodeMessage(message string) ([]byte, error) {
+
+	gzipMsg, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+
+	gzipTarBall := k8smnfutil.GzipDecompress(gzipMsg)
+
+	yamls, err := k8smnfutil.GetYAMLsInArtifact(gzipTarBall)
+	if err != nil {
+		return nil, err
+	}
+
+	return k8smnfutil.ConcatenateYAMLs(yamls), nil
 }
 
 func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
 
-	keyPath := utils.PRIVATE_KEY_PATH
-	manifestPath := filepath.Join(s.appData.AppDirPath, utils.MANIFEST_FILE_NAME)
 	signedManifestPath := filepath.Join(s.appData.AppDirPath, utils.SIGNED_MANIFEST_FILE_NAME)
 
-	signedBytes, err := sign.SignManifest(keyPath, manifestPath, signedManifestPath)
-
+	signedBytes, err := ioutil.ReadFile(filepath.Clean(signedManifestPath))
 	if err != nil {
-		log.Errorf("Error in signing manifest: %s", err.Error())
+		log.Errorf("Error in reading signed manifest: %s", err.Error())
 		return err
 	}
 
@@ -103,12 +192,14 @@ func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
 
 			message := "null"
 			signature := "null"
+			certificate := ""
 			if sourceVerifed {
 				message = annotations[utils.MSG_ANNOTATION_NAME]
 				signature = annotations[utils.SIG_ANNOTATION_NAME]
+				certificate = annotations[utils.CERT_ANNOTATION_NAME]
 			}
 
-			patchData, err := preparePatch(message, signature, kind)
+			patchData, err := preparePatch(message, signature, certificate, kind)
 			if err != nil {
 				log.Errorf("Error in creating patch for application resource config: %s", err.Error())
 				return err
@@ -136,7 +227,9 @@ func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
 	return nil
 }
 
-func preparePatch(message, signature, kind string) ([]string, error) {
+// preparePatch returns the patches setting the message and signature on the signature
+// resource, and the certificate chain when the manifest was signed in keyless mode
+func preparePatch(message, signature, certificate, kind string) ([]string, error) {
 
 	var patchData []string
 	if kind == "ConfigMap" {
@@ -147,6 +240,11 @@ func preparePatch(message, signature, kind string) ([]string, error) {
 		patchMsg := fmt.Sprintf("{\"%s\": {\"%s\": \"%s\"}}",
 			"data", "message", message)
 		patchData = append(patchData, patchMsg)
+		if certificate != "" {
+			patchCert := fmt.Sprintf("{\"%s\": {\"%s\": \"%s\"}}",
+				"data", "certificate", certificate)
+			patchData = append(patchData, patchCert)
+		}
 	} else {
 		sigAnnot := utils.SIG_ANNOTATION_NAME
 		patchSig := fmt.Sprintf("{\"%s\": { \"%s\" : {\"%s\": \"%s\"}}}",
@@ -158,34 +256,109 @@ func preparePatch(message, signature, kind string) ([]string, error) {
 			"metadata", "annotations", msgAnnot, message)
 
 		patchData = append(patchData, patchMsg)
+
+		if certificate != "" {
+			certAnnot := utils.CERT_ANNOTATION_NAME
+			patchCert := fmt.Sprintf("{\"%s\": { \"%s\" : {\"%s\": \"%s\"}}}",
+				"metadata", "annotations", certAnnot, certificate)
+			patchData = append(patchData, patchCert)
+		}
 	}
 
 	return patchData, nil
 }
 
-func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time) error {
+// StoreSourceVerification does nothing, the signature resource is only
+// annotated with the signature of verified sources in StoreManifestBundle
+func (s StorageBackend) StoreSourceVerification(verification application.SourceVerification) error {
+	return nil
+}
+
+func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
 	manifestPath := filepath.Join(s.appData.AppDirPath, utils.MANIFEST_FILE_NAME)
-	computedFileHash, err := utils.ComputeHash(manifestPath)
+	err := s.attachRekorEntry(manifestPath)
+	if err != nil {
+		log.Errorf("Error in attaching transparency log entry: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
 
-	if s.appData.IsHelm {
-		prov, _ := helmprov.NewProvenance(s.appData)
-		err = prov.GenerateProvanance(manifestPath, computedFileHash, true, buildStartedOn, buildFinishedOn)
+// attachRekorEntry patches the signature resource with the transparency log entry
+// of the attestation, so that a verifier does not need to search Rekor for it.
+func (s StorageBackend) attachRekorEntry(manifestPath string) error {
 
-		if err != nil {
-			log.Errorf("Error in storing provenance: %s", err.Error())
-			return err
+	rekorEntryPath := filepath.Join(s.appData.AppDirPath, utils.REKOR_ENTRY_FILE_NAME)
+	if !utils.FileExist(rekorEntryPath) {
+		return nil
+	}
+
+	rekorEntryBytes, err := ioutil.ReadFile(filepath.Clean(rekorEntryPath))
+	if err != nil {
+		return err
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		return err
+	}
+
+	obj, err := findSignatureResource(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		log.Infof("[INFO][%s] No signature resource found, transparency log entry is not attached", s.appData.AppName)
+		return nil
+	}
+
+	var patch map[string]interface{}
+	if obj.GetKind() == "ConfigMap" {
+		patch = map[string]interface{}{
+			"data": map[string]string{"rekorEntry": string(rekorEntryBytes)},
 		}
 	} else {
-		prov, _ := kustprov.NewProvenance(s.appData)
-		err = prov.GenerateProvanance(manifestPath, computedFileHash, true, buildStartedOn, buildFinishedOn)
+		patch = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{utils.REKOR_ANNOTATION_NAME: string(rekorEntryBytes)},
+			},
+		}
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("[INFO][%s] Interlace attaches transparency log entry to resource as annotation", s.appData.AppName)
+
+	return utils.ApplyResourcePatch(obj.GetKind(), obj.GetName(), obj.GetNamespace(), s.appData.AppName, []string{string(patchBytes)})
+}
+
+// findSignatureResource returns the resource labelled as the signature resource
+// in the manifest, or nil when there is none.
+func findSignatureResource(manifestBytes []byte) (*unstructured.Unstructured, error) {
 
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifestBytes) {
+		var obj unstructured.Unstructured
+		err := yaml.Unmarshal(item, &obj)
 		if err != nil {
-			log.Errorf("Error in storing provenance: %s", err.Error())
-			return err
+			return nil, err
 		}
-	}
 
-	return nil
+		if rscLabel, ok := obj.GetLabels()[interlaceConfig.SignatureResourceLabel]; ok {
+			if isSignatureresource, _ := strconv.ParseBool(rscLabel); isSignatureresource {
+				return &obj, nil
+			}
+		}
+	}
+	return nil, nil
 }
 
 func (b *StorageBackend) Type() string {
@@ -0,0 +1,193 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package annotation
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+)
+
+const (
+	testSignatureLabel = "interlace.dev/signature-resource"
+	testManifest       = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+`
+)
+
+// encodeMessage packs the manifest into a message as SignManifest does
+func encodeMessage(t *testing.T, manifest string) string {
+	manifestPath := filepath.Join(t.TempDir(), utils.MANIFEST_FILE_NAME)
+	err := ioutil.WriteFile(manifestPath, []byte(manifest), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = k8smnfutil.TarGzCompress(manifestPath, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress(buf.Bytes()))
+}
+
+// managedResources returns a response of the managed-resources endpoint of the Argo CD API
+func managedResources(t *testing.T, liveStates ...map[string]interface{}) string {
+	items := []map[string]interface{}{}
+	for _, liveState := range liveStates {
+		item := map[string]interface{}{"liveState": "null"}
+		if liveState != nil {
+			b, _ := json.Marshal(liveState)
+			item["liveState"] = string(b)
+		}
+		items = append(items, item)
+	}
+	b, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// sameYAML reports whether the YAML documents hold the same objects, whatever their key order
+func sameYAML(t *testing.T, a, b []byte) bool {
+	var objA, objB interface{}
+	if err := yaml.Unmarshal(a, &objA); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(b, &objB); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(objA, objB)
+}
+
+func signatureConfigMap(label, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":   "app-signature",
+			"labels": map[string]interface{}{testSignatureLabel: label},
+		},
+		"data": map[string]interface{}{"message": message, "signature": "c2ln"},
+	}
+}
+
+func signatureDeployment(message string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":        "app",
+			"labels":      map[string]interface{}{testSignatureLabel: "true"},
+			"annotations": map[string]interface{}{utils.MSG_ANNOTATION_NAME: message},
+		},
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		wantErr bool
+	}{
+		{"signed manifest", encodeMessage(t, testManifest), testManifest, false},
+		{"not base64", "not a message!", "", true},
+		{"raw manifest", base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress([]byte(testManifest))), testManifest, false},
+		{"empty message", base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress([]byte{})), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeMessage(tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !sameYAML(t, got, []byte(tt.want)) {
+				t.Errorf("decodeMessage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedManifestInResources(t *testing.T) {
+	message := encodeMessage(t, testManifest)
+	service := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "app"},
+	}
+
+	tests := []struct {
+		name             string
+		managedResources string
+		want             string
+		wantErr          bool
+	}{
+		{
+			name:             "ConfigMap signature resource",
+			managedResources: managedResources(t, nil, service, signatureConfigMap("true", message)),
+			want:             testManifest,
+		},
+		{
+			name:             "annotated signature resource",
+			managedResources: managedResources(t, service, signatureDeployment(message)),
+			want:             testManifest,
+		},
+		{
+			name:             "not signed yet",
+			managedResources: managedResources(t, signatureConfigMap("true", "null")),
+		},
+		{
+			name:             "signature label false",
+			managedResources: managedResources(t, signatureConfigMap("false", message)),
+			wantErr:          true,
+		},
+		{
+			name:             "no signature resource",
+			managedResources: managedResources(t, service),
+			wantErr:          true,
+		},
+		{
+			name:             "invalid message",
+			managedResources: managedResources(t, signatureDeployment("not a message!")),
+			wantErr:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := signedManifestInResources("app", tt.managedResources, testSignatureLabel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("signedManifestInResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (tt.want == "" && got != nil) || (tt.want != "" && !sameYAML(t, got, []byte(tt.want))) {
+				t.Errorf("signedManifestInResources() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
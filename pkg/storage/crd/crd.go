@@ -0,0 +1,371 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crd
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	mprovv1beta1 "github.com/IBM/argocd-interlace/pkg/apis/manifestprovenance/v1beta1"
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/go-openapi/swag"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	log "github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	StorageBackendCRD = "crd"
+)
+
+var applicationGVR = schema.GroupVersionResource{
+	Group:    "argoproj.io",
+	Version:  "v1alpha1",
+	Resource: "applications",
+}
+
+type StorageBackend struct {
+	appData       application.ApplicationData
+	namespace     string
+	dynamicClient dynamic.Interface
+}
+
+func NewStorageBackend(appData application.ApplicationData) (*StorageBackend, error) {
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	_, cfg, err := utils.GetClient("")
+	if err != nil {
+		log.Errorf("Error in getting kubernetes client: %s", err.Error())
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		log.Errorf("Error in creating dynamic client: %s", err.Error())
+		return nil, err
+	}
+
+	return &StorageBackend{
+		appData:       appData,
+		namespace:     interlaceConfig.ArgocdNamespace,
+		dynamicClient: dynamicClient,
+	}, nil
+}
+
+// GetLatestManifestContent returns the manifest recorded in the ManifestProvenance
+// of the application, or nil when it does not exist yet.
+func (s StorageBackend) GetLatestManifestContent() ([]byte, error) {
+
+	mprov, err := s.getManifestProvenance()
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			log.Infof("[INFO][%s] ManifestProvenance %s/%s does not exist yet", s.appData.AppName, s.namespace, s.appData.AppName)
+			return nil, nil
+		}
+		log.Errorf("Error in getting ManifestProvenance: %s", err.Error())
+		return nil, err
+	}
+
+	if mprov.Status.Manifest == "" {
+		return nil, nil
+	}
+
+	log.Infof("[INFO][%s] Interlace retrieved previous manifest from ManifestProvenance %s/%s", s.appData.AppName, s.namespace, s.appData.AppName)
+
+	return []byte(mprov.Status.Manifest), nil
+}
+
+func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
+
+	manifestPath := filepath.Join(s.appData.AppDirPath, utils.MANIFEST_FILE_NAME)
+	signedManifestPath := filepath.Join(s.appData.AppDirPath, utils.SIGNED_MANIFEST_FILE_NAME)
+
+	signedBytes, err := ioutil.ReadFile(filepath.Clean(signedManifestPath))
+	if err != nil {
+		log.Errorf("Error in reading signed manifest: %s", err.Error())
+		return err
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		log.Errorf("Error in reading manifest: %s", err.Error())
+		return err
+	}
+
+	manifestDigest, err := utils.ComputeHash(manifestPath)
+	if err != nil {
+		log.Errorf("Error in computing manifest digest: %s", err.Error())
+		return err
+	}
+
+	// Every object in the signed manifest carries the same signature annotation
+	signature := ""
+	signatureCertificate := ""
+	signedYAMLs := k8smnfutil.SplitConcatYAMLs(signedBytes)
+	if len(signedYAMLs) > 0 {
+		annotations := k8smnfutil.GetAnnotationsInYAML(signedYAMLs[0])
+		signature = annotations[utils.SIG_ANNOTATION_NAME]
+
+		// The certificate annotation is the base64 encoded gzip of the PEM chain
+		if encodedCert, ok := annotations[utils.CERT_ANNOTATION_NAME]; ok {
+			gzipCert, err := base64.StdEncoding.DecodeString(encodedCert)
+			if err != nil {
+				log.Errorf("Error in decoding signature certificate: %s", err.Error())
+				return err
+			}
+			signatureCertificate = string(k8smnfutil.GzipDecompress(gzipCert))
+		}
+	}
+
+	err = s.updateStatus(func(status *mprovv1beta1.ManifestProvenanceStatus) {
+		status.CommitSha = s.appData.AppSourceCommitSha
+		status.Revision = s.appData.AppSourceRevision
+		status.ManifestDigest = "sha256:" + manifestDigest
+		status.Manifest = string(manifestBytes)
+		status.Signature = signature
+		status.SignatureCertificate = signatureCertificate
+		status.SourceVerified = sourceVerifed
+	})
+	if err != nil {
+		log.Errorf("Error in storing manifest bundle: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// StoreSourceVerification records the outcome of the source material verification in the
+// status, so that a revision that could not be verified is reported along with its reason.
+func (s StorageBackend) StoreSourceVerification(verification application.SourceVerification) error {
+
+	err := s.updateStatus(func(status *mprovv1beta1.ManifestProvenanceStatus) {
+		status.SourceVerified = verification.Verified
+		status.SourceVerification = &mprovv1beta1.SourceVerification{
+			CommitSha: s.appData.RevisionID(),
+			Verified:  verification.Verified,
+			Method:    verification.Method,
+			Signer:    verification.Signer,
+			Error:     verification.Error,
+		}
+	})
+	if err != nil {
+		log.Errorf("Error in storing source verification: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
+	attestationPath := filepath.Join(s.appData.AppDirPath, utils.ATTESTATION_FILE_NAME)
+	attestationBytes, err := ioutil.ReadFile(filepath.Clean(attestationPath))
+	if err != nil {
+		log.Errorf("Error in reading attestation: %s", err.Error())
+		return err
+	}
+
+	attestationCertificate := ""
+	certPath := filepath.Join(s.appData.AppDirPath, utils.CERTIFICATE_FILE_NAME)
+	if utils.FileExist(certPath) {
+		certBytes, err := ioutil.ReadFile(filepath.Clean(certPath))
+		if err != nil {
+			log.Errorf("Error in reading attestation certificate: %s", err.Error())
+			return err
+		}
+		attestationCertificate = string(certBytes)
+	}
+
+	rekorEntry, err := attestation.ReadRekorEntry(s.appData.AppDirPath)
+	if err != nil {
+		log.Errorf("Error in reading transparency log entry: %s", err.Error())
+		return err
+	}
+
+	err = s.updateStatus(func(status *mprovv1beta1.ManifestProvenanceStatus) {
+		startedOn := metav1.NewTime(buildStartedOn)
+		finishedOn := metav1.NewTime(buildFinishedOn)
+		status.BuildStartedOn = &startedOn
+		status.BuildFinishedOn = &finishedOn
+		status.Attestation = string(attestationBytes)
+		status.AttestationCertificate = attestationCertificate
+		setRekorEntry(status, rekorEntry)
+	})
+	if err != nil {
+		log.Errorf("Error in storing manifest provenance: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *StorageBackend) Type() string {
+	return StorageBackendCRD
+}
+
+// setRekorEntry records the transparency log entry of the attestation in the status,
+// clearing the entry of a previous attestation when none was uploaded.
+func setRekorEntry(status *mprovv1beta1.ManifestProvenanceStatus, rekorEntry *attestation.RekorEntry) {
+
+	status.RekorUUID = ""
+	status.RekorLogIndex = 0
+	status.RekorIntegratedTime = 0
+	status.RekorLogID = ""
+	status.RekorSignedTimestamp = ""
+	status.RekorInclusionProof = nil
+
+	if rekorEntry == nil {
+		return
+	}
+
+	status.RekorUUID = rekorEntry.UUID
+	status.RekorLogIndex = rekorEntry.LogIndex
+	status.RekorIntegratedTime = rekorEntry.IntegratedTime
+	status.RekorLogID = rekorEntry.LogID
+	status.RekorSignedTimestamp = rekorEntry.SignedEntryTimestamp
+
+	proof := rekorEntry.InclusionProof
+	if proof != nil {
+		status.RekorInclusionProof = &mprovv1beta1.RekorInclusionProof{
+			LogIndex: swag.Int64Value(proof.LogIndex),
+			RootHash: swag.StringValue(proof.RootHash),
+			TreeSize: swag.Int64Value(proof.TreeSize),
+			Hashes:   proof.Hashes,
+		}
+	}
+}
+
+func (s StorageBackend) getManifestProvenance() (*mprovv1beta1.ManifestProvenance, error) {
+
+	obj, err := s.dynamicClient.Resource(mprovv1beta1.GroupVersionResource).Namespace(s.namespace).
+		Get(context.TODO(), s.appData.AppName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var mprov mprovv1beta1.ManifestProvenance
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &mprov)
+	if err != nil {
+		return nil, err
+	}
+	return &mprov, nil
+}
+
+// updateStatus applies mutate to the status of the ManifestProvenance of the
+// application, creating the ManifestProvenance first when it does not exist.
+func (s StorageBackend) updateStatus(mutate func(status *mprovv1beta1.ManifestProvenanceStatus)) error {
+
+	client := s.dynamicClient.Resource(mprovv1beta1.GroupVersionResource).Namespace(s.namespace)
+
+	mprov, err := s.getManifestProvenance()
+	if k8serrors.IsNotFound(err) {
+		mprov, err = s.createManifestProvenance()
+	}
+	if err != nil {
+		return err
+	}
+
+	mutate(&mprov.Status)
+	now := metav1.Now()
+	mprov.Status.LastUpdated = &now
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(mprov)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateStatus(context.TODO(), &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("[INFO][%s] Interlace updated ManifestProvenance %s/%s", s.appData.AppName, s.namespace, s.appData.AppName)
+
+	return nil
+}
+
+// createManifestProvenance creates the ManifestProvenance of the application
+// owned by the Application, so that it is garbage collected along with it.
+func (s StorageBackend) createManifestProvenance() (*mprovv1beta1.ManifestProvenance, error) {
+
+	app, err := s.dynamicClient.Resource(applicationGVR).Namespace(s.namespace).
+		Get(context.TODO(), s.appData.AppName, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("Error in getting application %s: %s", s.appData.AppName, err.Error())
+		return nil, err
+	}
+
+	controller := true
+	mprov := &mprovv1beta1.ManifestProvenance{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: mprovv1beta1.GroupName + "/" + mprovv1beta1.Version,
+			Kind:       mprovv1beta1.Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.appData.AppName,
+			Namespace: s.namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: app.GetAPIVersion(),
+					Kind:       app.GetKind(),
+					Name:       app.GetName(),
+					UID:        app.GetUID(),
+					Controller: &controller,
+				},
+			},
+		},
+		Spec: mprovv1beta1.ManifestProvenanceSpec{
+			Application: s.appData.AppName,
+			RepoURL:     s.appData.AppSourceRepoUrl,
+			Path:        s.appData.AppPath,
+			Chart:       s.appData.Chart,
+		},
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(mprov)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := s.dynamicClient.Resource(mprovv1beta1.GroupVersionResource).Namespace(s.namespace).
+		Create(context.TODO(), &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		log.Errorf("Error in creating ManifestProvenance: %s", err.Error())
+		return nil, err
+	}
+
+	var createdMprov mprovv1beta1.ManifestProvenance
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(created.Object, &createdMprov)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("[INFO][%s] Interlace created ManifestProvenance %s/%s", s.appData.AppName, s.namespace, s.appData.AppName)
+
+	return &createdMprov, nil
+}
@@ -0,0 +1,321 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	mprovv1beta1 "github.com/IBM/argocd-interlace/pkg/apis/manifestprovenance/v1beta1"
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/go-openapi/swag"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	"github.com/sigstore/rekor/pkg/generated/models"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const (
+	testNamespace = "argocd"
+	testAppName   = "guestbook"
+	testAppUID    = "9a3e5c1f-0000-4000-8000-000000000001"
+)
+
+// newTestStorageBackend returns a storage backend of a fake cluster, with the
+// Application of the test when withApplication is set
+func newTestStorageBackend(t *testing.T, withApplication bool) StorageBackend {
+	objects := []runtime.Object{}
+	if withApplication {
+		app := &unstructured.Unstructured{}
+		app.SetAPIVersion("argoproj.io/v1alpha1")
+		app.SetKind("Application")
+		app.SetNamespace(testNamespace)
+		app.SetName(testAppName)
+		app.SetUID(types.UID(testAppUID))
+		objects = append(objects, app)
+	}
+
+	listKinds := map[schema.GroupVersionResource]string{
+		applicationGVR:                    "ApplicationList",
+		mprovv1beta1.GroupVersionResource: "ManifestProvenanceList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+
+	return StorageBackend{
+		appData: application.ApplicationData{
+			AppName:            testAppName,
+			AppPath:            "guestbook",
+			AppDirPath:         t.TempDir(),
+			AppSourceRepoUrl:   "https://github.com/example/apps.git",
+			AppSourceRevision:  "main",
+			AppSourceCommitSha: "9c3b4e5bb4ee5ed1ec9df2ee8e51e4b7cd9c66b1",
+		},
+		namespace:     testNamespace,
+		dynamicClient: dynamicClient,
+	}
+}
+
+func writeFile(t *testing.T, dir, fileName, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, fileName), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreSourceVerification(t *testing.T) {
+	tests := []struct {
+		name         string
+		verification application.SourceVerification
+	}{
+		{
+			name: "verified",
+			verification: application.SourceVerification{
+				Verified: true,
+				Method:   "git-signature",
+				Signer:   "Alice <alice@example.com> (gpg key 0123ABCD)",
+			},
+		},
+		{
+			name: "not verified",
+			verification: application.SourceVerification{
+				Method: "git-signature",
+				Error:  "The commit 9c3b4e5 of https://github.com/example/apps.git is not signed",
+			},
+		},
+		{
+			name: "verification failed",
+			verification: application.SourceVerification{
+				Method: "helm-sigstore",
+				Error:  "exit status 1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorageBackend(t, true)
+
+			err := s.StoreSourceVerification(tt.verification)
+			if err != nil {
+				t.Fatalf("StoreSourceVerification() error = %v", err)
+			}
+
+			mprov, err := s.getManifestProvenance()
+			if err != nil {
+				t.Fatalf("getManifestProvenance() error = %v", err)
+			}
+
+			want := &mprovv1beta1.SourceVerification{
+				CommitSha: s.appData.AppSourceCommitSha,
+				Verified:  tt.verification.Verified,
+				Method:    tt.verification.Method,
+				Signer:    tt.verification.Signer,
+				Error:     tt.verification.Error,
+			}
+			if !reflect.DeepEqual(mprov.Status.SourceVerification, want) {
+				t.Errorf("status.sourceVerification = %+v, want %+v", mprov.Status.SourceVerification, want)
+			}
+			if mprov.Status.SourceVerified != tt.verification.Verified {
+				t.Errorf("status.sourceVerified = %v, want %v", mprov.Status.SourceVerified, tt.verification.Verified)
+			}
+
+			// The ManifestProvenance is owned by the Application
+			owners := mprov.GetOwnerReferences()
+			if len(owners) != 1 || owners[0].Kind != "Application" || owners[0].Name != testAppName ||
+				string(owners[0].UID) != testAppUID || !swag.BoolValue(owners[0].Controller) {
+				t.Errorf("owner references = %+v, want the Application", owners)
+			}
+			if mprov.Spec.Application != testAppName || mprov.Spec.RepoURL != s.appData.AppSourceRepoUrl {
+				t.Errorf("spec = %+v", mprov.Spec)
+			}
+		})
+	}
+}
+
+func TestStoreSourceVerificationWithoutApplication(t *testing.T) {
+	s := newTestStorageBackend(t, false)
+
+	err := s.StoreSourceVerification(application.SourceVerification{Verified: true})
+	if err == nil {
+		t.Error("StoreSourceVerification() without Application succeeded")
+	}
+}
+
+func TestStoreManifestBundle(t *testing.T) {
+	s := newTestStorageBackend(t, true)
+
+	manifest, err := s.GetLatestManifestContent()
+	if err != nil || manifest != nil {
+		t.Fatalf("GetLatestManifestContent() = %s, %v, want nothing stored", manifest, err)
+	}
+
+	manifestYAML := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: guestbook\n"
+	certificate := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	encodedCert := base64.StdEncoding.EncodeToString(k8smnfutil.GzipCompress([]byte(certificate)))
+	signedYAML := fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: guestbook\n  annotations:\n    %s: c2lnbmF0dXJl\n    %s: %s\n",
+		utils.SIG_ANNOTATION_NAME, utils.CERT_ANNOTATION_NAME, encodedCert)
+	writeFile(t, s.appData.AppDirPath, utils.MANIFEST_FILE_NAME, manifestYAML)
+	writeFile(t, s.appData.AppDirPath, utils.SIGNED_MANIFEST_FILE_NAME, signedYAML)
+
+	err = s.StoreManifestBundle(true)
+	if err != nil {
+		t.Fatalf("StoreManifestBundle() error = %v", err)
+	}
+
+	mprov, err := s.getManifestProvenance()
+	if err != nil {
+		t.Fatalf("getManifestProvenance() error = %v", err)
+	}
+	manifestDigest, _ := utils.ComputeHash(filepath.Join(s.appData.AppDirPath, utils.MANIFEST_FILE_NAME))
+	status := mprov.Status
+	if status.CommitSha != s.appData.AppSourceCommitSha || status.Revision != "main" ||
+		status.ManifestDigest != "sha256:"+manifestDigest || !status.SourceVerified {
+		t.Errorf("status = %+v", status)
+	}
+	if status.Signature != "c2lnbmF0dXJl" || status.SignatureCertificate != certificate {
+		t.Errorf("status signature = %s, certificate = %s", status.Signature, status.SignatureCertificate)
+	}
+	if status.LastUpdated == nil {
+		t.Error("status.lastUpdated is not set")
+	}
+
+	manifest, err = s.GetLatestManifestContent()
+	if err != nil {
+		t.Fatalf("GetLatestManifestContent() error = %v", err)
+	}
+	if string(manifest) != manifestYAML {
+		t.Errorf("GetLatestManifestContent() = %s, want %s", manifest, manifestYAML)
+	}
+}
+
+func TestStoreManifestProvenance(t *testing.T) {
+	s := newTestStorageBackend(t, true)
+
+	rekorEntry := `{"uuid":"362f8ecba72f4326","logIndex":7,"integratedTime":1634000000,"logID":"c0d23d6a",` +
+		`"inclusionProof":{"logIndex":7,"rootHash":"5be1758d","treeSize":8,"hashes":["a1","b2"]}}`
+	writeFile(t, s.appData.AppDirPath, utils.ATTESTATION_FILE_NAME, "attestation")
+	writeFile(t, s.appData.AppDirPath, utils.REKOR_ENTRY_FILE_NAME, rekorEntry)
+
+	startedOn := time.Date(2021, 10, 12, 1, 0, 0, 0, time.UTC)
+	finishedOn := startedOn.Add(time.Minute)
+	err := s.StoreManifestProvenance(startedOn, finishedOn, true)
+	if err != nil {
+		t.Fatalf("StoreManifestProvenance() error = %v", err)
+	}
+
+	mprov, err := s.getManifestProvenance()
+	if err != nil {
+		t.Fatalf("getManifestProvenance() error = %v", err)
+	}
+	status := mprov.Status
+	if status.Attestation != "attestation" || status.AttestationCertificate != "" {
+		t.Errorf("status attestation = %s, certificate = %s", status.Attestation, status.AttestationCertificate)
+	}
+	if !status.BuildStartedOn.Time.Equal(startedOn) || !status.BuildFinishedOn.Time.Equal(finishedOn) {
+		t.Errorf("status build = %v - %v, want %v - %v", status.BuildStartedOn, status.BuildFinishedOn, startedOn, finishedOn)
+	}
+	if status.RekorUUID != "362f8ecba72f4326" || status.RekorInclusionProof == nil || status.RekorInclusionProof.TreeSize != 8 {
+		t.Errorf("status rekor entry = %s %+v", status.RekorUUID, status.RekorInclusionProof)
+	}
+}
+
+func TestSetRekorEntry(t *testing.T) {
+	previous := mprovv1beta1.ManifestProvenanceStatus{
+		RekorUUID:            "previous",
+		RekorLogIndex:        1,
+		RekorIntegratedTime:  1,
+		RekorLogID:           "previous",
+		RekorSignedTimestamp: "previous",
+		RekorInclusionProof:  &mprovv1beta1.RekorInclusionProof{LogIndex: 1},
+	}
+
+	tests := []struct {
+		name       string
+		rekorEntry *attestation.RekorEntry
+		want       mprovv1beta1.ManifestProvenanceStatus
+	}{
+		{
+			name:       "no entry clears the previous one",
+			rekorEntry: nil,
+			want:       mprovv1beta1.ManifestProvenanceStatus{},
+		},
+		{
+			name: "entry without inclusion proof",
+			rekorEntry: &attestation.RekorEntry{
+				UUID:                 "362f8ecba72f4326",
+				LogIndex:             7,
+				IntegratedTime:       1634000000,
+				LogID:                "c0d23d6a",
+				SignedEntryTimestamp: "MEUCIQ==",
+			},
+			want: mprovv1beta1.ManifestProvenanceStatus{
+				RekorUUID:            "362f8ecba72f4326",
+				RekorLogIndex:        7,
+				RekorIntegratedTime:  1634000000,
+				RekorLogID:           "c0d23d6a",
+				RekorSignedTimestamp: "MEUCIQ==",
+			},
+		},
+		{
+			name: "entry with inclusion proof",
+			rekorEntry: &attestation.RekorEntry{
+				UUID:           "362f8ecba72f4326",
+				LogIndex:       7,
+				IntegratedTime: 1634000000,
+				LogID:          "c0d23d6a",
+				InclusionProof: &models.InclusionProof{
+					LogIndex: swag.Int64(7),
+					RootHash: swag.String("5be1758d"),
+					TreeSize: swag.Int64(8),
+					Hashes:   []string{"a1", "b2"},
+				},
+			},
+			want: mprovv1beta1.ManifestProvenanceStatus{
+				RekorUUID:           "362f8ecba72f4326",
+				RekorLogIndex:       7,
+				RekorIntegratedTime: 1634000000,
+				RekorLogID:          "c0d23d6a",
+				RekorInclusionProof: &mprovv1beta1.RekorInclusionProof{
+					LogIndex: 7,
+					RootHash: "5be1758d",
+					TreeSize: 8,
+					Hashes:   []string{"a1", "b2"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := previous
+			setRekorEntry(&status, tt.rekorEntry)
+			if !reflect.DeepEqual(status, tt.want) {
+				t.Errorf("setRekorEntry() = %+v, want %+v", status, tt.want)
+			}
+		})
+	}
+}
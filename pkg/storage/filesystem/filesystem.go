@@ -0,0 +1,224 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package filesystem
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StorageBackendFilesystem = "filesystem"
+)
+
+// bundleFiles lists the files archived for each revision
+var bundleFiles = []string{
+	utils.MANIFEST_FILE_NAME,
+	utils.SIGNED_MANIFEST_FILE_NAME,
+	utils.PROVENANCE_FILE_NAME,
+	utils.ATTESTATION_FILE_NAME,
+	utils.REKOR_ENTRY_FILE_NAME,
+	utils.CERTIFICATE_FILE_NAME,
+}
+
+type StorageBackend struct {
+	appData    application.ApplicationData
+	storageDir string
+	history    int
+}
+
+func NewStorageBackend(appData application.ApplicationData) (*StorageBackend, error) {
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	return &StorageBackend{
+		appData:    appData,
+		storageDir: interlaceConfig.ManifestStorageDir,
+		history:    interlaceConfig.ManifestStorageHistory,
+	}, nil
+}
+
+// GetLatestManifestContent returns the manifest of the newest revision archived
+// for the application, or nil when nothing has been archived yet.
+func (s StorageBackend) GetLatestManifestContent() ([]byte, error) {
+
+	revisionDirs, err := s.listRevisionDirs()
+	if err != nil {
+		log.Errorf("Error in listing revisions: %s", err.Error())
+		return nil, err
+	}
+
+	if len(revisionDirs) == 0 {
+		log.Infof("[INFO][%s] No archived revision found in %s", s.appData.AppName, s.appDir())
+		return nil, nil
+	}
+
+	manifestPath := filepath.Join(revisionDirs[0], utils.MANIFEST_FILE_NAME)
+	manifestBytes, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		log.Errorf("Error in reading archived manifest %s: %s", manifestPath, err.Error())
+		return nil, err
+	}
+
+	log.Infof("[INFO][%s] Interlace retrieved previous manifest from %s", s.appData.AppName, manifestPath)
+
+	return manifestBytes, nil
+}
+
+// StoreManifestBundle does nothing, the bundle is archived together with
+// the provenance in StoreManifestProvenance
+func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
+	return nil
+}
+
+// StoreSourceVerification does nothing, the bundle is only archived for verified sources
+func (s StorageBackend) StoreSourceVerification(verification application.SourceVerification) error {
+	return nil
+}
+
+func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
+	err := s.archiveBundle()
+	if err != nil {
+		log.Errorf("Error in archiving manifest bundle: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *StorageBackend) Type() string {
+	return StorageBackendFilesystem
+}
+
+func (s StorageBackend) appDir() string {
+	return filepath.Join(s.storageDir, s.appData.AppName)
+}
+
+// archiveBundle copies the bundle files of the current build to
+// <storageDir>/<appName>/<revision>/ and prunes revisions beyond the history limit.
+// The revision is the commit SHA, or the chart version for helm charts without a commit.
+func (s StorageBackend) archiveBundle() error {
+
+	revision := s.appData.RevisionID()
+	if revision == "" {
+		return fmt.Errorf("Revision of application %s is empty, cannot archive manifest bundle", s.appData.AppName)
+	}
+
+	revisionDir := filepath.Join(s.appDir(), revision)
+
+	// Files of an earlier build of the same revision must not be left next to this bundle
+	err := os.RemoveAll(revisionDir)
+	if err != nil {
+		log.Errorf("Error in removing %s: %s", revisionDir, err.Error())
+		return err
+	}
+
+	for _, fileName := range bundleFiles {
+		filePath := filepath.Join(s.appData.AppDirPath, fileName)
+		if !utils.FileExist(filePath) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Clean(filePath))
+		if err != nil {
+			log.Errorf("Error in reading %s: %s", fileName, err.Error())
+			return err
+		}
+
+		err = utils.WriteToFile(string(content), revisionDir, fileName)
+		if err != nil {
+			log.Errorf("Error in archiving %s: %s", fileName, err.Error())
+			return err
+		}
+	}
+
+	// Mark the revision as the newest one even when it only overwrote existing files
+	now := time.Now()
+	err = os.Chtimes(revisionDir, now, now)
+	if err != nil {
+		log.Errorf("Error in updating modification time of %s: %s", revisionDir, err.Error())
+		return err
+	}
+
+	log.Infof("[INFO][%s] Interlace archived manifest bundle to %s", s.appData.AppName, revisionDir)
+
+	return s.pruneRevisions()
+}
+
+// pruneRevisions removes the oldest revisions so that at most history revisions are kept
+func (s StorageBackend) pruneRevisions() error {
+
+	revisionDirs, err := s.listRevisionDirs()
+	if err != nil {
+		log.Errorf("Error in listing revisions: %s", err.Error())
+		return err
+	}
+
+	if len(revisionDirs) <= s.history {
+		return nil
+	}
+
+	for _, revisionDir := range revisionDirs[s.history:] {
+		log.Infof("[INFO][%s] Interlace removes archived revision %s", s.appData.AppName, revisionDir)
+		err := os.RemoveAll(revisionDir)
+		if err != nil {
+			log.Errorf("Error in removing %s: %s", revisionDir, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// listRevisionDirs returns the revision directories of the application, newest first
+func (s StorageBackend) listRevisionDirs() ([]string, error) {
+
+	entries, err := ioutil.ReadDir(s.appDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	revisions := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			revisions = append(revisions, entry)
+		}
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ModTime().After(revisions[j].ModTime())
+	})
+
+	revisionDirs := []string{}
+	for _, revision := range revisions {
+		revisionDirs = append(revisionDirs, filepath.Join(s.appDir(), revision.Name()))
+	}
+	return revisionDirs, nil
+}
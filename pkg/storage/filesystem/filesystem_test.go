@@ -0,0 +1,184 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+)
+
+// build is a build of the application, whose bundle files hold the revision
+type build struct {
+	revision string
+	files    []string
+}
+
+func TestArchiveBundle(t *testing.T) {
+	tests := []struct {
+		name          string
+		isHelm        bool
+		history       int
+		builds        []build
+		wantRevisions []string
+		wantManifest  string
+		wantFiles     []string
+	}{
+		{
+			name:    "prune beyond history",
+			history: 2,
+			builds: []build{
+				{"aaa", []string{utils.MANIFEST_FILE_NAME}},
+				{"bbb", []string{utils.MANIFEST_FILE_NAME}},
+				{"ccc", []string{utils.MANIFEST_FILE_NAME}},
+			},
+			wantRevisions: []string{"ccc", "bbb"},
+			wantManifest:  "ccc",
+			wantFiles:     []string{utils.MANIFEST_FILE_NAME},
+		},
+		{
+			name:    "rebuilt revision becomes the newest",
+			history: 2,
+			builds: []build{
+				{"aaa", []string{utils.MANIFEST_FILE_NAME}},
+				{"bbb", []string{utils.MANIFEST_FILE_NAME}},
+				{"aaa", []string{utils.MANIFEST_FILE_NAME}},
+				{"ccc", []string{utils.MANIFEST_FILE_NAME}},
+			},
+			wantRevisions: []string{"ccc", "aaa"},
+			wantManifest:  "ccc",
+			wantFiles:     []string{utils.MANIFEST_FILE_NAME},
+		},
+		{
+			name:    "rebuilt revision replaces the files of the earlier build",
+			history: 3,
+			builds: []build{
+				{"aaa", []string{utils.MANIFEST_FILE_NAME, utils.ATTESTATION_FILE_NAME, utils.CERTIFICATE_FILE_NAME}},
+				{"aaa", []string{utils.MANIFEST_FILE_NAME, utils.ATTESTATION_FILE_NAME}},
+			},
+			wantRevisions: []string{"aaa"},
+			wantManifest:  "aaa",
+			wantFiles:     []string{utils.ATTESTATION_FILE_NAME, utils.MANIFEST_FILE_NAME},
+		},
+		{
+			name:    "helm chart version as revision",
+			isHelm:  true,
+			history: 3,
+			builds: []build{
+				{"1.0.0", []string{utils.MANIFEST_FILE_NAME, utils.PROVENANCE_FILE_NAME}},
+			},
+			wantRevisions: []string{"1.0.0"},
+			wantManifest:  "1.0.0",
+			wantFiles:     []string{utils.MANIFEST_FILE_NAME, utils.PROVENANCE_FILE_NAME},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageDir := t.TempDir()
+			appDirPath := t.TempDir()
+
+			for _, b := range tt.builds {
+				appData := application.ApplicationData{AppName: "app", AppDirPath: appDirPath, IsHelm: tt.isHelm}
+				if tt.isHelm {
+					appData.AppSourceRevision = b.revision
+				} else {
+					appData.AppSourceCommitSha = b.revision
+				}
+				writeBundle(t, appDirPath, b)
+
+				s := StorageBackend{appData: appData, storageDir: storageDir, history: tt.history}
+				err := s.StoreManifestProvenance(time.Now(), time.Now(), false)
+				if err != nil {
+					t.Fatalf("StoreManifestProvenance() error = %v", err)
+				}
+				// Revisions are ordered by modification time
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			s := StorageBackend{appData: application.ApplicationData{AppName: "app"}, storageDir: storageDir, history: tt.history}
+			revisionDirs, err := s.listRevisionDirs()
+			if err != nil {
+				t.Fatalf("listRevisionDirs() error = %v", err)
+			}
+			revisions := []string{}
+			for _, revisionDir := range revisionDirs {
+				revisions = append(revisions, filepath.Base(revisionDir))
+			}
+			if !reflect.DeepEqual(revisions, tt.wantRevisions) {
+				t.Errorf("archived revisions = %v, want %v", revisions, tt.wantRevisions)
+			}
+
+			manifest, err := s.GetLatestManifestContent()
+			if err != nil {
+				t.Fatalf("GetLatestManifestContent() error = %v", err)
+			}
+			if string(manifest) != tt.wantManifest {
+				t.Errorf("GetLatestManifestContent() = %s, want %s", manifest, tt.wantManifest)
+			}
+
+			files, err := ioutil.ReadDir(revisionDirs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileNames := []string{}
+			for _, file := range files {
+				fileNames = append(fileNames, file.Name())
+			}
+			if !reflect.DeepEqual(fileNames, tt.wantFiles) {
+				t.Errorf("files of newest revision = %v, want %v", fileNames, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestArchiveBundleWithoutRevision(t *testing.T) {
+	appDirPath := t.TempDir()
+	writeBundle(t, appDirPath, build{"", []string{utils.MANIFEST_FILE_NAME}})
+
+	s := StorageBackend{appData: application.ApplicationData{AppName: "app", AppDirPath: appDirPath}, storageDir: t.TempDir(), history: 1}
+	if err := s.StoreManifestProvenance(time.Now(), time.Now(), false); err == nil {
+		t.Error("StoreManifestProvenance() without revision succeeded")
+	}
+}
+
+func TestGetLatestManifestContentEmpty(t *testing.T) {
+	s := StorageBackend{appData: application.ApplicationData{AppName: "app"}, storageDir: t.TempDir(), history: 1}
+	manifest, err := s.GetLatestManifestContent()
+	if err != nil || manifest != nil {
+		t.Errorf("GetLatestManifestContent() = %s, %v, want nothing archived", manifest, err)
+	}
+}
+
+// writeBundle replaces the bundle files of the application directory with the files of the build
+func writeBundle(t *testing.T, appDirPath string, b build) {
+	for _, fileName := range bundleFiles {
+		_ = os.Remove(filepath.Join(appDirPath, fileName))
+	}
+	for _, fileName := range b.files {
+		err := ioutil.WriteFile(filepath.Join(appDirPath, fileName), []byte(b.revision), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StorageBackendOCI = "oci"
+)
+
+const (
+	// Annotation used on each layer to record the bundle file it carries
+	titleAnnotation = "org.opencontainers.image.title"
+
+	manifestMediaType       = "application/vnd.argocd-interlace.manifest.v1+yaml"
+	signedManifestMediaType = "application/vnd.argocd-interlace.manifest.signed.v1+yaml"
+	provenanceMediaType     = "application/vnd.argocd-interlace.provenance.v1+json"
+	attestationMediaType    = "application/vnd.argocd-interlace.attestation.v1+json"
+	rekorEntryMediaType     = "application/vnd.argocd-interlace.rekor-entry.v1+json"
+	certificateMediaType    = "application/pem-certificate-chain"
+)
+
+// bundleFiles lists the files pushed as layers of the bundle artifact, in layer order
+var bundleFiles = []struct {
+	fileName  string
+	mediaType types.MediaType
+}{
+	{utils.MANIFEST_FILE_NAME, manifestMediaType},
+	{utils.SIGNED_MANIFEST_FILE_NAME, signedManifestMediaType},
+	{utils.PROVENANCE_FILE_NAME, provenanceMediaType},
+	{utils.ATTESTATION_FILE_NAME, attestationMediaType},
+	{utils.REKOR_ENTRY_FILE_NAME, rekorEntryMediaType},
+	{utils.CERTIFICATE_FILE_NAME, certificateMediaType},
+}
+
+type StorageBackend struct {
+	appData          application.ApplicationData
+	imageRegistry    string
+	registryInsecure bool
+}
+
+func NewStorageBackend(appData application.ApplicationData) (*StorageBackend, error) {
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	return &StorageBackend{
+		appData:          appData,
+		imageRegistry:    interlaceConfig.OciImageRegistry,
+		registryInsecure: interlaceConfig.OciRegistryInsecure,
+	}, nil
+}
+
+// GetLatestManifestContent pulls the bundle artifact of the previous revision
+// and returns the manifest it carries. It returns nil when there is no
+// previous artifact in the registry.
+func (s StorageBackend) GetLatestManifestContent() ([]byte, error) {
+
+	previousCommitSha := s.appData.AppSourcePreiviousCommitSha
+	if previousCommitSha == "" {
+		log.Infof("[INFO][%s] No previous revision found, skip pulling manifest bundle", s.appData.AppName)
+		return nil, nil
+	}
+
+	ref, err := s.imageReference(previousCommitSha)
+	if err != nil {
+		log.Errorf("Error in parsing image reference: %s", err.Error())
+		return nil, err
+	}
+
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			log.Infof("[INFO][%s] Manifest bundle %s does not exist in registry", s.appData.AppName, ref.String())
+			return nil, nil
+		}
+		log.Errorf("Error in pulling manifest bundle %s: %s", ref.String(), err.Error())
+		return nil, err
+	}
+
+	manifestBytes, err := getLayerContent(img, utils.MANIFEST_FILE_NAME)
+	if err != nil {
+		log.Errorf("Error in reading manifest from bundle %s: %s", ref.String(), err.Error())
+		return nil, err
+	}
+
+	log.Infof("[INFO][%s] Interlace retrieved previous manifest from bundle %s", s.appData.AppName, ref.String())
+
+	return manifestBytes, nil
+}
+
+// StoreManifestBundle does nothing, the bundle is pushed as one artifact
+// together with the provenance in StoreManifestProvenance
+func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
+	return nil
+}
+
+// StoreSourceVerification does nothing, the artifact is only pushed for verified sources
+func (s StorageBackend) StoreSourceVerification(verification application.SourceVerification) error {
+	return nil
+}
+
+func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
+	err := s.pushBundle()
+	if err != nil {
+		log.Errorf("Error in pushing manifest bundle: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *StorageBackend) Type() string {
+	return StorageBackendOCI
+}
+
+// pushBundle pushes the bundle files that exist in the application directory
+// as one OCI artifact tagged by the commit SHA of the application revision,
+// or by the chart version for helm charts without a commit.
+func (s StorageBackend) pushBundle() error {
+
+	revision := s.appData.RevisionID()
+	if revision == "" {
+		return fmt.Errorf("Revision of application %s is empty, cannot tag manifest bundle", s.appData.AppName)
+	}
+
+	ref, err := s.imageReference(revision)
+	if err != nil {
+		log.Errorf("Error in parsing image reference: %s", err.Error())
+		return err
+	}
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+
+	for _, bundleFile := range bundleFiles {
+		filePath := filepath.Join(s.appData.AppDirPath, bundleFile.fileName)
+		if !utils.FileExist(filePath) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Clean(filePath))
+		if err != nil {
+			log.Errorf("Error in reading %s: %s", bundleFile.fileName, err.Error())
+			return err
+		}
+
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer: static.NewLayer(content, bundleFile.mediaType),
+			Annotations: map[string]string{
+				titleAnnotation: bundleFile.fileName,
+			},
+		})
+		if err != nil {
+			log.Errorf("Error in appending %s to image: %s", bundleFile.fileName, err.Error())
+			return err
+		}
+	}
+
+	err = remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		log.Errorf("Error in pushing image %s: %s", ref.String(), err.Error())
+		return err
+	}
+
+	log.Infof("[INFO][%s] Interlace pushed manifest bundle to %s", s.appData.AppName, ref.String())
+
+	return nil
+}
+
+func (s StorageBackend) imageReference(tag string) (name.Reference, error) {
+
+	// Semver build metadata of chart versions is not allowed in tags, helm replaces "+" with "_" as well
+	imageRef := fmt.Sprintf("%s/%s:%s", s.imageRegistry, s.appData.AppName, strings.ReplaceAll(tag, "+", "_"))
+
+	if s.registryInsecure {
+		return name.ParseReference(imageRef, name.Insecure)
+	}
+	return name.ParseReference(imageRef)
+}
+
+// getLayerContent returns the content of the layer annotated with the given file name
+func getLayerContent(img v1.Image, fileName string) ([]byte, error) {
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range manifest.Layers {
+		if desc.Annotations[titleAnnotation] != fileName {
+			continue
+		}
+
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// Bundle layers are stored as plain blobs, so the compressed stream is the file content
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		return ioutil.ReadAll(rc)
+	}
+
+	return nil, fmt.Errorf("%s not found in manifest bundle", fileName)
+}
@@ -0,0 +1,141 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package oci
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTestStorageBackend returns a backend pushing to a local registry and the directory of the bundle files
+func newTestStorageBackend(t *testing.T, appData application.ApplicationData) (*StorageBackend, string) {
+
+	server := httptest.NewServer(registry.New())
+	t.Cleanup(server.Close)
+
+	appData.AppName = "app"
+	appData.AppDirPath = t.TempDir()
+	return &StorageBackend{
+		appData:          appData,
+		imageRegistry:    strings.TrimPrefix(server.URL, "http://"),
+		registryInsecure: true,
+	}, appData.AppDirPath
+}
+
+func writeBundleFile(t *testing.T, dir, fileName, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, fileName), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushAndPullBundle(t *testing.T) {
+
+	commitSha := "0123456789abcdef0123456789abcdef01234567"
+	s, dir := newTestStorageBackend(t, application.ApplicationData{AppSourceCommitSha: commitSha})
+
+	writeBundleFile(t, dir, utils.MANIFEST_FILE_NAME, "kind: ConfigMap\n")
+	writeBundleFile(t, dir, utils.PROVENANCE_FILE_NAME, "{}")
+
+	err := s.pushBundle()
+	if err != nil {
+		t.Fatalf("push bundle: %s", err.Error())
+	}
+
+	// Only the files that exist are layers of the bundle
+	ref, _ := s.imageReference(commitSha)
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("pull bundle: %s", err.Error())
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 {
+		t.Errorf("expected 2 layers, got %d", len(manifest.Layers))
+	}
+	provenance, err := getLayerContent(img, utils.PROVENANCE_FILE_NAME)
+	if err != nil || string(provenance) != "{}" {
+		t.Errorf("expected provenance layer {}, got %s, %v", string(provenance), err)
+	}
+	_, err = getLayerContent(img, utils.ATTESTATION_FILE_NAME)
+	if err == nil {
+		t.Error("expected an error for a file that is not in the bundle")
+	}
+
+	// The next revision reads the manifest of this one
+	s.appData.AppSourcePreiviousCommitSha = commitSha
+	content, err := s.GetLatestManifestContent()
+	if err != nil {
+		t.Fatalf("get latest manifest: %s", err.Error())
+	}
+	if string(content) != "kind: ConfigMap\n" {
+		t.Errorf("unexpected manifest %s", string(content))
+	}
+}
+
+func TestGetLatestManifestContentMissing(t *testing.T) {
+
+	s, _ := newTestStorageBackend(t, application.ApplicationData{})
+
+	content, err := s.GetLatestManifestContent()
+	if err != nil || content != nil {
+		t.Errorf("expected no manifest without previous revision, got %s, %v", string(content), err)
+	}
+
+	s.appData.AppSourcePreiviousCommitSha = "fedcba9876543210fedcba9876543210fedcba98"
+	content, err = s.GetLatestManifestContent()
+	if err != nil || content != nil {
+		t.Errorf("expected no manifest for a revision that was not pushed, got %s, %v", string(content), err)
+	}
+}
+
+func TestPushHelmBundle(t *testing.T) {
+
+	// Helm charts without commit are tagged by chart version
+	s, dir := newTestStorageBackend(t, application.ApplicationData{IsHelm: true, AppSourceRevision: "1.2.3+build.1"})
+	writeBundleFile(t, dir, utils.MANIFEST_FILE_NAME, "kind: Secret\n")
+
+	err := s.pushBundle()
+	if err != nil {
+		t.Fatalf("push bundle: %s", err.Error())
+	}
+
+	ref, _ := s.imageReference("1.2.3+build.1")
+	if !strings.HasSuffix(ref.String(), ":1.2.3_build.1") {
+		t.Errorf("unexpected reference %s", ref.String())
+	}
+	_, err = remote.Image(ref)
+	if err != nil {
+		t.Errorf("pull bundle %s: %s", ref.String(), err.Error())
+	}
+
+	s.appData.IsHelm = false
+	err = s.pushBundle()
+	if err == nil {
+		t.Error("expected an error for an application without revision")
+	}
+}
@@ -0,0 +1,265 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package resource
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/config"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	StorageBackendResource = "resource"
+)
+
+const (
+	bundleNameSuffix      = "-manifest-bundle"
+	applicationLabel      = "argocd.interlace.dev/application"
+	commitShaAnnotation   = "argocd.interlace.dev/commit-sha"
+	managedByLabel        = "app.kubernetes.io/managed-by"
+	managedByLabelValue   = "argocd-interlace"
+	resourceKindConfigMap = "ConfigMap"
+	resourceKindSecret    = "Secret"
+)
+
+// bundleFiles lists the files stored as data keys of the bundle resource
+var bundleFiles = []string{
+	utils.MANIFEST_FILE_NAME,
+	utils.SIGNED_MANIFEST_FILE_NAME,
+	utils.PROVENANCE_FILE_NAME,
+	utils.ATTESTATION_FILE_NAME,
+	utils.REKOR_ENTRY_FILE_NAME,
+	utils.CERTIFICATE_FILE_NAME,
+}
+
+type StorageBackend struct {
+	appData   application.ApplicationData
+	namespace string
+	kind      string
+	clientset kubernetes.Interface
+}
+
+func NewStorageBackend(appData application.ApplicationData) (*StorageBackend, error) {
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	clientset, _, err := utils.GetClient("")
+	if err != nil {
+		log.Errorf("Error in getting kubernetes client: %s", err.Error())
+		return nil, err
+	}
+
+	return &StorageBackend{
+		appData:   appData,
+		namespace: interlaceConfig.ManifestBundleNamespace,
+		kind:      interlaceConfig.ManifestBundleKind,
+		clientset: clientset,
+	}, nil
+}
+
+// GetLatestManifestContent returns the manifest held by the bundle resource of
+// the application, or nil when the resource does not exist yet.
+func (s StorageBackend) GetLatestManifestContent() ([]byte, error) {
+
+	data, err := s.getBundleData()
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			log.Infof("[INFO][%s] %s %s/%s does not exist yet", s.appData.AppName, s.kind, s.namespace, s.bundleName())
+			return nil, nil
+		}
+		log.Errorf("Error in getting %s %s/%s: %s", s.kind, s.namespace, s.bundleName(), err.Error())
+		return nil, err
+	}
+
+	manifestBytes, ok := data[utils.MANIFEST_FILE_NAME]
+	if !ok {
+		return nil, nil
+	}
+
+	log.Infof("[INFO][%s] Interlace retrieved previous manifest from %s %s/%s", s.appData.AppName, s.kind, s.namespace, s.bundleName())
+
+	return manifestBytes, nil
+}
+
+// StoreManifestBundle does nothing, the bundle resource is applied together
+// with the provenance in StoreManifestProvenance
+func (s StorageBackend) StoreManifestBundle(sourceVerifed bool) error {
+	return nil
+}
+
+// StoreSourceVerification does nothing, the bundle resource is only applied for verified sources
+func (s StorageBackend) StoreSourceVerification(verification application.SourceVerification) error {
+	return nil
+}
+
+func (s StorageBackend) StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error {
+	err := s.applyBundle()
+	if err != nil {
+		log.Errorf("Error in storing manifest bundle: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *StorageBackend) Type() string {
+	return StorageBackendResource
+}
+
+func (s StorageBackend) bundleName() string {
+	return s.appData.AppName + bundleNameSuffix
+}
+
+// applyBundle creates or updates the bundle resource of the application with
+// the bundle files that exist in the application directory.
+func (s StorageBackend) applyBundle() error {
+
+	data := make(map[string][]byte, len(bundleFiles))
+	for _, fileName := range bundleFiles {
+		filePath := filepath.Join(s.appData.AppDirPath, fileName)
+		if !utils.FileExist(filePath) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Clean(filePath))
+		if err != nil {
+			log.Errorf("Error in reading %s: %s", fileName, err.Error())
+			return err
+		}
+		data[fileName] = content
+	}
+
+	objectMeta := metav1.ObjectMeta{
+		Name:      s.bundleName(),
+		Namespace: s.namespace,
+		Labels: map[string]string{
+			applicationLabel: s.appData.AppName,
+			managedByLabel:   managedByLabelValue,
+		},
+		Annotations: map[string]string{
+			commitShaAnnotation: s.appData.AppSourceCommitSha,
+		},
+	}
+
+	var err error
+	switch s.kind {
+	case resourceKindConfigMap:
+		err = s.applyConfigMap(objectMeta, data)
+	case resourceKindSecret:
+		err = s.applySecret(objectMeta, data)
+	default:
+		err = fmt.Errorf("Unsupported manifest bundle kind %s", s.kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("[INFO][%s] Interlace stored manifest bundle in %s %s/%s", s.appData.AppName, s.kind, s.namespace, s.bundleName())
+
+	return nil
+}
+
+func (s StorageBackend) applyConfigMap(objectMeta metav1.ObjectMeta, data map[string][]byte) error {
+
+	stringData := map[string]string{}
+	for key, value := range data {
+		stringData[key] = string(value)
+	}
+
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	current, err := configMaps.Get(context.TODO(), objectMeta.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: objectMeta,
+			Data:       stringData,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	current.Labels = objectMeta.Labels
+	current.Annotations = objectMeta.Annotations
+	current.Data = stringData
+	_, err = configMaps.Update(context.TODO(), current, metav1.UpdateOptions{})
+	return err
+}
+
+func (s StorageBackend) applySecret(objectMeta metav1.ObjectMeta, data map[string][]byte) error {
+
+	secrets := s.clientset.CoreV1().Secrets(s.namespace)
+
+	current, err := secrets.Get(context.TODO(), objectMeta.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = secrets.Create(context.TODO(), &corev1.Secret{
+			ObjectMeta: objectMeta,
+			Type:       corev1.SecretTypeOpaque,
+			Data:       data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	current.Labels = objectMeta.Labels
+	current.Annotations = objectMeta.Annotations
+	current.Data = data
+	_, err = secrets.Update(context.TODO(), current, metav1.UpdateOptions{})
+	return err
+}
+
+// getBundleData returns the data of the bundle resource of the application
+func (s StorageBackend) getBundleData() (map[string][]byte, error) {
+
+	switch s.kind {
+	case resourceKindConfigMap:
+		cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.bundleName(), metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		data := map[string][]byte{}
+		for key, value := range cm.Data {
+			data[key] = []byte(value)
+		}
+		return data, nil
+
+	case resourceKindSecret:
+		secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(context.TODO(), s.bundleName(), metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return secret.Data, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported manifest bundle kind %s", s.kind)
+}
@@ -0,0 +1,160 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package resource
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/application"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "argocd-interlace"
+
+// writeBundle replaces the bundle files of the application directory with the given files
+func writeBundle(t *testing.T, appDirPath string, files map[string]string) {
+	for _, fileName := range bundleFiles {
+		_ = os.Remove(filepath.Join(appDirPath, fileName))
+	}
+	for fileName, content := range files {
+		err := ioutil.WriteFile(filepath.Join(appDirPath, fileName), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// bundleData returns the data and annotations of the bundle resource of the given kind
+func bundleData(t *testing.T, s StorageBackend) (map[string]string, map[string]string) {
+	data := map[string]string{}
+	var objectMeta metav1.ObjectMeta
+	if s.kind == resourceKindConfigMap {
+		cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.bundleName(), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get ConfigMap: %v", err)
+		}
+		data = cm.Data
+		objectMeta = cm.ObjectMeta
+	} else {
+		secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(context.TODO(), s.bundleName(), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get Secret: %v", err)
+		}
+		for key, value := range secret.Data {
+			data[key] = string(value)
+		}
+		objectMeta = secret.ObjectMeta
+	}
+	if objectMeta.Labels[applicationLabel] != s.appData.AppName || objectMeta.Labels[managedByLabel] != managedByLabelValue {
+		t.Errorf("bundle resource labels = %v", objectMeta.Labels)
+	}
+	return data, objectMeta.Annotations
+}
+
+func TestResourceStorageBackend(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+	}{
+		{"ConfigMap", resourceKindConfigMap},
+		{"Secret", resourceKindSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDirPath := t.TempDir()
+			s := StorageBackend{
+				appData:   application.ApplicationData{AppName: "app", AppDirPath: appDirPath, AppSourceCommitSha: "aaa"},
+				namespace: testNamespace,
+				kind:      tt.kind,
+				clientset: fake.NewSimpleClientset(),
+			}
+
+			// Nothing stored yet
+			manifest, err := s.GetLatestManifestContent()
+			if err != nil || manifest != nil {
+				t.Fatalf("GetLatestManifestContent() = %s, %v, want nothing stored", manifest, err)
+			}
+
+			// The bundle resource is created with the files of the first build
+			firstBuild := map[string]string{
+				utils.MANIFEST_FILE_NAME:    "manifest aaa",
+				utils.ATTESTATION_FILE_NAME: "attestation aaa",
+				utils.CERTIFICATE_FILE_NAME: "certificate aaa",
+			}
+			writeBundle(t, appDirPath, firstBuild)
+			err = s.StoreManifestProvenance(time.Now(), time.Now(), false)
+			if err != nil {
+				t.Fatalf("StoreManifestProvenance() error = %v", err)
+			}
+			data, annotations := bundleData(t, s)
+			if !reflect.DeepEqual(data, firstBuild) || annotations[commitShaAnnotation] != "aaa" {
+				t.Errorf("bundle resource = %v %v, want %v of commit aaa", data, annotations, firstBuild)
+			}
+
+			// The bundle resource is updated with the files of the next build only
+			s.appData.AppSourceCommitSha = "bbb"
+			secondBuild := map[string]string{
+				utils.MANIFEST_FILE_NAME:    "manifest bbb",
+				utils.ATTESTATION_FILE_NAME: "attestation bbb",
+			}
+			writeBundle(t, appDirPath, secondBuild)
+			err = s.StoreManifestProvenance(time.Now(), time.Now(), false)
+			if err != nil {
+				t.Fatalf("StoreManifestProvenance() error = %v", err)
+			}
+			data, annotations = bundleData(t, s)
+			if !reflect.DeepEqual(data, secondBuild) || annotations[commitShaAnnotation] != "bbb" {
+				t.Errorf("bundle resource = %v %v, want %v of commit bbb", data, annotations, secondBuild)
+			}
+
+			manifest, err = s.GetLatestManifestContent()
+			if err != nil {
+				t.Fatalf("GetLatestManifestContent() error = %v", err)
+			}
+			if string(manifest) != "manifest bbb" {
+				t.Errorf("GetLatestManifestContent() = %s, want manifest bbb", manifest)
+			}
+		})
+	}
+}
+
+func TestResourceStorageBackendUnsupportedKind(t *testing.T) {
+	appDirPath := t.TempDir()
+	writeBundle(t, appDirPath, map[string]string{utils.MANIFEST_FILE_NAME: "manifest"})
+
+	s := StorageBackend{
+		appData:   application.ApplicationData{AppName: "app", AppDirPath: appDirPath},
+		namespace: testNamespace,
+		kind:      "Deployment",
+		clientset: fake.NewSimpleClientset(),
+	}
+	if err := s.StoreManifestProvenance(time.Now(), time.Now(), false); err == nil {
+		t.Error("StoreManifestProvenance() of unsupported kind succeeded")
+	}
+	if _, err := s.GetLatestManifestContent(); err == nil {
+		t.Error("GetLatestManifestContent() of unsupported kind succeeded")
+	}
+}
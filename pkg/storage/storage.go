@@ -17,37 +17,74 @@
 package storage
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/IBM/argocd-interlace/pkg/application"
 	"github.com/IBM/argocd-interlace/pkg/storage/annotation"
+	"github.com/IBM/argocd-interlace/pkg/storage/crd"
+	"github.com/IBM/argocd-interlace/pkg/storage/filesystem"
+	"github.com/IBM/argocd-interlace/pkg/storage/oci"
+	"github.com/IBM/argocd-interlace/pkg/storage/resource"
 )
 
 type StorageBackend interface {
 	GetLatestManifestContent() ([]byte, error)
 	StoreManifestBundle(sourceVerifed bool) error
-	StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time) error
+	StoreSourceVerification(verification application.SourceVerification) error
+	StoreManifestProvenance(buildStartedOn time.Time, buildFinishedOn time.Time, reproducible bool) error
 	Type() string
 }
 
-func InitializeStorageBackends(appData application.ApplicationData, manifestStorageType string) (map[string]StorageBackend, error) {
-
-	configuredStorageBackends := []string{annotation.StorageBackendAnnotation}
+// InitializeStorageBackends returns the storage backends of the given types, keyed by type
+func InitializeStorageBackends(appData application.ApplicationData, manifestStorageTypes []string) (map[string]StorageBackend, error) {
 
 	storageBackends := map[string]StorageBackend{}
-	for _, backendType := range configuredStorageBackends {
-		if manifestStorageType == backendType {
-			switch backendType {
+	for _, backendType := range manifestStorageTypes {
+		switch backendType {
+
+		case annotation.StorageBackendAnnotation:
 
-			case annotation.StorageBackendAnnotation:
+			annotationStorageBackend, err := annotation.NewStorageBackend(appData)
+			if err != nil {
+				return nil, err
+			}
+			storageBackends[backendType] = annotationStorageBackend
 
-				annotationStorageBackend, err := annotation.NewStorageBackend(appData)
-				if err != nil {
-					return nil, err
-				}
-				storageBackends[backendType] = annotationStorageBackend
+		case oci.StorageBackendOCI:
 
+			ociStorageBackend, err := oci.NewStorageBackend(appData)
+			if err != nil {
+				return nil, err
 			}
+			storageBackends[backendType] = ociStorageBackend
+
+		case filesystem.StorageBackendFilesystem:
+
+			filesystemStorageBackend, err := filesystem.NewStorageBackend(appData)
+			if err != nil {
+				return nil, err
+			}
+			storageBackends[backendType] = filesystemStorageBackend
+
+		case resource.StorageBackendResource:
+
+			resourceStorageBackend, err := resource.NewStorageBackend(appData)
+			if err != nil {
+				return nil, err
+			}
+			storageBackends[backendType] = resourceStorageBackend
+
+		case crd.StorageBackendCRD:
+
+			crdStorageBackend, err := crd.NewStorageBackend(appData)
+			if err != nil {
+				return nil, err
+			}
+			storageBackends[backendType] = crdStorageBackend
+
+		default:
+			return nil, fmt.Errorf("Unsupported storage type %s", backendType)
 		}
 	}
 
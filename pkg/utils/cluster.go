@@ -0,0 +1,127 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	ARGOCD_SECRET_TYPE_LABEL   = "argocd.argoproj.io/secret-type"
+	ARGOCD_SECRET_TYPE_CLUSTER = "cluster"
+	IN_CLUSTER_NAME            = "in-cluster"
+)
+
+// ClusterRestConfig returns the config of the destination cluster of an application. The
+// cluster Interlace runs in is accessed with its own config, other clusters with the
+// credentials of their Argo CD cluster Secret.
+func ClusterRestConfig(clientset kubernetes.Interface, namespace string, inClusterConfig *rest.Config, destination appv1.ApplicationDestination) (*rest.Config, error) {
+
+	if destination.Server == appv1.KubernetesInternalAPIServerAddr || (destination.Server == "" && destination.Name == IN_CLUSTER_NAME) {
+		return inClusterConfig, nil
+	}
+
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", ARGOCD_SECRET_TYPE_LABEL, ARGOCD_SECRET_TYPE_CLUSTER),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets.Items {
+		server := strings.TrimSuffix(string(secret.Data["server"]), "/")
+		if destination.Server != "" && server != strings.TrimSuffix(destination.Server, "/") {
+			continue
+		}
+		if destination.Server == "" && string(secret.Data["name"]) != destination.Name {
+			continue
+		}
+
+		cluster := appv1.Cluster{Server: server}
+		if len(secret.Data["config"]) > 0 {
+			err = json.Unmarshal(secret.Data["config"], &cluster.Config)
+			if err != nil {
+				return nil, fmt.Errorf("error in parsing config of cluster Secret %s: %s", secret.Name, err.Error())
+			}
+		}
+		if server == appv1.KubernetesInternalAPIServerAddr {
+			return inClusterConfig, nil
+		}
+		return cluster.RawRestConfig(), nil
+	}
+
+	return nil, fmt.Errorf("no cluster Secret found for destination %s", DestinationKey(destination))
+}
+
+// DestinationKey identifies the destination cluster of an application
+func DestinationKey(destination appv1.ApplicationDestination) string {
+	if destination.Server != "" {
+		return destination.Server
+	}
+	return destination.Name
+}
+
+// ClusterVersions returns the Kubernetes version and the API versions of a cluster the way
+// Argo CD passes them to helm template: the version as major.minor and the API versions as
+// group/version and group/version/kind, sorted
+func ClusterVersions(restConfig *rest.Config) (string, []string, error) {
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return "", nil, err
+	}
+
+	serverVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return "", nil, err
+	}
+	kubeVersion := strings.ReplaceAll(fmt.Sprintf("%s.%s", serverVersion.Major, serverVersion.Minor), "+", "")
+
+	_, resourceLists, err := discoveryClient.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return "", nil, err
+	}
+
+	apiVersionMap := map[string]bool{}
+	for _, resourceList := range resourceLists {
+		apiVersionMap[resourceList.GroupVersion] = true
+		for _, resource := range resourceList.APIResources {
+			// Subresources are not kinds of their own
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			apiVersionMap[resourceList.GroupVersion+"/"+resource.Kind] = true
+		}
+	}
+	apiVersions := []string{}
+	for apiVersion := range apiVersionMap {
+		apiVersions = append(apiVersions, apiVersion)
+	}
+	sort.Strings(apiVersions)
+
+	return kubeVersion, apiVersions, nil
+}
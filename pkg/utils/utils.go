@@ -28,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/IBM/argocd-interlace/pkg/config"
 	"github.com/pkg/errors"
@@ -43,12 +44,15 @@ const (
 	SIGNED_MANIFEST_FILE_NAME = "manifest.signed"
 	PROVENANCE_FILE_NAME      = "provenance.yaml"
 	ATTESTATION_FILE_NAME     = "attestation.json"
+	REKOR_ENTRY_FILE_NAME     = "rekor-entry.json"
+	CERTIFICATE_FILE_NAME     = "certificate.pem"
+	IMAGE_DIGESTS_FILE_NAME   = "image-digests.json"
 	TMP_DIR                   = "/tmp/output"
-	PRIVATE_KEY_PATH          = "/etc/signing-secrets/cosign.key"
-	PUB_KEY_PATH              = "/etc/signing-secrets/cosign.pub"
 	KEYRING_PUB_KEY_PATH      = "/.gnupg/pubring.gpg"
 	SIG_ANNOTATION_NAME       = "cosign.sigstore.dev/signature"
 	MSG_ANNOTATION_NAME       = "cosign.sigstore.dev/message"
+	CERT_ANNOTATION_NAME      = "cosign.sigstore.dev/certificate"
+	REKOR_ANNOTATION_NAME     = "argocd.interlace.dev/rekor-entry"
 	RETRY_ATTEMPTS            = 10
 )
 
@@ -169,6 +173,40 @@ func RetriveDesiredManifest(appName string) (string, error) {
 	return desiredManifest, nil
 }
 
+// ArgocdVersion is the version of the Argo CD server and of the tools it builds manifests with
+type ArgocdVersion struct {
+	Version          string `json:"Version"`
+	KustomizeVersion string `json:"KustomizeVersion,omitempty"`
+	HelmVersion      string `json:"HelmVersion,omitempty"`
+}
+
+func RetrieveArgocdVersion() (*ArgocdVersion, error) {
+
+	interlaceConfig, err := config.GetInterlaceConfig()
+	if err != nil {
+		log.Errorf("Error in loading config: %s", err.Error())
+		return nil, err
+	}
+
+	baseUrl := strings.TrimSuffix(interlaceConfig.ArgocdApiBaseUrl, "/api/v1/applications")
+
+	versionUrl := fmt.Sprintf("%s/api/version", baseUrl)
+
+	versionStr, err := QueryAPI(versionUrl, "GET", interlaceConfig.ArgocdApiToken, nil)
+	if err != nil {
+		log.Errorf("Error occured while querying argocd REST API %s ", err.Error())
+		return nil, err
+	}
+
+	var argocdVersion ArgocdVersion
+	err = json.Unmarshal([]byte(versionStr), &argocdVersion)
+	if err != nil {
+		log.Errorf("Error in parsing argocd version: %s", err.Error())
+		return nil, err
+	}
+	return &argocdVersion, nil
+}
+
 func FileExist(fpath string) bool {
 	if _, err := os.Stat(fpath); err == nil {
 		return true
@@ -0,0 +1,161 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package verify
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// fulcioIssuerOID is the certificate extension in which Fulcio records the OIDC issuer
+// of the token the certificate was requested with
+var fulcioIssuerOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+// verifyCertificateChain checks the first certificate of the PEM chain, as issued to the
+// ephemeral key of keyless signing, against the CA roots, the expected identity and
+// OIDC issuer of the options, and returns its PEM encoded public key. The certificate must
+// be valid at the time the transparency log entry of the signature was integrated, the
+// entry is required and its integrated time is only trusted once its signed entry
+// timestamp verifies with the public key of the log.
+func verifyCertificateChain(chainPEM []byte, vo VerifyOption, rekorEntry *attestation.RekorEntry) ([]byte, error) {
+
+	if vo.CertificateIdentity == "" || vo.CertificateOIDCIssuer == "" {
+		return nil, fmt.Errorf("a certificate identity and OIDC issuer are required to verify keyless certificates")
+	}
+	if rekorEntry == nil {
+		return nil, fmt.Errorf("a transparency log entry is required to verify the signing time of the certificate")
+	}
+
+	rekorPubKey, err := ioutil.ReadFile(filepath.Clean(vo.RekorPublicKeyPath))
+	if err != nil {
+		return nil, err
+	}
+	err = attestation.VerifySignedEntryTimestamp(rekorEntry, rekorPubKey)
+	if err != nil {
+		return nil, err
+	}
+	signingTime := time.Unix(rekorEntry.IntegratedTime, 0)
+
+	certs, err := parseCertificates(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in certificate chain")
+	}
+	leaf := certs[0]
+
+	rootsPEM, err := ioutil.ReadFile(filepath.Clean(vo.CARootsPath))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificate found in CA roots %s", vo.CARootsPath)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// The certificate is short-lived, it only has to be valid when the signature was recorded
+	if signingTime.Before(leaf.NotBefore) || signingTime.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("transparency log entry integrated at %s, outside of the certificate validity from %s to %s",
+			signingTime.UTC(), leaf.NotBefore.UTC(), leaf.NotAfter.UTC())
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signingTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate is not issued by the CA roots: %s", err.Error())
+	}
+
+	identities := certificateIdentities(leaf)
+	if !contains(identities, vo.CertificateIdentity) {
+		return nil, fmt.Errorf("certificate identity %v does not match %s", identities, vo.CertificateIdentity)
+	}
+	issuer := certificateOIDCIssuer(leaf)
+	if issuer != vo.CertificateOIDCIssuer {
+		return nil, fmt.Errorf("certificate OIDC issuer %q does not match %s", issuer, vo.CertificateOIDCIssuer)
+	}
+	log.Infof("[INFO] Certificate issued to %v of %s by %s", identities, issuer, leaf.Issuer.String())
+
+	return cryptoutils.MarshalPublicKeyToPEM(leaf.PublicKey)
+}
+
+func parseCertificates(chainPEM []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// certificateIdentities returns the subject alternative names Fulcio certifies:
+// the email or the URI of the OIDC token subject, e.g. of a Kubernetes service account
+func certificateIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// certificateOIDCIssuer returns the OIDC issuer of the token that Fulcio certified,
+// or an empty string when the certificate does not record it
+func certificateOIDCIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+)
+
+const (
+	testIdentity = "https://kubernetes.io/namespaces/argocd-interlace/serviceaccounts/argocd-interlace-controller"
+	testIssuer   = "https://kubernetes.default.svc"
+)
+
+// newTestCertificateChain returns the PEM chain of a short-lived certificate issued for
+// testIdentity of testIssuer by a test CA, as a keyless signer gets it, and the path of the CA roots
+func newTestCertificateChain(t *testing.T, notBefore, notAfter time.Time) ([]byte, string) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             notBefore.Add(-24 * time.Hour),
+		NotAfter:              notAfter.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, _ := url.Parse(testIdentity)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		URIs:         []*url.URL{identity},
+		ExtraExtensions: []pkix.Extension{
+			{Id: fulcioIssuerOID, Value: []byte(testIssuer)},
+		},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+
+	rootsPath := filepath.Join(t.TempDir(), "ca-roots.pem")
+	err = ioutil.WriteFile(rootsPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, rootsPath
+}
+
+// newTestRekorLog returns a function that makes entries integrated at a given time,
+// signed like the entries of a Rekor log, and the path of the public key of the log
+func newTestRekorLog(t *testing.T) (func(tm time.Time) *attestation.RekorEntry, string) {
+
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(rekorKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekorPubKeyPath := filepath.Join(t.TempDir(), "rekor.pub")
+	err = ioutil.WriteFile(rekorPubKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := fmt.Sprintf("%x", sha256.Sum256(der))
+
+	integratedAt := func(tm time.Time) *attestation.RekorEntry {
+		entry := &attestation.RekorEntry{
+			UUID:           "entry",
+			Body:           base64.StdEncoding.EncodeToString([]byte("{}")),
+			IntegratedTime: tm.Unix(),
+			LogIndex:       1,
+			LogID:          logID,
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"body":           entry.Body,
+			"integratedTime": entry.IntegratedTime,
+			"logIndex":       entry.LogIndex,
+			"logID":          entry.LogID,
+		})
+		canonicalized, err := jsoncanonicalizer.Transform(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(canonicalized)
+		set, err := ecdsa.SignASN1(rand.Reader, rekorKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.SignedEntryTimestamp = base64.StdEncoding.EncodeToString(set)
+		return entry
+	}
+	return integratedAt, rekorPubKeyPath
+}
+
+func TestVerifyCertificateChain(t *testing.T) {
+	// The certificate expired long ago, it is verified at the time of the log entry
+	notBefore := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	notAfter := notBefore.Add(20 * time.Minute)
+	chain, rootsPath := newTestCertificateChain(t, notBefore, notAfter)
+	integratedAt, rekorPubKeyPath := newTestRekorLog(t)
+
+	// An entry of a valid time whose integrated time was changed afterwards
+	forged := integratedAt(notAfter.Add(time.Hour))
+	forged.IntegratedTime = notBefore.Add(time.Minute).Unix()
+
+	tests := []struct {
+		name       string
+		identity   string
+		issuer     string
+		rekorEntry *attestation.RekorEntry
+		wantErr    bool
+	}{
+		{"integrated while valid", testIdentity, testIssuer, integratedAt(notBefore.Add(time.Minute)), false},
+		{"no identity", "", testIssuer, integratedAt(notBefore.Add(time.Minute)), true},
+		{"no issuer", testIdentity, "", integratedAt(notBefore.Add(time.Minute)), true},
+		{"no transparency log entry", testIdentity, testIssuer, nil, true},
+		{"forged integrated time", testIdentity, testIssuer, forged, true},
+		{"integrated after expiry", testIdentity, testIssuer, integratedAt(notAfter.Add(time.Minute)), true},
+		{"integrated before issuance", testIdentity, testIssuer, integratedAt(notBefore.Add(-time.Minute)), true},
+		{"other identity", "https://kubernetes.io/namespaces/default/serviceaccounts/default", testIssuer, integratedAt(notBefore.Add(time.Minute)), true},
+		{"other issuer", testIdentity, "https://accounts.google.com", integratedAt(notBefore.Add(time.Minute)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vo := VerifyOption{
+				CARootsPath:           rootsPath,
+				CertificateIdentity:   tt.identity,
+				CertificateOIDCIssuer: tt.issuer,
+				RekorPublicKeyPath:    rekorPubKeyPath,
+			}
+			pubKey, err := verifyCertificateChain(chain, vo, tt.rekorEntry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyCertificateChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(pubKey) == 0 {
+				t.Error("verifyCertificateChain() returned no public key")
+			}
+		})
+	}
+}
+
+func TestVerifyCertificateChainOtherCA(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	chain, _ := newTestCertificateChain(t, notBefore, notBefore.Add(20*time.Minute))
+	_, otherRootsPath := newTestCertificateChain(t, notBefore, notBefore.Add(20*time.Minute))
+	integratedAt, rekorPubKeyPath := newTestRekorLog(t)
+
+	vo := VerifyOption{
+		CARootsPath:           otherRootsPath,
+		CertificateIdentity:   testIdentity,
+		CertificateOIDCIssuer: testIssuer,
+		RekorPublicKeyPath:    rekorPubKeyPath,
+	}
+	if _, err := verifyCertificateChain(chain, vo, integratedAt(notBefore.Add(time.Minute))); err == nil {
+		t.Error("verifyCertificateChain() accepted a certificate of another CA")
+	}
+}
@@ -0,0 +1,449 @@
+//
+// Copyright 2021 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/IBM/argocd-interlace/pkg/provenance/attestation"
+	"github.com/IBM/argocd-interlace/pkg/provenance/slsa"
+	"github.com/IBM/argocd-interlace/pkg/utils"
+	"github.com/ghodss/yaml"
+	"github.com/in-toto/in-toto-golang/in_toto"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/k8s-manifest-sigstore/pkg/k8smanifest"
+	k8smnfutil "github.com/sigstore/k8s-manifest-sigstore/pkg/util"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// VerifyOption holds the paths of the artifacts produced by the controller.
+// The attestation must be signed by Threshold of the keys, all of them when it is 0.
+// Signatures made in keyless mode are verified with the certificates of the
+// signing keys: the certificate chain of the attestation in CertificatePath and
+// the one embedded in the signature, both checked against CARootsPath,
+// CertificateIdentity and CertificateOIDCIssuer. The transparency log entry recorded for the attestation
+// is checked when RekorEntryPath is given: its signed entry timestamp with the public key
+// of the log in RekorPublicKeyPath, its inclusion proof, and that it records a signature
+// of the attestation. Certificates are short-lived, they must be valid at the time the
+// entry was integrated in the log, so the entry is required to verify keyless signatures.
+type VerifyOption struct {
+	ManifestPath          string
+	SignaturePath         string
+	AttestationPath       string
+	PublicKeyPaths        []string
+	Threshold             int
+	CertificatePath       string
+	CARootsPath           string
+	CertificateIdentity   string
+	CertificateOIDCIssuer string
+	RekorEntryPath        string
+	RekorPublicKeyPath    string
+}
+
+// Verify checks the DSSE signature of the attestation, that one of its subjects
+// is the manifest, and the k8s-manifest-sigstore signature of every resource in
+// the manifest. Checks whose inputs are not given are skipped.
+func Verify(vo VerifyOption) error {
+
+	var rekorEntry *attestation.RekorEntry
+	if vo.RekorEntryPath != "" {
+		var err error
+		rekorEntry, err = VerifyRekorEntry(vo.RekorEntryPath, vo.RekorPublicKeyPath, vo.AttestationPath)
+		if err != nil {
+			log.Errorf("Error in verifying transparency log entry: %s", err.Error())
+			return err
+		}
+		log.Infof("[INFO] Transparency log entry %s of attestation %s is included in the log", vo.RekorEntryPath, vo.AttestationPath)
+	}
+
+	if vo.AttestationPath != "" {
+		pubKeyPaths := vo.PublicKeyPaths
+		if vo.CertificatePath != "" {
+			pubKeyPaths = append(pubKeyPaths, vo.CertificatePath)
+		}
+
+		pubKeys := [][]byte{}
+		for _, pubKeyPath := range pubKeyPaths {
+			pubKey, err := readVerificationKey(pubKeyPath, vo, rekorEntry)
+			if err != nil {
+				log.Errorf("Error in loading attestation verification key %s: %s", pubKeyPath, err.Error())
+				return err
+			}
+			pubKeys = append(pubKeys, pubKey)
+		}
+
+		threshold := vo.Threshold
+		if threshold == 0 {
+			threshold = len(pubKeys)
+		}
+
+		statement, err := VerifyAttestation(vo.AttestationPath, pubKeys, threshold)
+		if err != nil {
+			log.Errorf("Error in verifying attestation: %s", err.Error())
+			return err
+		}
+		log.Infof("[INFO] Attestation %s is signed with at least %d of %v", vo.AttestationPath, threshold, pubKeyPaths)
+
+		err = VerifySubject(statement, vo.ManifestPath)
+		if err != nil {
+			log.Errorf("Error in verifying attestation subject: %s", err.Error())
+			return err
+		}
+		log.Infof("[INFO] Attestation subjects match manifest %s", vo.ManifestPath)
+	}
+
+	if vo.SignaturePath != "" {
+		pubKeyPaths := vo.PublicKeyPaths
+		if len(pubKeyPaths) == 0 {
+			// Keyless signature, verified with the public key of its certificate
+			tmpDir, err := ioutil.TempDir("", "argocd-interlace-verify")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir)
+
+			pubKeyPath, err := writeSignatureCertificateKey(vo, rekorEntry, tmpDir)
+			if err != nil {
+				log.Errorf("Error in loading signature certificate: %s", err.Error())
+				return err
+			}
+			pubKeyPaths = []string{pubKeyPath}
+		}
+
+		// The manifest is signed with a single key, any of the given ones
+		var err error
+		for _, pubKeyPath := range pubKeyPaths {
+			err = VerifyManifestSignature(vo.ManifestPath, vo.SignaturePath, pubKeyPath)
+			if err == nil {
+				if len(vo.PublicKeyPaths) > 0 {
+					log.Infof("[INFO] Manifest %s is signed with %s", vo.ManifestPath, pubKeyPath)
+				} else {
+					log.Infof("[INFO] Manifest %s is signed with the certificate in %s", vo.ManifestPath, vo.SignaturePath)
+				}
+				break
+			}
+		}
+		if err != nil {
+			log.Errorf("Error in verifying manifest signature: %s", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readVerificationKey returns the PEM public key in keyPath, or the public key of the
+// certificate chain in keyPath once it is verified against the CA roots.
+func readVerificationKey(keyPath string, vo VerifyOption, rekorEntry *attestation.RekorEntry) ([]byte, error) {
+
+	keyBytes, err := ioutil.ReadFile(filepath.Clean(keyPath))
+	if err != nil {
+		return nil, err
+	}
+
+	pb, _ := pem.Decode(keyBytes)
+	if pb == nil || pb.Type != "CERTIFICATE" {
+		return keyBytes, nil
+	}
+	if vo.CARootsPath == "" {
+		return nil, fmt.Errorf("%s is a certificate, CA roots are required to verify it", keyPath)
+	}
+	return verifyCertificateChain(keyBytes, vo, rekorEntry)
+}
+
+// writeSignatureCertificateKey verifies the certificate chain embedded in the signature
+// and writes its public key to dir for k8s-manifest-sigstore.
+func writeSignatureCertificateKey(vo VerifyOption, rekorEntry *attestation.RekorEntry, dir string) (string, error) {
+
+	signatureBytes, err := ioutil.ReadFile(filepath.Clean(vo.SignaturePath))
+	if err != nil {
+		return "", err
+	}
+
+	_, _, certificate, err := getSignature(signatureBytes)
+	if err != nil {
+		return "", err
+	}
+	if certificate == "" {
+		return "", fmt.Errorf("no certificate found in signature file, a public key is required")
+	}
+	if vo.CARootsPath == "" {
+		return "", fmt.Errorf("CA roots are required to verify the signature certificate")
+	}
+
+	// The certificate is embedded as the base64 encoded gzip of the PEM chain
+	gzipCert, err := base64.StdEncoding.DecodeString(certificate)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode signature certificate: %s", err.Error())
+	}
+
+	pubKey, err := verifyCertificateChain(k8smnfutil.GzipDecompress(gzipCert), vo, rekorEntry)
+	if err != nil {
+		return "", err
+	}
+
+	pubKeyPath := filepath.Join(dir, "signature.pub")
+	err = ioutil.WriteFile(pubKeyPath, pubKey, 0600)
+	if err != nil {
+		return "", err
+	}
+	return pubKeyPath, nil
+}
+
+// VerifyRekorEntry checks the transparency log entry in rekorEntryPath, e.g. rekor-entry.json,
+// and returns the entry. Its signed entry timestamp must verify with the PEM public key of the
+// log in rekorPubKeyPath, its inclusion proof must be valid, and its body must record a
+// signature of the DSSE envelope in attestationPath.
+func VerifyRekorEntry(rekorEntryPath, rekorPubKeyPath, attestationPath string) (*attestation.RekorEntry, error) {
+
+	rb, err := ioutil.ReadFile(filepath.Clean(rekorEntryPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var rekorEntry attestation.RekorEntry
+	err = json.Unmarshal(rb, &rekorEntry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse transparency log entry: %s", err.Error())
+	}
+
+	rekorPubKey, err := ioutil.ReadFile(filepath.Clean(rekorPubKeyPath))
+	if err != nil {
+		return nil, err
+	}
+
+	err = attestation.VerifySignedEntryTimestamp(&rekorEntry, rekorPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = attestation.VerifyInclusionProof(&rekorEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	envelopeBytes, err := ioutil.ReadFile(filepath.Clean(attestationPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope dsse.Envelope
+	err = json.Unmarshal(envelopeBytes, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DSSE envelope: %s", err.Error())
+	}
+
+	err = attestation.VerifyEntryBody(&rekorEntry, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	return &rekorEntry, nil
+}
+
+// VerifyAttestation verifies that the DSSE envelope in attestationPath is signed by at
+// least threshold of the PEM public keys and returns the in-toto statement it carries.
+func VerifyAttestation(attestationPath string, pubKeys [][]byte, threshold int) (*in_toto.Statement, error) {
+
+	envelopeBytes, err := ioutil.ReadFile(filepath.Clean(attestationPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope dsse.Envelope
+	err = json.Unmarshal(envelopeBytes, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DSSE envelope: %s", err.Error())
+	}
+
+	verifiers := []*attestation.IntotoVerifier{}
+	for _, pubKey := range pubKeys {
+		verifier, err := attestation.NewIntotoVerifier(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, verifier)
+	}
+
+	_, err = attestation.VerifyEnvelope(&envelope, verifiers, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("DSSE signature verification failed: %s", err.Error())
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var statement in_toto.Statement
+	err = json.Unmarshal(payload, &statement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse in-toto statement: %s", err.Error())
+	}
+	return &statement, nil
+}
+
+// VerifySubject checks that the SHA-256 digest of the manifest is one of the
+// subjects of the statement, or else that every resource of the manifest is a
+// subject of the statement generated with PROVENANCE_RESOURCE_SUBJECTS.
+func VerifySubject(statement *in_toto.Statement, manifestPath string) error {
+
+	manifestDigest, err := utils.ComputeHash(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	resourceSubjects := map[string]string{}
+	for _, subject := range statement.Subject {
+		if subject.Digest["sha256"] == manifestDigest {
+			return nil
+		}
+		resourceSubjects[subject.Name] = subject.Digest["sha256"]
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		return err
+	}
+	objs, err := slsa.SplitResources(manifest)
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return fmt.Errorf("no subject of the attestation matches the digest sha256:%s of %s", manifestDigest, manifestPath)
+	}
+	for _, obj := range objs {
+		name := slsa.ResourceSubjectName(obj)
+		digest, err := slsa.ResourceDigest(obj)
+		if err != nil {
+			return err
+		}
+		if resourceSubjects[name] != digest {
+			return fmt.Errorf("neither the digest sha256:%s of %s nor the digest sha256:%s of its resource %s match a subject of the attestation",
+				manifestDigest, manifestPath, digest, name)
+		}
+	}
+	return nil
+}
+
+// VerifyManifestSignature verifies every resource in the manifest against the signature
+// found in signaturePath, which is either a signed manifest bundle or a resource
+// holding the cosign message and signature, e.g. the live signature resource.
+func VerifyManifestSignature(manifestPath, signaturePath, pubKeyPath string) error {
+
+	pubKeyBytes, err := ioutil.ReadFile(filepath.Clean(pubKeyPath))
+	if err != nil {
+		return err
+	}
+	pubKey, err := cryptoutils.UnmarshalPEMToPublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	if _, ok := pubKey.(*ecdsa.PublicKey); !ok {
+		return fmt.Errorf("k8s-manifest-sigstore verifies manifest signatures with ECDSA keys only, got %T", pubKey)
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Clean(manifestPath))
+	if err != nil {
+		return err
+	}
+
+	signatureBytes, err := ioutil.ReadFile(filepath.Clean(signaturePath))
+	if err != nil {
+		return err
+	}
+
+	message, signature, _, err := getSignature(signatureBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range k8smnfutil.SplitConcatYAMLs(manifestBytes) {
+		var obj unstructured.Unstructured
+		err := yaml.Unmarshal(item, &obj)
+		if err != nil {
+			return err
+		}
+
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[utils.MSG_ANNOTATION_NAME] = message
+		annotations[utils.SIG_ANNOTATION_NAME] = signature
+		obj.SetAnnotations(annotations)
+
+		objBytes, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+
+		vo := &k8smanifest.VerifyManifestOption{}
+		vo.KeyPath = pubKeyPath
+
+		result, err := k8smanifest.VerifyManifest(objBytes, vo)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", obj.GetKind(), obj.GetName(), err.Error())
+		}
+		if !result.Verified {
+			diff := ""
+			if result.Diff != nil {
+				diff = result.Diff.String()
+			}
+			return fmt.Errorf("%s %s is not verified, diff: %s", obj.GetKind(), obj.GetName(), diff)
+		}
+	}
+	return nil
+}
+
+// getSignature returns the cosign message, signature and certificate of the first resource
+// in the signature file that has them, either as annotations or as ConfigMap data.
+// The certificate is empty unless the manifest was signed in keyless mode.
+func getSignature(signatureBytes []byte) (string, string, string, error) {
+
+	for _, item := range k8smnfutil.SplitConcatYAMLs(signatureBytes) {
+		var obj unstructured.Unstructured
+		err := yaml.Unmarshal(item, &obj)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		annotations := obj.GetAnnotations()
+		message := annotations[utils.MSG_ANNOTATION_NAME]
+		signature := annotations[utils.SIG_ANNOTATION_NAME]
+		certificate := annotations[utils.CERT_ANNOTATION_NAME]
+
+		if obj.GetKind() == "ConfigMap" && (message == "" || signature == "") {
+			message, _, _ = unstructured.NestedString(obj.Object, "data", "message")
+			signature, _, _ = unstructured.NestedString(obj.Object, "data", "signature")
+			certificate, _, _ = unstructured.NestedString(obj.Object, "data", "certificate")
+		}
+
+		if message != "" && message != "null" && signature != "" && signature != "null" {
+			return message, signature, certificate, nil
+		}
+	}
+	return "", "", "", fmt.Errorf("no message and signature found in signature file")
+}